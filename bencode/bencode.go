@@ -0,0 +1,122 @@
+// Package bencode encodes and decodes the bencoding of .torrent files and
+// tracker responses.
+//
+// Struct fields map to dictionary keys through `bencode:"key"` tags, with an
+// optional ",omitempty"; a tag of "-" skips the field and an untagged field
+// uses its name. Strings decode into string, []byte and byte arrays of the
+// exact length, integers into any integer kind or bool, and any value into
+// interface{} as int64, string, []interface{} or map[string]interface{}.
+// A RawMessage field keeps the value exactly as it appeared in the input.
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RawMessage is an encoded value that is kept as is when decoding and written
+// verbatim when encoding, e.g. to hash the info dictionary of a torrent
+type RawMessage []byte
+
+// Limits applied by Unmarshal and by a Decoder unless changed
+const (
+	DefaultMaxStringLength = 64 << 20
+	DefaultMaxDepth        = 64
+)
+
+var (
+	// ErrMaxLength is returned for a string longer than the decoder allows
+	ErrMaxLength = errors.New("bencode: string exceeds the maximum length")
+	// ErrMaxDepth is returned for lists and dictionaries nested too deeply
+	ErrMaxDepth = errors.New("bencode: value nested too deeply")
+	// ErrMaxSize is returned when a value is larger than the decoder allows
+	ErrMaxSize = errors.New("bencode: value exceeds the maximum size")
+	// ErrUnsortedKeys is returned by a strict decoder for dictionary keys that
+	// are not in ascending order or appear twice
+	ErrUnsortedKeys = errors.New("bencode: dictionary keys are not sorted")
+)
+
+// SyntaxError reports malformed input at a byte offset
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return "bencode: " + e.Msg + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+// UnmarshalTypeError reports a value that does not fit the Go type it decodes into
+type UnmarshalTypeError struct {
+	Value string
+	Type  reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "bencode: cannot decode " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+// MarshalError reports a Go value that has no bencoding
+type MarshalError struct {
+	Type reflect.Type
+}
+
+func (e *MarshalError) Error() string {
+	return "bencode: unsupported type " + e.Type.String()
+}
+
+// field is a struct field mapped to a dictionary key
+type field struct {
+	key       string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+// fields returns the dictionary fields of a struct type, sorted by key
+func fields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+	var list []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		list = append(list, field{key: name, index: sf.Index, omitEmpty: opts == "omitempty"})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key < list[j].key })
+	fieldCache.Store(t, list)
+	return list
+}
+
+// lookup finds the field for a key, preferring an exact match
+func lookup(list []field, key string) *field {
+	for i := range list {
+		if list[i].key == key {
+			return &list[i]
+		}
+	}
+	for i := range list {
+		if strings.EqualFold(list[i].key, key) {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
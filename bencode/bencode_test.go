@@ -0,0 +1,184 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		setup func(*Decoder)
+		err   error
+	}{
+		{"string at max length", "4:spam", func(d *Decoder) { d.MaxStringLength = 4 }, nil},
+		{"string over max length", "5:spams", func(d *Decoder) { d.MaxStringLength = 4 }, ErrMaxLength},
+		{"huge announced length", "99999999999:x", nil, ErrMaxLength},
+		{"dictionary key over max length", "d5:spamsi1ee", func(d *Decoder) { d.MaxStringLength = 4 }, ErrMaxLength},
+		{"depth at max", "llee", func(d *Decoder) { d.MaxDepth = 2 }, nil},
+		{"depth over max", "llleee", func(d *Decoder) { d.MaxDepth = 2 }, ErrMaxDepth},
+		{"dictionaries count toward depth", "d1:ad1:bleee", func(d *Decoder) { d.MaxDepth = 2 }, ErrMaxDepth},
+		{"default depth", strings.Repeat("l", DefaultMaxDepth+1) + strings.Repeat("e", DefaultMaxDepth+1), nil, ErrMaxDepth},
+		{"size at max", "l4:spami42ee", func(d *Decoder) { d.MaxSize = 12 }, nil},
+		{"size over max", "l4:spami42ee", func(d *Decoder) { d.MaxSize = 11 }, ErrMaxSize},
+		{"string over max size", "l10:0123456789e", func(d *Decoder) { d.MaxSize = 8 }, ErrMaxSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			if tt.setup != nil {
+				tt.setup(d)
+			}
+			var v interface{}
+			if err := d.Decode(&v); !errors.Is(err, tt.err) {
+				t.Fatalf("Decode(%q) = %v, want %v", tt.input, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMaxSizePerValue(t *testing.T) {
+	// MaxSize applies to each value, not to the whole stream
+	d := NewDecoder(strings.NewReader("4:spam4:eggs"))
+	d.MaxSize = 6
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := d.Decode(&s); err != nil {
+			t.Fatalf("Decode #%d: %v", i, err)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		input  string
+		strict bool // whether a strict decoder accepts it
+	}{
+		{"d1:ai1e1:bi2ee", true},
+		{"d1:bi2e1:ai1ee", false},
+		{"d1:ai1e1:ai2ee", false},
+		{"d2:aai1e1:bi2ee", true},
+		{"d1:b0:2:aa0:e", false},
+		{"i0e", true},
+		{"i-1e", true},
+		{"i-0e", false},
+		{"i03e", false},
+		{"i-03e", false},
+		{"i00e", false},
+		{"0:", true},
+		{"04:spam", false},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := Unmarshal([]byte(tt.input), &v); err != nil {
+			t.Errorf("Unmarshal(%q): %v", tt.input, err)
+		}
+		d := NewDecoder(strings.NewReader(tt.input))
+		d.Strict = true
+		err := d.Decode(&v)
+		if (err == nil) != tt.strict {
+			t.Errorf("strict Decode(%q) = %v, want accepted %t", tt.input, err, tt.strict)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	for _, input := range []string{"i12", "ie", "i1-2e", "x", "di1ei2ee", "l4:spa", "3:ab", "-1:a"} {
+		var v interface{}
+		if err := Unmarshal([]byte(input), &v); err == nil {
+			t.Errorf("Unmarshal(%q) = %#v, want an error", input, v)
+		}
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	// Raw values must come back byte for byte, even where they are not canonical
+	tests := []string{
+		"i42e",
+		"i-0e",
+		"4:spam",
+		"l4:spami7ee",
+		"d1:bi2e1:ai1ee",
+		"d4:infod6:lengthi12e4:name1:xee",
+		"d1:ad1:bd1:cleeee",
+	}
+	for _, raw := range tests {
+		var v struct {
+			Before string     `bencode:"a"`
+			Raw    RawMessage `bencode:"r"`
+			After  string     `bencode:"z"`
+		}
+		input := "d1:a3:one1:r" + raw + "1:z3:twoe"
+		if err := Unmarshal([]byte(input), &v); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", input, err)
+		}
+		if string(v.Raw) != raw || v.Before != "one" || v.After != "two" {
+			t.Errorf("Unmarshal(%q) = %q %q %q", input, v.Before, v.Raw, v.After)
+		}
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != input {
+			t.Errorf("Marshal = %q, want %q", out, input)
+		}
+	}
+}
+
+func TestNestedRawMessage(t *testing.T) {
+	var v struct {
+		Outer RawMessage `bencode:"o"`
+		Inner struct {
+			Raw RawMessage `bencode:"r"`
+		} `bencode:"i"`
+	}
+	input := "d1:id1:rl1:xee1:od1:rl1:yeee"
+	if err := Unmarshal([]byte(input), &v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Inner.Raw) != "l1:xe" || string(v.Outer) != "d1:rl1:yee" {
+		t.Errorf("got %q and %q", v.Inner.Raw, v.Outer)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"i42e", "i-7e", "0:", "4:spam", "le", "de",
+		"l4:spami-3ee", "d3:cow3:moo4:spaml1:a1:bee",
+		"d1:bi2e1:ai1ee", "i03e", "d4:infod6:lengthi12e4:name1:xee",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		if err := Unmarshal(data, &v); err != nil {
+			return
+		}
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", v, err)
+		}
+
+		// Our encoding is canonical, a strict decoder takes it and gets the same value
+		d := NewDecoder(bytes.NewReader(out))
+		d.Strict = true
+		var again interface{}
+		if err := d.Decode(&again); err != nil {
+			t.Fatalf("strict Decode(%q): %v", out, err)
+		}
+		if !reflect.DeepEqual(v, again) {
+			t.Fatalf("%q decoded to %#v, re-encoded to %#v", data, v, again)
+		}
+
+		// Input a strict decoder accepts is canonical and re-encodes to itself
+		d = NewDecoder(bytes.NewReader(data))
+		d.Strict = true
+		if d.Decode(&again) == nil && !bytes.Equal(out, data[:d.offset]) {
+			t.Fatalf("strict input %q re-encoded to %q", data[:d.offset], out)
+		}
+	})
+}
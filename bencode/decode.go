@@ -0,0 +1,415 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Decoder reads bencoded values from a stream, one per call to Decode
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+
+	// MaxStringLength bounds every string, MaxDepth the nesting of lists and
+	// dictionaries. Both default to the package defaults.
+	MaxStringLength int
+	MaxDepth        int
+	// MaxSize bounds the encoded size of a single value, zero means no limit
+	MaxSize int64
+	// Strict rejects dictionary keys that are unsorted or repeated and
+	// integers with leading zeros or a negative zero, as the spec requires
+	Strict bool
+
+	// start is the offset of the value being decoded, for MaxSize
+	start int64
+	// raw collects the input while a RawMessage is being decoded
+	raw       []byte
+	recording int
+	// typeErr is the first value that did not fit its Go type
+	typeErr error
+}
+
+// NewDecoder returns a decoder reading from r. It may read past the end of
+// the value it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:               bufio.NewReader(r),
+		MaxStringLength: DefaultMaxStringLength,
+		MaxDepth:        DefaultMaxDepth,
+	}
+}
+
+// Unmarshal decodes the value at the start of data into v, which must be a
+// non-nil pointer. Data after the value is ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Decode reads the next value from the stream into v, which must be a non-nil
+// pointer. It returns io.EOF when the stream ends before a value starts.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("bencode: Decode needs a non-nil pointer")
+	}
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	d.start = d.offset
+	d.typeErr = nil
+	if err := d.value(rv, 0); err != nil {
+		return err
+	}
+	return d.typeErr
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.offset, Msg: msg}
+}
+
+// consumed accounts for n bytes read and enforces MaxSize
+func (d *Decoder) consumed(p []byte) error {
+	d.offset += int64(len(p))
+	if d.MaxSize > 0 && d.offset-d.start > d.MaxSize {
+		return ErrMaxSize
+	}
+	if d.recording > 0 {
+		d.raw = append(d.raw, p...)
+	}
+	return nil
+}
+
+func (d *Decoder) peek() (byte, error) {
+	p, err := d.r.Peek(1)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c, d.consumed([]byte{c})
+}
+
+// readUntil reads the digits of a length or integer up to the delimiter
+func (d *Decoder) readUntil(delim byte) ([]byte, error) {
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == delim {
+			return digits, nil
+		}
+		// Twenty characters hold any int64 with its sign
+		if len(digits) == 20 || (c != '-' && (c < '0' || c > '9')) {
+			return nil, d.syntaxError("invalid number")
+		}
+		digits = append(digits, c)
+	}
+}
+
+// readString reads a string, growing the buffer as data arrives so a large
+// announced length alone cannot exhaust memory
+func (d *Decoder) readString() ([]byte, error) {
+	digits, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(digits))
+	if err != nil || length < 0 || (d.Strict && len(digits) > 1 && digits[0] == '0') {
+		return nil, d.syntaxError("invalid string length")
+	}
+	if length > d.MaxStringLength {
+		return nil, ErrMaxLength
+	}
+	if d.MaxSize > 0 && d.offset-d.start+int64(length) > d.MaxSize {
+		return nil, ErrMaxSize
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(length)); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), d.consumed(buf.Bytes())
+}
+
+func (d *Decoder) readInt() (int64, error) {
+	if _, err := d.readByte(); err != nil { // 'i'
+		return 0, err
+	}
+	digits, err := d.readUntil('e')
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, d.syntaxError("invalid integer")
+	}
+	if d.Strict {
+		s := string(digits)
+		if s == "-0" || (len(s) > 1 && s[0] == '0') || (len(s) > 2 && s[:2] == "-0") {
+			return 0, d.syntaxError("non-canonical integer")
+		}
+	}
+	return n, nil
+}
+
+// typeError remembers the first value that does not fit, decoding carries on
+func (d *Decoder) typeError(value string, t reflect.Type) {
+	if d.typeErr == nil {
+		d.typeErr = &UnmarshalTypeError{Value: value, Type: t}
+	}
+}
+
+// value decodes the next value into v. An invalid v skips the value.
+func (d *Decoder) value(v reflect.Value, depth int) error {
+	if v.IsValid() && v.Type() == rawMessageType {
+		return d.rawMessage(v, depth)
+	}
+	// Allocate pointers on the way to the value
+	for v.IsValid() && v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		if v.IsValid() {
+			d.setInt(v, n)
+		}
+		return nil
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if v.IsValid() {
+			d.setString(v, s)
+		}
+		return nil
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	default:
+		return d.syntaxError("unexpected " + strconv.QuoteRune(rune(c)))
+	}
+}
+
+func (d *Decoder) rawMessage(v reflect.Value, depth int) error {
+	d.recording++
+	begin := len(d.raw)
+	err := d.value(reflect.Value{}, depth)
+	raw := bytes.Clone(d.raw[begin:])
+	d.recording--
+	if d.recording == 0 {
+		d.raw = d.raw[:0]
+	}
+	if err != nil {
+		return err
+	}
+	v.SetBytes(raw)
+	return nil
+}
+
+func (d *Decoder) setInt(v reflect.Value, n int64) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+			return
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+			return
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		d.typeError("integer", v.Type())
+	}
+}
+
+func (d *Decoder) setString(v reflect.Value, s []byte) {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(s)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s):
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		d.typeError("string", v.Type())
+	}
+}
+
+func (d *Decoder) list(v reflect.Value, depth int) error {
+	if depth >= d.MaxDepth {
+		return ErrMaxDepth
+	}
+	if _, err := d.readByte(); err != nil { // 'l'
+		return err
+	}
+	kind := reflect.Invalid
+	if v.IsValid() {
+		kind = v.Kind()
+		switch kind {
+		case reflect.Slice:
+			v.SetLen(0)
+		case reflect.Array:
+		default:
+			d.typeError("list", v.Type())
+			v = reflect.Value{}
+		}
+	}
+	for i := 0; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+		var elem reflect.Value
+		switch {
+		case !v.IsValid():
+		case kind == reflect.Slice:
+			elem = reflect.New(v.Type().Elem()).Elem()
+		case i < v.Len():
+			elem = v.Index(i)
+		}
+		if err := d.value(elem, depth+1); err != nil {
+			return err
+		}
+		if v.IsValid() && kind == reflect.Slice {
+			v.Set(reflect.Append(v, elem))
+		}
+	}
+}
+
+func (d *Decoder) dict(v reflect.Value, depth int) error {
+	if depth >= d.MaxDepth {
+		return ErrMaxDepth
+	}
+	if _, err := d.readByte(); err != nil { // 'd'
+		return err
+	}
+	var structFields []field
+	if v.IsValid() {
+		switch {
+		case v.Kind() == reflect.Struct:
+			structFields = fields(v.Type())
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+		default:
+			d.typeError("dictionary", v.Type())
+			v = reflect.Value{}
+		}
+	}
+	var prev []byte
+	for first := true; ; first = false {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("dictionary key is not a string")
+		}
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.Strict && !first && bytes.Compare(prev, key) >= 0 {
+			return ErrUnsortedKeys
+		}
+		prev = key
+
+		var elem reflect.Value
+		switch {
+		case !v.IsValid():
+		case v.Kind() == reflect.Struct:
+			if f := lookup(structFields, string(key)); f != nil {
+				elem = v.FieldByIndex(f.index)
+			}
+		default:
+			elem = reflect.New(v.Type().Elem()).Elem()
+		}
+		if err := d.value(elem, depth+1); err != nil {
+			return err
+		}
+		if v.IsValid() && v.Kind() == reflect.Map {
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+		}
+	}
+}
+
+// generic decodes a value into int64, string, []interface{} or map[string]interface{}
+func (d *Decoder) generic(depth int) (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		return d.readInt()
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		list := []interface{}{}
+		err := d.list(reflect.ValueOf(&list).Elem(), depth)
+		return list, err
+	case c == 'd':
+		dict := map[string]interface{}{}
+		err := d.dict(reflect.ValueOf(&dict).Elem(), depth)
+		return dict, err
+	default:
+		return nil, d.syntaxError("unexpected " + strconv.QuoteRune(rune(c)))
+	}
+}
@@ -0,0 +1,156 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the bencoding of v. Dictionary keys are written in sorted
+// order, so equal values always encode to the same bytes.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencoding of v
+func (e *Encoder) Encode(v interface{}) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func writeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return &MarshalError{Type: reflect.TypeOf(nil)}
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return &MarshalError{Type: v.Type()}
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &MarshalError{Type: v.Type()}
+		}
+		return encode(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, []byte(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(s), v)
+			writeString(buf, s)
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &MarshalError{Type: v.Type()}
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buf.WriteByte('d')
+		for _, key := range keys {
+			value := v.MapIndex(key)
+			if isNil(value) {
+				continue
+			}
+			writeString(buf, []byte(key.String()))
+			if err := encode(buf, value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range fields(v.Type()) {
+			value := v.FieldByIndex(f.index)
+			if isNil(value) || (f.omitEmpty && isEmpty(value)) {
+				continue
+			}
+			writeString(buf, []byte(f.key))
+			if err := encode(buf, value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &MarshalError{Type: v.Type()}
+	}
+	return nil
+}
+
+// isNil reports values that have nothing to encode, they are left out of dictionaries
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Type() == rawMessageType && v.Len() == 0
+	}
+	return false
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
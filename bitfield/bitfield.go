@@ -1,23 +1,246 @@
 package bitfield
 
-type Bitfield []byte
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
 
-func (bf Bitfield) HasPiece(index int) bool {
-	byteIndex := index / 8
-	offset := index % 8
+var (
+	// ErrOutOfRange is returned for a piece index outside the bitfield
+	ErrOutOfRange = errors.New("bitfield: piece index out of range")
+	// ErrLengthMismatch is returned when combining bitfields of different piece counts
+	ErrLengthMismatch = errors.New("bitfield: piece counts differ")
+)
 
-	if byteIndex < 0 || byteIndex >= len(bf) {
-		return false
+// Bitfield holds one bit per piece, the first piece in the high bit of the
+// first byte. The bits past the last piece are always zero.
+type Bitfield struct {
+	bits      []byte
+	numPieces int
+}
+
+// New returns an empty bitfield for numPieces pieces
+func New(numPieces int) *Bitfield {
+	return &Bitfield{bits: make([]byte, (numPieces+7)/8), numPieces: numPieces}
+}
+
+// FromBytes validates a bitfield in wire format, as a peer sends it. It must
+// be exactly long enough for numPieces and have no spare bits set.
+func FromBytes(data []byte, numPieces int) (*Bitfield, error) {
+	if numPieces < 0 || len(data) != (numPieces+7)/8 {
+		return nil, fmt.Errorf("bitfield: %d bytes for %d pieces, expected %d", len(data), numPieces, (numPieces+7)/8)
+	}
+	bf := New(numPieces)
+	copy(bf.bits, data)
+	if spare := numPieces % 8; spare != 0 && bf.bits[len(bf.bits)-1]&(0xff>>spare) != 0 {
+		return nil, errors.New("bitfield: spare bits set")
+	}
+	return bf, nil
+}
+
+// Len returns the number of pieces
+func (bf *Bitfield) Len() int {
+	return bf.numPieces
+}
+
+// Bytes returns a copy of the bitfield in wire format
+func (bf *Bitfield) Bytes() []byte {
+	return append([]byte(nil), bf.bits...)
+}
+
+// HasPiece reports whether the bit of the piece is set
+func (bf *Bitfield) HasPiece(index int) (bool, error) {
+	if index < 0 || index >= bf.numPieces {
+		return false, ErrOutOfRange
+	}
+	return bf.bits[index/8]>>(7-index%8)&1 != 0, nil
+}
+
+// SetPiece sets the bit of the piece
+func (bf *Bitfield) SetPiece(index int) error {
+	if index < 0 || index >= bf.numPieces {
+		return ErrOutOfRange
+	}
+	bf.bits[index/8] |= 1 << (7 - index%8)
+	return nil
+}
+
+// ClearPiece clears the bit of the piece
+func (bf *Bitfield) ClearPiece(index int) error {
+	if index < 0 || index >= bf.numPieces {
+		return ErrOutOfRange
+	}
+	bf.bits[index/8] &^= 1 << (7 - index%8)
+	return nil
+}
+
+// Count returns the number of pieces set. It counts eight bytes at a time,
+// the spare bits are zero and add nothing.
+func (bf *Bitfield) Count() int {
+	n := 0
+	b := bf.bits
+	for ; len(b) >= 8; b = b[8:] {
+		n += bits.OnesCount64(binary.BigEndian.Uint64(b))
+	}
+	for _, x := range b {
+		n += bits.OnesCount8(x)
+	}
+	return n
+}
+
+// All reports whether every piece is set
+func (bf *Bitfield) All() bool {
+	return bf.Count() == bf.numPieces
+}
+
+// None reports whether no piece is set
+func (bf *Bitfield) None() bool {
+	b := bf.bits
+	for ; len(b) >= 8; b = b[8:] {
+		if binary.BigEndian.Uint64(b) != 0 {
+			return false
+		}
+	}
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
 	}
-	return bf[byteIndex]>>(7-offset)&1 != 0
+	return true
 }
 
-func (bf Bitfield) SetPiece(index int) {
-	byteIndex := index / 8
-	offset := index % 8
+// NextSet returns the first set piece at or after from. Together with
+// NextClear it iterates over the pieces:
+//
+//	for i, ok := bf.NextSet(0); ok; i, ok = bf.NextSet(i + 1) {
+//		...
+//	}
+func (bf *Bitfield) NextSet(from int) (int, bool) {
+	return bf.next(from, 0)
+}
+
+// NextClear returns the first clear piece at or after from
+func (bf *Bitfield) NextClear(from int) (int, bool) {
+	return bf.next(from, ^uint64(0))
+}
 
-	if byteIndex < 0 || byteIndex >= len(bf) {
-		return
+// next scans a word at a time for a bit that differs from the bits of flip
+func (bf *Bitfield) next(from int, flip uint64) (int, bool) {
+	if from < 0 {
+		from = 0
+	}
+	for index := from; index < bf.numPieces; {
+		word := bf.word(index/8) ^ flip
+		// Drop the bits before index, the byte holding it comes first in the word
+		word &= ^uint64(0) >> (index % 8)
+		if word != 0 {
+			found := index/8*8 + bits.LeadingZeros64(word)
+			if found >= bf.numPieces {
+				break
+			}
+			return found, true
+		}
+		index = index/8*8 + 64
+	}
+	return 0, false
+}
+
+// word returns the eight bytes from byteIndex, padded with zeros past the end
+func (bf *Bitfield) word(byteIndex int) uint64 {
+	var buf [8]byte
+	copy(buf[:], bf.bits[byteIndex:])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// And keeps the pieces set in both bitfields
+func (bf *Bitfield) And(other *Bitfield) error {
+	return bf.combine(other, func(a, b uint64) uint64 { return a & b })
+}
+
+// AndNot clears the pieces set in other
+func (bf *Bitfield) AndNot(other *Bitfield) error {
+	return bf.combine(other, func(a, b uint64) uint64 { return a &^ b })
+}
+
+// Or sets the pieces set in other
+func (bf *Bitfield) Or(other *Bitfield) error {
+	return bf.combine(other, func(a, b uint64) uint64 { return a | b })
+}
+
+// combine applies op to both bitfields eight bytes at a time and stores the result in bf
+func (bf *Bitfield) combine(other *Bitfield, op func(a, b uint64) uint64) error {
+	if bf.numPieces != other.numPieces {
+		return ErrLengthMismatch
+	}
+	i := 0
+	for ; i+8 <= len(bf.bits); i += 8 {
+		word := op(binary.BigEndian.Uint64(bf.bits[i:]), binary.BigEndian.Uint64(other.bits[i:]))
+		binary.BigEndian.PutUint64(bf.bits[i:], word)
+	}
+	for ; i < len(bf.bits); i++ {
+		bf.bits[i] = byte(op(uint64(bf.bits[i]), uint64(other.bits[i])))
+	}
+	return nil
+}
+
+// Equal reports whether both bitfields have the same pieces set
+func (bf *Bitfield) Equal(other *Bitfield) bool {
+	return bf.numPieces == other.numPieces && bytes.Equal(bf.bits, other.bits)
+}
+
+// Clone returns an independent copy
+func (bf *Bitfield) Clone() *Bitfield {
+	return &Bitfield{bits: bf.Bytes(), numPieces: bf.numPieces}
+}
+
+// MarshalBinary encodes the piece count as four bytes followed by the bits in wire format
+func (bf *Bitfield) MarshalBinary() ([]byte, error) {
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(bf.bits)), uint32(bf.numPieces))
+	return append(data, bf.bits...), nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary wrote
+func (bf *Bitfield) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("bitfield: binary data too short")
+	}
+	decoded, err := FromBytes(data[4:], int(binary.BigEndian.Uint32(data)))
+	if err != nil {
+		return err
+	}
+	*bf = *decoded
+	return nil
+}
+
+// MarshalText encodes the bitfield as the piece count and the bits in hex, e.g. "12:a5f0"
+func (bf *Bitfield) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(bf.numPieces) + ":" + hex.EncodeToString(bf.bits)), nil
+}
+
+// UnmarshalText decodes what MarshalText wrote
+func (bf *Bitfield) UnmarshalText(text []byte) error {
+	count, encoded, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return fmt.Errorf("bitfield: invalid text %q", text)
+	}
+	numPieces, err := strconv.Atoi(count)
+	if err != nil || numPieces < 0 {
+		return fmt.Errorf("bitfield: invalid piece count %q", count)
+	}
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("bitfield: %w", err)
+	}
+	decoded, err := FromBytes(data, numPieces)
+	if err != nil {
+		return err
 	}
-	bf[byteIndex] |= 1 << (7 - offset)
+	*bf = *decoded
+	return nil
 }
@@ -0,0 +1,317 @@
+package bitfield
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestFromBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		numPieces int
+		ok        bool
+	}{
+		{"empty torrent", []byte{}, 0, true},
+		{"whole bytes", []byte{0xff, 0x00}, 16, true},
+		{"last piece in the low bit", []byte{0x00, 0x01}, 16, true},
+		{"spare bits clear", []byte{0xff, 0xe0}, 11, true},
+		{"one piece", []byte{0x80}, 1, true},
+		{"too short", []byte{0xff}, 9, false},
+		{"too long", []byte{0xff, 0x00, 0x00}, 16, false},
+		{"nothing for one piece", []byte{}, 1, false},
+		{"bytes for no piece", []byte{0x00}, 0, false},
+		{"first spare bit set", []byte{0xff, 0xf0}, 11, false},
+		{"last spare bit set", []byte{0x00, 0x01}, 15, false},
+		{"spare bits of one piece", []byte{0x40}, 1, false},
+		{"negative piece count", []byte{}, -1, false},
+	}
+	for _, test := range tests {
+		bf, err := FromBytes(test.data, test.numPieces)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: FromBytes(%x, %d) took it", test.name, test.data, test.numPieces)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: FromBytes(%x, %d): %v", test.name, test.data, test.numPieces, err)
+			continue
+		}
+		if bf.Len() != test.numPieces || !bytes.Equal(bf.Bytes(), test.data) {
+			t.Errorf("%s: got %d pieces %x", test.name, bf.Len(), bf.Bytes())
+		}
+	}
+}
+
+func TestFromBytesCopies(t *testing.T) {
+	data := []byte{0x80}
+	bf, err := FromBytes(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 0xff
+	if has, _ := bf.HasPiece(1); has {
+		t.Fatal("Bitfield shares the bytes of the message")
+	}
+	bf.Bytes()[0] = 0xff
+	if has, _ := bf.HasPiece(1); has {
+		t.Fatal("Bytes returns the bits themselves")
+	}
+}
+
+func TestPieces(t *testing.T) {
+	bf := New(11)
+	for _, index := range []int{0, 7, 8, 10} {
+		if err := bf.SetPiece(index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []byte{0x81, 0xa0}; !bytes.Equal(bf.Bytes(), want) {
+		t.Fatalf("Got %x, want %x", bf.Bytes(), want)
+	}
+	for index := 0; index < 11; index++ {
+		has, err := bf.HasPiece(index)
+		if want := index == 0 || index == 7 || index == 8 || index == 10; err != nil || has != want {
+			t.Fatalf("HasPiece(%d) = %v, %v", index, has, err)
+		}
+	}
+	if err := bf.ClearPiece(7); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bf.HasPiece(7); has {
+		t.Fatal("Piece still set after ClearPiece")
+	}
+
+	// The spare bits of the last byte are not pieces
+	for _, index := range []int{-1, 11, 15, 16, 1 << 20} {
+		if _, err := bf.HasPiece(index); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("HasPiece(%d) = %v, want ErrOutOfRange", index, err)
+		}
+		if err := bf.SetPiece(index); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("SetPiece(%d) = %v, want ErrOutOfRange", index, err)
+		}
+		if err := bf.ClearPiece(index); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("ClearPiece(%d) = %v, want ErrOutOfRange", index, err)
+		}
+	}
+	if want := []byte{0x80, 0xa0}; !bytes.Equal(bf.Bytes(), want) {
+		t.Fatalf("Out of range calls changed the bits to %x", bf.Bytes())
+	}
+}
+
+// sizes straddle the bytes and the eight byte words the scans work on
+var sizes = []int{1, 5, 7, 8, 9, 13, 63, 64, 65, 100, 127, 128, 129, 1000}
+
+// random returns a bitfield with about one piece in density set
+func random(rng *rand.Rand, numPieces, density int) *Bitfield {
+	bf := New(numPieces)
+	for i := 0; i < numPieces; i++ {
+		if rng.Intn(density) == 0 {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// pieces lists what HasPiece says, one piece at a time
+func pieces(bf *Bitfield) []bool {
+	list := make([]bool, bf.Len())
+	for i := range list {
+		list[i], _ = bf.HasPiece(i)
+	}
+	return list
+}
+
+func TestNext(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, numPieces := range sizes {
+		for _, density := range []int{1, 2, 10, 100} {
+			bf := random(rng, numPieces, density)
+			want := pieces(bf)
+			// Every piece, the spare bits and the words after the last one
+			for from := -1; from <= numPieces+70; from++ {
+				for _, set := range []bool{true, false} {
+					wantIndex, wantOK := 0, false
+					for i := max(from, 0); i < numPieces; i++ {
+						if want[i] == set {
+							wantIndex, wantOK = i, true
+							break
+						}
+					}
+					next, name := bf.NextClear, "NextClear"
+					if set {
+						next, name = bf.NextSet, "NextSet"
+					}
+					if index, ok := next(from); index != wantIndex || ok != wantOK {
+						t.Fatalf("%d pieces %x: %s(%d) = %d, %v, want %d, %v",
+							numPieces, bf.Bytes(), name, from, index, ok, wantIndex, wantOK)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNextAtWordEdges(t *testing.T) {
+	for _, numPieces := range []int{63, 64, 65} {
+		bf := New(numPieces)
+		bf.SetPiece(numPieces - 1)
+		if index, ok := bf.NextSet(0); !ok || index != numPieces-1 {
+			t.Errorf("%d pieces: NextSet(0) = %d, %v, want the last piece", numPieces, index, ok)
+		}
+		if _, ok := bf.NextSet(numPieces); ok {
+			t.Errorf("%d pieces: NextSet past the end found a piece", numPieces)
+		}
+		if _, ok := bf.NextClear(numPieces - 1); ok {
+			t.Errorf("%d pieces: NextClear found a spare bit", numPieces)
+		}
+		if index, ok := bf.NextClear(0); !ok || index != 0 {
+			t.Errorf("%d pieces: NextClear(0) = %d, %v", numPieces, index, ok)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, numPieces := range sizes {
+		for _, density := range []int{1, 2, 3, 50} {
+			bf := random(rng, numPieces, density)
+			want := 0
+			for _, has := range pieces(bf) {
+				if has {
+					want++
+				}
+			}
+			if got := bf.Count(); got != want {
+				t.Fatalf("%d pieces %x: Count() = %d, want %d", numPieces, bf.Bytes(), got, want)
+			}
+			if bf.All() != (want == numPieces) || bf.None() != (want == 0) {
+				t.Fatalf("%d pieces with %d set: All() = %v, None() = %v", numPieces, want, bf.All(), bf.None())
+			}
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	ops := []struct {
+		name string
+		op   func(a, b *Bitfield) error
+		want func(a, b bool) bool
+	}{
+		{"And", (*Bitfield).And, func(a, b bool) bool { return a && b }},
+		{"AndNot", (*Bitfield).AndNot, func(a, b bool) bool { return a && !b }},
+		{"Or", (*Bitfield).Or, func(a, b bool) bool { return a || b }},
+	}
+	for _, op := range ops {
+		for _, numPieces := range sizes {
+			a, b := random(rng, numPieces, 2), random(rng, numPieces, 2)
+			before, other := pieces(a), pieces(b)
+			if err := op.op(a, b); err != nil {
+				t.Fatal(err)
+			}
+			for i, has := range pieces(a) {
+				if has != op.want(before[i], other[i]) {
+					t.Fatalf("%s of %d pieces: piece %d is %v", op.name, numPieces, i, has)
+				}
+			}
+			if !bytes.Equal(packPieces(other), b.Bytes()) {
+				t.Fatalf("%s changed its argument", op.name)
+			}
+		}
+
+		a, b := New(64), New(65)
+		a.SetPiece(3)
+		b.SetPiece(3)
+		if err := op.op(a, b); !errors.Is(err, ErrLengthMismatch) {
+			t.Errorf("%s of 64 and 65 pieces = %v, want ErrLengthMismatch", op.name, err)
+		}
+		if err := op.op(b, New(8)); !errors.Is(err, ErrLengthMismatch) {
+			t.Errorf("%s of 65 and 8 pieces = %v, want ErrLengthMismatch", op.name, err)
+		}
+		if a.Count() != 1 || b.Count() != 1 {
+			t.Errorf("%s changed the bits despite the mismatch", op.name)
+		}
+	}
+}
+
+// packPieces packs a piece list in wire format
+func packPieces(list []bool) []byte {
+	bf := New(len(list))
+	for i, has := range list {
+		if has {
+			bf.SetPiece(i)
+		}
+	}
+	return bf.Bytes()
+}
+
+func TestEqualClone(t *testing.T) {
+	a := random(rand.New(rand.NewSource(4)), 100, 2)
+	before := a.Bytes()
+	b := a.Clone()
+	if !a.Equal(b) {
+		t.Fatal("Clone differs")
+	}
+	for i := 0; i < b.Len(); i++ {
+		b.SetPiece(i)
+	}
+	if !bytes.Equal(a.Bytes(), before) || a.Equal(b) {
+		t.Fatal("Clone shares the bits")
+	}
+	if New(8).Equal(New(7)) {
+		t.Fatal("Bitfields of different piece counts are equal")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for _, numPieces := range append([]int{0}, sizes...) {
+		bf := random(rng, numPieces, 2)
+
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromBinary Bitfield
+		if err := fromBinary.UnmarshalBinary(data); err != nil || !fromBinary.Equal(bf) {
+			t.Fatalf("%d pieces: binary round trip gave %x, %v", numPieces, fromBinary.Bytes(), err)
+		}
+
+		text, err := bf.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromText Bitfield
+		if err := fromText.UnmarshalText(text); err != nil || !fromText.Equal(bf) {
+			t.Fatalf("%d pieces: text round trip of %s gave %x, %v", numPieces, text, fromText.Bytes(), err)
+		}
+	}
+
+	bf := New(12)
+	bf.SetPiece(0)
+	bf.SetPiece(2)
+	bf.SetPiece(11)
+	if text, _ := bf.MarshalText(); string(text) != "12:a010" {
+		t.Fatalf("MarshalText() = %s, want 12:a010", text)
+	}
+	if data, _ := bf.MarshalBinary(); !bytes.Equal(data, []byte{0, 0, 0, 12, 0xa0, 0x10}) {
+		t.Fatalf("MarshalBinary() = %x", data)
+	}
+
+	for _, data := range [][]byte{nil, {0, 0, 0}, {0, 0, 0, 12, 0xa0}, {0, 0, 0, 12, 0xa0, 0x11}, {0, 0, 0, 0, 0}} {
+		var bf Bitfield
+		if err := bf.UnmarshalBinary(data); err == nil {
+			t.Errorf("UnmarshalBinary(%x) took it", data)
+		}
+	}
+	for _, text := range []string{"", "12", "12:a0", "12:a011", "-1:", "x:00", "12:zz10", "0:00"} {
+		var bf Bitfield
+		if err := bf.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) took it", text)
+		}
+	}
+}
@@ -2,30 +2,115 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Harry-kp/nebula/bitfield"
 	"github.com/Harry-kp/nebula/handshake"
 	"github.com/Harry-kp/nebula/message"
+	"github.com/Harry-kp/nebula/mse"
 	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/ratelimit"
 )
 
+// Config holds the optional settings of a peer connection
+type Config struct {
+	// NumPieces is the number of pieces in the torrent, needed to validate the
+	// bitfield of the peer and to expand HAVE ALL
+	NumPieces int
+	// DownloadLimiters and UploadLimiters throttle every byte read from and
+	// written to the connection, e.g. the global and the per-torrent limit
+	DownloadLimiters []*ratelimit.Limiter
+	UploadLimiters   []*ratelimit.Limiter
+	// Encryption decides whether the connection runs over Message Stream Encryption
+	Encryption mse.Policy
+	// Dial opens the connection to a peer, nil dials TCP
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+	// V2 advertises BitTorrent v2 support, for v2 and hybrid torrents
+	V2 bool
+	// IdleTimeout is how long we wait on a silent peer before dropping it,
+	// zero uses DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// KeepAliveInterval is how long we may stay silent before sending a
+	// keep-alive, zero uses DefaultKeepAliveInterval
+	KeepAliveInterval time.Duration
+	// Wanted reports whether we still need a piece, it decides our interest
+	// in the peer. Nil wants every piece.
+	Wanted func(index int) bool
+	// Have holds the pieces we have, announced to the peer right after the
+	// handshake. Nil has none.
+	Have *bitfield.Bitfield
+}
+
+// Client is a connection to a peer. After the handshake a read loop keeps the
+// peer state up to date and passes every message on to Events, and a write
+// loop sends what the Send methods queue.
 type Client struct {
-	Bitfield bitfield.Bitfield
-	Conn     net.Conn
-	Choked   bool
+	// FastExtension is set when both sides support BEP 6
+	FastExtension bool
+	// V2 is set when both sides speak BitTorrent v2 and can exchange hashes
+	V2       bool
+	conn     net.Conn
 	infoHash [20]byte
 	peerID   [20]byte
 	peer     peers.Peer
+	stop     func() bool
+
+	numPieces int
+	wanted    func(index int) bool
+
+	// mu guards the connection state below. The read loop updates it from
+	// the messages of the peer, the Send methods from the ones we queue.
+	mu             sync.Mutex
+	bitfield       *bitfield.Bitfield
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	allowedFast    map[int]bool
+
+	events chan *message.Message
+	queue  writeQueue
+
+	idleTimeout       time.Duration
+	keepAliveInterval time.Duration
+	// lastWrite and lastRead are unix nanoseconds of the last message sent and received
+	lastWrite atomic.Int64
+	lastRead  atomic.Int64
+
+	// done is closed once the connection is shut down, err tells why
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
-func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.HandShake, error) {
+// receiveHandshake answers the handshake of a peer that connected to us
+func receiveHandshake(conn net.Conn, sendHsk *handshake.HandShake) (*handshake.HandShake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Disable the
+	defer conn.SetDeadline(time.Time{})
 
-	sendHsk := handshake.New(peerID, infoHash)
+	resHsk, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(resHsk.InfoHash[:], sendHsk.InfoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x, but got %x", sendHsk.InfoHash, resHsk.InfoHash)
+	}
+
+	if _, err := conn.Write(sendHsk.Serialize()); err != nil {
+		return nil, err
+	}
+	return resHsk, nil
+}
+
+func completeHandshake(conn net.Conn, sendHsk *handshake.HandShake) (*handshake.HandShake, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{}) // Disable the
 
 	_, err := conn.Write(sendHsk.Serialize())
 	if err != nil {
@@ -37,13 +122,35 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 		return nil, err
 	}
 
-	if !bytes.Equal(resHsk.InfoHash[:], infoHash[:]) {
-		return nil, fmt.Errorf("Expected infohash %x, but got %x", infoHash, resHsk.InfoHash)
+	if !bytes.Equal(resHsk.InfoHash[:], sendHsk.InfoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x, but got %x", sendHsk.InfoHash, resHsk.InfoHash)
 	}
 	return resHsk, nil
 }
 
-func fetchBitField(conn net.Conn) (bitfield.Bitfield, error) {
+// sendBitField announces the pieces we have. With the Fast Extension both sides
+// must announce their pieces, HAVE ALL and HAVE NONE stand in for a full or an
+// empty bitfield. Without it an empty bitfield is left out.
+func sendBitField(conn net.Conn, have *bitfield.Bitfield, fast bool) error {
+	var msg *message.Message
+	switch {
+	case fast && (have == nil || have.None()):
+		msg = &message.Message{ID: message.MsgHaveNone}
+	case fast && have.All():
+		msg = &message.Message{ID: message.MsgHaveAll}
+	case have != nil && !have.None():
+		msg = &message.Message{ID: message.MsgBitfield, Payload: have.Bytes()}
+	default:
+		return nil
+	}
+	_, err := conn.Write(msg.Serialize())
+	return err
+}
+
+// fetchBitField reads the pieces the peer has. With the Fast Extension the
+// peer may send HAVE ALL or HAVE NONE instead of a bitfield. A bitfield of the
+// wrong length or with spare bits set is an error, which drops the peer.
+func fetchBitField(conn net.Conn, numPieces int, fast bool) (*bitfield.Bitfield, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
@@ -56,78 +163,311 @@ func fetchBitField(conn net.Conn) (bitfield.Bitfield, error) {
 		return nil, fmt.Errorf("Expected bitfield, but got nil")
 	}
 
-	if msg.ID != message.MsgBitfield {
+	switch {
+	case msg.ID == message.MsgBitfield:
+		return bitfield.FromBytes(msg.Payload, numPieces)
+	case fast && msg.ID == message.MsgHaveAll:
+		bf := bitfield.New(numPieces)
+		for i := 0; i < numPieces; i++ {
+			bf.SetPiece(i)
+		}
+		return bf, nil
+	case fast && msg.ID == message.MsgHaveNone:
+		return bitfield.New(numPieces), nil
+	default:
 		return nil, fmt.Errorf("Expected bitfield, but got ID %d", msg.ID)
 	}
+}
+
+// dial connects to the peer and runs the encryption handshake the policy asks
+// for. With Prefer a peer that fails the encrypted handshake is redialed in plaintext.
+func dial(ctx context.Context, peer peers.Peer, infoHash [20]byte, cfg Config) (net.Conn, error) {
+	policy := cfg.Encryption
+	dialContext := cfg.Dial
+	if dialContext == nil {
+		dialer := net.Dialer{Timeout: 3 * time.Second}
+		dialContext = func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+	}
+	for {
+		rawConn, err := dialContext(ctx, peer.String())
+		if err != nil {
+			return nil, err
+		}
+		conn := limit(ctx, rawConn, cfg)
+		if policy == mse.Disable {
+			return conn, nil
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		encrypted, err := mse.Initiate(conn, infoHash, policy)
+		conn.SetDeadline(time.Time{})
+		if err == nil {
+			return encrypted, nil
+		}
+		conn.Close()
+		if policy != mse.Prefer || ctx.Err() != nil {
+			return nil, err
+		}
+		policy = mse.Disable
+	}
+}
 
-	return msg.Payload, nil
+// limit wraps the connection in the rate limiters of the config, if any
+func limit(ctx context.Context, conn net.Conn, cfg Config) net.Conn {
+	if len(cfg.DownloadLimiters) == 0 && len(cfg.UploadLimiters) == 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, ctx: ctx, down: cfg.DownloadLimiters, up: cfg.UploadLimiters}
 }
 
-func New(peer peers.Peer, infoHash, peerID [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// New dials the peer, completes the handshake and reads its bitfield. The
+// connection is closed as soon as ctx is done, which unblocks any pending read.
+func New(ctx context.Context, peer peers.Peer, infoHash, peerID [20]byte, cfg Config) (*Client, error) {
+	conn, err := dial(ctx, peer, infoHash, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return setup(ctx, conn, peer, infoHash, peerID, cfg, completeHandshake)
+}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+// Accept completes the handshake of a peer that connected to us, including
+// Message Stream Encryption if the peer started with it and the policy allows it.
+func Accept(ctx context.Context, rawConn net.Conn, infoHash, peerID [20]byte, cfg Config) (*Client, error) {
+	peer, err := peers.FromAddr(rawConn.RemoteAddr())
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	conn := limit(ctx, rawConn, cfg)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	encrypted, _, err := mse.Accept(conn, [][20]byte{infoHash}, cfg.Encryption)
+	conn.SetDeadline(time.Time{})
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bitfield, err := fetchBitField(conn)
+	return setup(ctx, encrypted, peer, infoHash, peerID, cfg, receiveHandshake)
+}
+
+// setup runs the BitTorrent handshake over an established connection and reads the peer's pieces
+func setup(ctx context.Context, conn net.Conn, peer peers.Peer, infoHash, peerID [20]byte, cfg Config,
+	shake func(net.Conn, *handshake.HandShake) (*handshake.HandShake, error)) (*Client, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	sendHsk := handshake.New(peerID, infoHash)
+	if cfg.V2 {
+		sendHsk.SetV2()
+	}
+	resHsk, err := shake(conn, sendHsk)
 	if err != nil {
+		stop()
 		conn.Close()
 		return nil, err
 	}
+	fast := resHsk.SupportsFast()
 
-	return &Client{
-		Bitfield: bitfield,
-		Conn:     conn,
-		Choked:   true,
-		infoHash: infoHash,
-		peerID:   peerID,
-		peer:     peer,
-	}, nil
-}
+	if err := sendBitField(conn, cfg.Have, fast); err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
 
-func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
+	bitfield, err := fetchBitField(conn, cfg.NumPieces, fast)
 	if err != nil {
+		stop()
+		conn.Close()
 		return nil, err
 	}
-	return msg, nil
 
+	wanted := cfg.Wanted
+	if wanted == nil {
+		wanted = func(int) bool { return true }
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	keepAliveInterval := cfg.KeepAliveInterval
+	if keepAliveInterval <= 0 {
+		keepAliveInterval = DefaultKeepAliveInterval
+	}
+	c := &Client{
+		FastExtension:     fast,
+		V2:                cfg.V2 && resHsk.SupportsV2(),
+		conn:              conn,
+		infoHash:          infoHash,
+		peerID:            peerID,
+		peer:              peer,
+		stop:              stop,
+		numPieces:         bitfield.Len(),
+		wanted:            wanted,
+		bitfield:          bitfield,
+		amChoking:         true,
+		peerChoking:       true,
+		allowedFast:       make(map[int]bool),
+		events:            make(chan *message.Message, eventBuffer),
+		queue:             writeQueue{wake: make(chan struct{}, 1)},
+		idleTimeout:       idleTimeout,
+		keepAliveInterval: keepAliveInterval,
+		done:              make(chan struct{}),
+	}
+	now := time.Now().UnixNano()
+	c.lastWrite.Store(now)
+	c.lastRead.Store(now)
+	go c.readLoop()
+	go c.writeLoop()
+	return c, nil
+}
+
+// shutdown closes the connection for the given reason, the first one sticks
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.stop()
+		c.conn.Close()
+	})
+}
+
+// Close closes the connection to the peer and stops its read and write loops
+func (c *Client) Close() error {
+	c.shutdown(net.ErrClosed)
+	return nil
+}
+
+// Err returns why the connection was shut down, nil while it is open
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Peer returns the remote peer this client is connected to
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// HasPiece reports whether the peer has the piece, as far as we know
+func (c *Client) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	has, _ := c.bitfield.HasPiece(index)
+	return has
+}
+
+// AmChoking reports whether we are choking the peer
+func (c *Client) AmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+// AmInterested reports whether we told the peer we want pieces from it
+func (c *Client) AmInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amInterested
+}
+
+// PeerChoking reports whether the peer is choking us
+func (c *Client) PeerChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerChoking
+}
+
+// PeerInterested reports whether the peer wants pieces from us
+func (c *Client) PeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerInterested
+}
+
+// UpdateInterest compares the pieces of the peer with the ones we still want
+// and sends Interested or NotInterested if our interest changed. It reports
+// whether we are interested now. Call it when we completed pieces, the read
+// loop takes care of new pieces of the peer.
+func (c *Client) UpdateInterest() (bool, error) {
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interested := false
+	for index, ok := c.bitfield.NextSet(0); ok; index, ok = c.bitfield.NextSet(index + 1) {
+		if c.wanted(index) {
+			interested = true
+			break
+		}
+	}
+	c.setInterest(interested)
+	return interested, nil
+}
+
+// setInterest queues Interested or NotInterested if our interest changed, c.mu must be held
+func (c *Client) setInterest(interested bool) {
+	if interested == c.amInterested {
+		return
+	}
+	c.amInterested = interested
+	id := message.MsgNotInterested
+	if interested {
+		id = message.MsgInterested
+	}
+	c.queue.push(&message.Message{ID: id})
+}
+
+// AllowedFast reports whether we may request the piece even while choked
+func (c *Client) AllowedFast(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allowedFast[index]
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
-	msg := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(message.FormatRequest(index, begin, length))
 }
 
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(&message.Message{ID: message.MsgInterested})
 }
 
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(&message.Message{ID: message.MsgNotInterested})
+}
+
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	return c.write(&message.Message{ID: message.MsgChoke})
 }
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(&message.Message{ID: message.MsgUnchoke})
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(message.FormatHave(index))
+}
+
+// SendHashRequest asks the peer for hashes of a v2 merkle tree
+func (c *Client) SendHashRequest(r message.HashRequest) error {
+	return c.write(message.FormatHashRequest(r))
+}
+
+// SendHashes answers a hash request of the peer
+func (c *Client) SendHashes(r message.HashRequest, hashes [][32]byte) error {
+	return c.write(message.FormatHashes(r, hashes))
+}
+
+// SendHashReject tells the peer we cannot serve its hash request
+func (c *Client) SendHashReject(r message.HashRequest) error {
+	return c.write(message.FormatHashReject(r))
 }
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/bitfield"
+	"github.com/Harry-kp/nebula/handshake"
+	"github.com/Harry-kp/nebula/message"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// remote is the peer end of a test connection
+type remote struct {
+	conn net.Conn
+	// msgs holds what the client sent after the handshake, keep-alives as nil.
+	// It is closed when reading fails.
+	msgs chan *message.Message
+	// gate, while locked, stops reading after the next message so the
+	// writes of the client pile up
+	gate sync.Mutex
+}
+
+// connectPipe runs setup over net.Pipe against a remote that announces have,
+// with or without the Fast Extension
+func connectPipe(t *testing.T, cfg Config, fast bool, have *message.Message) (*Client, *remote) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	b.SetDeadline(deadline)
+	infoHash := [20]byte{1, 2, 3}
+
+	type result struct {
+		c   *Client
+		err error
+	}
+	setupDone := make(chan result, 1)
+	go func() {
+		c, err := setup(context.Background(), a, peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+			infoHash, [20]byte{'-', 'N', 'B'}, cfg, completeHandshake)
+		setupDone <- result{c, err}
+	}()
+
+	if _, err := handshake.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	reply := handshake.New([20]byte{'-', 'R', 'M'}, infoHash)
+	if !fast {
+		reply.Reserved = [8]byte{}
+	}
+	if _, err := b.Write(reply.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	r := &remote{conn: b, msgs: make(chan *message.Message, 1024)}
+	// net.Pipe has no buffer, both sides send their pieces at once
+	go func() {
+		defer close(r.msgs)
+		for {
+			msg, err := message.Read(b)
+			if err != nil {
+				return
+			}
+			r.gate.Lock()
+			r.gate.Unlock()
+			r.msgs <- msg
+		}
+	}()
+	if have != nil {
+		if _, err := b.Write(have.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := <-setupDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	t.Cleanup(func() { res.c.Close() })
+	return res.c, r
+}
+
+// send writes a message to the client
+func (r *remote) send(t *testing.T, msg *message.Message) {
+	t.Helper()
+	if _, err := r.conn.Write(msg.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next message the client sent, failing the test if none comes
+func (r *remote) next(t *testing.T) *message.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-r.msgs:
+		if !ok {
+			t.Fatal("Connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message from the client")
+		return nil
+	}
+}
+
+// expect checks the next message the client sent against want, the payload
+// only if want has one
+func (r *remote) expect(t *testing.T, want *message.Message) *message.Message {
+	t.Helper()
+	msg := r.next(t)
+	if msg == nil || msg.ID != want.ID || (want.Payload != nil && !bytes.Equal(msg.Payload, want.Payload)) {
+		t.Fatalf("Client sent %v, want %v", msg, want)
+	}
+	return msg
+}
+
+// event returns the next event of the client, failing the test if none comes
+func event(t *testing.T, c *Client) *message.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-c.Events():
+		if !ok {
+			t.Fatalf("Events closed: %v", c.Err())
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event from the client")
+		return nil
+	}
+}
+
+func fullBitfield(numPieces int) *message.Message {
+	bf := bitfield.New(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return &message.Message{ID: message.MsgBitfield, Payload: bf.Bytes()}
+}
+
+func TestRejectRequests(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		c, r := connectPipe(t, Config{NumPieces: 4}, fast, fullBitfield(4))
+		if fast {
+			r.expect(t, &message.Message{ID: message.MsgHaveNone})
+		}
+		if !c.AmChoking() {
+			t.Fatal("Client starts unchoking the peer")
+		}
+		r.send(t, message.FormatRequest(2, 16384, 16384))
+		if msg := event(t, c); msg.ID != message.MsgRequest {
+			t.Fatalf("Event %v, want the request", msg)
+		}
+		// A marker after the request tells whether anything was sent in between
+		if err := c.SendHave(3); err != nil {
+			t.Fatal(err)
+		}
+		if fast {
+			// BEP 6: every request gets a piece or a reject, we never upload
+			r.expect(t, message.FormatReject(2, 16384, 16384))
+		}
+		r.expect(t, message.FormatHave(3))
+	}
+}
+
+func TestInterest(t *testing.T) {
+	var mu sync.Mutex
+	done := map[int]bool{0: true}
+	wanted := func(index int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !done[index]
+	}
+	c, r := connectPipe(t, Config{NumPieces: 4, Wanted: wanted}, false, emptyBitfield(4))
+
+	// The peer has nothing, so nothing we want
+	if interested, err := c.UpdateInterest(); err != nil || interested || c.AmInterested() {
+		t.Fatalf("UpdateInterest() = %v, %v for a peer without pieces", interested, err)
+	}
+	// A piece we already have changes nothing
+	r.send(t, message.FormatHave(0))
+	event(t, c)
+	if c.AmInterested() {
+		t.Fatal("Interested in a piece we have")
+	}
+	// A piece we want makes us interested without waiting for UpdateInterest
+	r.send(t, message.FormatHave(2))
+	event(t, c)
+	if !c.AmInterested() {
+		t.Fatal("Not interested in a piece we want")
+	}
+	r.expect(t, &message.Message{ID: message.MsgInterested})
+	if interested, err := c.UpdateInterest(); err != nil || !interested {
+		t.Fatalf("UpdateInterest() = %v, %v with a wanted piece", interested, err)
+	}
+
+	// Once we completed the piece elsewhere, the peer has nothing left for us
+	mu.Lock()
+	done[2] = true
+	mu.Unlock()
+	if interested, err := c.UpdateInterest(); err != nil || interested || c.AmInterested() {
+		t.Fatalf("UpdateInterest() = %v, %v after completing the piece", interested, err)
+	}
+	// Unchanged interest sends nothing, the marker comes right after NotInterested
+	if _, err := c.UpdateInterest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendHave(1); err != nil {
+		t.Fatal(err)
+	}
+	r.expect(t, &message.Message{ID: message.MsgNotInterested})
+	r.expect(t, message.FormatHave(1))
+}
+
+func TestInterestedInSeeder(t *testing.T) {
+	c, r := connectPipe(t, Config{NumPieces: 4}, true, &message.Message{ID: message.MsgHaveAll})
+	r.expect(t, &message.Message{ID: message.MsgHaveNone})
+	if interested, err := c.UpdateInterest(); err != nil || !interested {
+		t.Fatalf("UpdateInterest() = %v, %v for a seeder", interested, err)
+	}
+	r.expect(t, &message.Message{ID: message.MsgInterested})
+
+	c.Close()
+	if _, err := c.UpdateInterest(); err == nil {
+		t.Fatal("UpdateInterest on a closed connection")
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/Harry-kp/nebula/ratelimit"
+)
+
+// MaxLimitedChunk caps a single read or write so a rate limit is applied smoothly
+const maxLimitedChunk = 16 * 1024
+
+// limitedConn charges every byte crossing the connection, handshake and
+// protocol overhead included, to the download and upload limiters
+type limitedConn struct {
+	net.Conn
+	ctx  context.Context
+	down []*ratelimit.Limiter
+	up   []*ratelimit.Limiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedChunk {
+		p = p[:maxLimitedChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if waitErr := ratelimit.WaitAll(c.ctx, c.down, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := min(len(p)-written, maxLimitedChunk)
+		if err := ratelimit.WaitAll(c.ctx, c.up, chunk); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
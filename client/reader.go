@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Harry-kp/nebula/message"
+)
+
+// eventBuffer is how many messages the read loop may get ahead of the consumer
+const eventBuffer = 64
+
+// ErrIdle is returned by Err when the peer was dropped for staying silent
+var ErrIdle = errors.New("Peer was idle for too long")
+
+// Events returns the messages of the peer, keep-alives left out. The channel
+// is closed when the connection is shut down, Err then tells why.
+func (c *Client) Events() <-chan *message.Message {
+	return c.events
+}
+
+// readLoop reads the messages of the peer until the connection fails. The
+// peer state is updated before a message is passed on, so it is current even
+// while nobody consumes the events.
+func (c *Client) readLoop() {
+	defer close(c.events)
+	for {
+		msg, err := message.Read(c.conn)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		if msg == nil {
+			continue
+		}
+		if err := c.update(msg); err != nil {
+			c.shutdown(err)
+			return
+		}
+		select {
+		case c.events <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// update applies a message to the connection state. A new piece we want
+// makes us interested right away. Nebula does not upload, with the Fast
+// Extension every request of the peer gets the reject BEP 6 asks for.
+func (c *Client) update(msg *message.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch msg.ID {
+	case message.MsgChoke:
+		c.peerChoking = true
+	case message.MsgUnchoke:
+		c.peerChoking = false
+	case message.MsgInterested:
+		c.peerInterested = true
+	case message.MsgNotInterested:
+		c.peerInterested = false
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if err := c.bitfield.SetPiece(index); err != nil {
+			return err
+		}
+		if !c.amInterested && c.wanted(index) {
+			c.setInterest(true)
+		}
+	case message.MsgRequest:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		if c.FastExtension {
+			c.queue.push(message.FormatReject(index, begin, length))
+		}
+	case message.MsgAllowedFast:
+		index, err := message.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		c.allowedFast[index] = true
+	}
+	return nil
+}
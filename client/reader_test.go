@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/bitfield"
+	"github.com/Harry-kp/nebula/message"
+)
+
+func emptyBitfield(numPieces int) *message.Message {
+	return &message.Message{ID: message.MsgBitfield, Payload: bitfield.New(numPieces).Bytes()}
+}
+
+func TestStateBeforeEvent(t *testing.T) {
+	const numPieces = 2 * eventBuffer
+	c, r := connectPipe(t, Config{NumPieces: numPieces}, false, emptyBitfield(numPieces))
+
+	r.send(t, &message.Message{ID: message.MsgUnchoke})
+	if msg := event(t, c); msg.ID != message.MsgUnchoke || c.PeerChoking() {
+		t.Fatalf("Event %v delivered before the unchoke was recorded", msg)
+	}
+	r.send(t, &message.Message{ID: message.MsgInterested})
+	if msg := event(t, c); msg.ID != message.MsgInterested || !c.PeerInterested() {
+		t.Fatalf("Event %v delivered before the interest was recorded", msg)
+	}
+
+	// Nobody reads the events now, the state must keep up all the same
+	for i := 0; i <= eventBuffer; i++ {
+		r.send(t, message.FormatHave(i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.HasPiece(eventBuffer) {
+		if time.Now().After(deadline) {
+			t.Fatal("Have not recorded while the events are full")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(c.Events()) != eventBuffer {
+		t.Fatalf("%d events buffered, want %d", len(c.Events()), eventBuffer)
+	}
+	for i := 0; i <= eventBuffer; i++ {
+		if index, err := message.ParseHave(event(t, c)); err != nil || index != i {
+			t.Fatalf("Event #%d is the have of %d, %v", i, index, err)
+		}
+	}
+}
+
+func TestEventsClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(c *Client, r *remote)
+		want  error
+	}{
+		{"peer hangs up", func(c *Client, r *remote) { r.conn.Close() }, io.EOF},
+		{"we close", func(c *Client, r *remote) { c.Close() }, net.ErrClosed},
+		{"bad message", func(c *Client, r *remote) { r.send(t, message.FormatHave(1000)) }, bitfield.ErrOutOfRange},
+	}
+	for _, test := range tests {
+		c, r := connectPipe(t, Config{NumPieces: 4}, false, fullBitfield(4))
+		r.send(t, &message.Message{ID: message.MsgUnchoke})
+		event(t, c)
+		test.close(c, r)
+
+		select {
+		case msg, ok := <-c.Events():
+			if ok {
+				t.Fatalf("%s: got event %v", test.name, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: events not closed", test.name)
+		}
+		if !errors.Is(c.Err(), test.want) {
+			t.Fatalf("%s: Err() = %v, want %v", test.name, c.Err(), test.want)
+		}
+		if err := c.SendHave(1); !errors.Is(err, test.want) {
+			t.Fatalf("%s: SendHave on a closed connection = %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/message"
+)
+
+// DefaultKeepAliveInterval is how long we may stay silent before sending a
+// keep-alive, peers commonly drop connections after two minutes
+const DefaultKeepAliveInterval = 2 * time.Minute
+
+// DefaultIdleTimeout is how long we wait on a silent peer before dropping it.
+// A live peer sends at least a keep-alive every two minutes.
+const DefaultIdleTimeout = 3 * time.Minute
+
+// idleCheckInterval bounds how late a keep-alive or an idle drop may come
+const idleCheckInterval = 5 * time.Second
+
+// maxBatch is how many bytes of queued messages go out in a single write
+const maxBatch = 64 * 1024
+
+// writeQueue holds the messages waiting for the write loop. Control messages
+// overtake data, so a choke or a have is not stuck behind a run of requests.
+type writeQueue struct {
+	mu      sync.Mutex
+	control []*message.Message
+	data    []*message.Message
+	// wake tells the write loop there is something to send
+	wake chan struct{}
+}
+
+// isData reports whether the message belongs to the data class. Cancels
+// stay behind the requests they cancel.
+func isData(msg *message.Message) bool {
+	switch msg.ID {
+	case message.MsgRequest, message.MsgCancel, message.MsgPiece, message.MsgHashes:
+		return true
+	}
+	return false
+}
+
+func (q *writeQueue) push(msg *message.Message) {
+	q.mu.Lock()
+	if isData(msg) {
+		q.data = append(q.data, msg)
+	} else {
+		q.control = append(q.control, msg)
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// batch takes queued messages, control first, and serializes them into one
+// buffer of about maxBatch bytes. Messages that do not fit stay queued.
+func (q *writeQueue) batch() []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var buf []byte
+	for _, queue := range []*[]*message.Message{&q.control, &q.data} {
+		for len(*queue) > 0 && len(buf) < maxBatch {
+			buf = append(buf, (*queue)[0].Serialize()...)
+			(*queue)[0] = nil
+			*queue = (*queue)[1:]
+		}
+	}
+	if len(q.control)+len(q.data) > 0 {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return buf
+}
+
+// write queues a message for the write loop and records our side of the
+// connection state. It fails once the connection is shut down.
+func (c *Client) write(msg *message.Message) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	switch msg.ID {
+	case message.MsgChoke:
+		c.amChoking = true
+	case message.MsgUnchoke:
+		c.amChoking = false
+	case message.MsgInterested:
+		c.amInterested = true
+	case message.MsgNotInterested:
+		c.amInterested = false
+	}
+	c.mu.Unlock()
+	c.queue.push(msg)
+	return nil
+}
+
+// writeLoop sends the queued messages in batches. It sends a keep-alive
+// whenever nothing else was sent for the keep-alive interval and shuts the
+// connection down when the peer has been silent for the idle timeout.
+func (c *Client) writeLoop() {
+	ticker := time.NewTicker(min(idleCheckInterval, c.idleTimeout/2, c.keepAliveInterval/2))
+	defer ticker.Stop()
+	for {
+		var buf []byte
+		select {
+		case <-c.done:
+			return
+		case <-c.queue.wake:
+			buf = c.queue.batch()
+		case <-ticker.C:
+			now := time.Now()
+			if now.Sub(time.Unix(0, c.lastRead.Load())) >= c.idleTimeout {
+				c.shutdown(ErrIdle)
+				return
+			}
+			if now.Sub(time.Unix(0, c.lastWrite.Load())) >= c.keepAliveInterval {
+				buf = (*message.Message)(nil).Serialize()
+			}
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		if _, err := c.conn.Write(buf); err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.lastWrite.Store(time.Now().UnixNano())
+	}
+}
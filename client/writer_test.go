@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/message"
+)
+
+// nextKeepAlive waits for a keep-alive from the client, skipping other messages
+func (r *remote) nextKeepAlive(t *testing.T) time.Time {
+	t.Helper()
+	for {
+		if msg := r.next(t); msg == nil {
+			return time.Now()
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	start := time.Now()
+	c, r := connectPipe(t, Config{NumPieces: 4, KeepAliveInterval: interval}, false, fullBitfield(4))
+
+	first := r.nextKeepAlive(t)
+	if first.Sub(start) < interval {
+		t.Fatalf("Keep-alive after %v, before the interval", first.Sub(start))
+	}
+	second := r.nextKeepAlive(t)
+	if gap := second.Sub(first); gap < interval || gap > 4*interval {
+		t.Fatalf("Keep-alives %v apart, want about %v", gap, interval)
+	}
+
+	// Anything else we send counts as a sign of life
+	stop := time.After(5 * interval)
+	sent := time.Now()
+	for sending := true; sending; {
+		select {
+		case <-stop:
+			sending = false
+		case <-time.After(interval / 4):
+			if err := c.SendHave(1); err != nil {
+				t.Fatal(err)
+			}
+			r.expect(t, message.FormatHave(1))
+		}
+	}
+	if at := r.nextKeepAlive(t); at.Sub(sent) < 5*interval {
+		t.Fatal("Keep-alive sent although the connection was busy")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	c, r := connectPipe(t, Config{NumPieces: 4, IdleTimeout: timeout}, false, fullBitfield(4))
+
+	// A peer sending keep-alives is alive
+	var silent time.Time
+	for deadline := time.Now().Add(3 * timeout); time.Now().Before(deadline); {
+		if _, err := r.conn.Write((*message.Message)(nil).Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		silent = time.Now()
+		time.Sleep(timeout / 4)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("Peer sending keep-alives dropped: %v", err)
+	}
+
+	for msg := range c.Events() {
+		t.Fatalf("Unexpected event %v", msg)
+	}
+	if !errors.Is(c.Err(), ErrIdle) {
+		t.Fatalf("Err() = %v, want ErrIdle", c.Err())
+	}
+	if elapsed := time.Since(silent); elapsed < timeout || elapsed > 5*timeout {
+		t.Fatalf("Dropped after %v of silence, want about %v", elapsed, timeout)
+	}
+}
+
+// fullHashes returns a message of the data class of about 16 KiB
+func fullHashes(index int) *message.Message {
+	r := message.HashRequest{PiecesRoot: [32]byte{1}, Index: index * 512, Length: 512}
+	return message.FormatHashes(r, make([][32]byte, 512))
+}
+
+func TestBatch(t *testing.T) {
+	q := writeQueue{wake: make(chan struct{}, 1)}
+	for i := 0; i < 10; i++ {
+		q.push(fullHashes(i))
+	}
+	q.push(message.FormatRequest(1, 0, 16384))
+	q.push(message.FormatHave(7))
+	q.push(&message.Message{ID: message.MsgChoke})
+
+	// Like the write loop, take a batch whenever the queue wakes us
+	var got []*message.Message
+	for woken := true; woken; {
+		select {
+		case <-q.wake:
+		default:
+			woken = false
+			continue
+		}
+		buf := q.batch()
+		// Only the message that crosses the limit may stick out
+		if len(buf) > maxBatch+len(fullHashes(0).Serialize()) {
+			t.Fatalf("Batch of %d bytes", len(buf))
+		}
+		r := bytes.NewReader(buf)
+		for r.Len() > 0 {
+			msg, err := message.Read(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg)
+		}
+		if len(got) == 2 {
+			t.Fatal("Batch holds the control messages only")
+		}
+	}
+	if len(got) != 13 || got[0].ID != message.MsgHave || got[1].ID != message.MsgChoke {
+		t.Fatalf("Got %d messages starting with %v, %v, want the control messages first", len(got), got[0], got[1])
+	}
+	for i, msg := range got[2:12] {
+		if !bytes.Equal(msg.Serialize(), fullHashes(i).Serialize()) {
+			t.Fatalf("Data message #%d out of order", i)
+		}
+	}
+	if got[12].ID != message.MsgRequest {
+		t.Fatalf("Got %v last, want the request", got[12])
+	}
+	if len(q.control)+len(q.data) > 0 {
+		t.Fatal("Messages left in the queue")
+	}
+}
+
+func TestControlOvertakesData(t *testing.T) {
+	c, r := connectPipe(t, Config{NumPieces: 4}, false, fullBitfield(4))
+
+	// With the remote stalled the write loop sits on its first batch while the rest queues up
+	r.gate.Lock()
+	const numData = 10
+	for i := 0; i < numData; i++ {
+		if err := c.SendHashes(message.HashRequest{PiecesRoot: [32]byte{1}, Index: i * 512, Length: 512}, make([][32]byte, 512)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SendHave(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendChoke(); err != nil {
+		t.Fatal(err)
+	}
+	r.gate.Unlock()
+
+	var order []bool // whether each message we sent is data
+	for len(order) < numData+2 {
+		msg := r.next(t)
+		if msg == nil || msg.ID == message.MsgInterested {
+			continue
+		}
+		order = append(order, isData(msg))
+	}
+	if !order[len(order)-1] {
+		t.Fatalf("Control messages did not overtake the queued data, order %v", order)
+	}
+	if !c.AmChoking() {
+		t.Fatal("Choke not recorded")
+	}
+}
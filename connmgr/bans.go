@@ -0,0 +1,124 @@
+package connmgr
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// DefaultBanStrikes is the number of corrupt pieces a peer may send before it is banned
+const DefaultBanStrikes = 2
+
+// Bans keeps the peers caught sending corrupt data. Peers are known by IP, so
+// reconnecting from another port does not help them.
+type Bans struct {
+	mu        sync.Mutex
+	threshold int
+	key       func(peers.Peer) string
+	strikes   map[string]int
+	banned    map[string]bool
+}
+
+// NewBans returns an empty ban list banning peers after threshold strikes
+func NewBans(threshold int) *Bans {
+	return &Bans{
+		threshold: max(threshold, 1),
+		key:       IPKey,
+		strikes:   make(map[string]int),
+		banned:    make(map[string]bool),
+	}
+}
+
+// LoadBans reads a ban list saved by Save. A missing file gives an empty list.
+func LoadBans(path string, threshold int) (*Bans, error) {
+	b := NewBans(threshold)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			b.banned[key] = true
+		}
+	}
+	return b, scanner.Err()
+}
+
+// Save writes the banned peers to path, one per line
+func (b *Bans) Save(path string) error {
+	b.mu.Lock()
+	keys := make([]string, 0, len(b.banned))
+	for key := range b.banned {
+		keys = append(keys, key)
+	}
+	b.mu.Unlock()
+	sort.Strings(keys)
+	var data []byte
+	for _, key := range keys {
+		data = append(data, key+"\n"...)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// IPKey tells peers apart by IP, the default of a ban list
+func IPKey(peer peers.Peer) string {
+	return peer.IP.String()
+}
+
+// AddrKey tells peers apart by IP and port. It suits local test swarms where
+// every peer shares one IP, not real ones.
+func AddrKey(peer peers.Peer) string {
+	return peer.String()
+}
+
+// SetKey changes how peers are told apart, nil restores IPKey. Strikes and
+// bans recorded so far keep their keys.
+func (b *Bans) SetKey(key func(peers.Peer) string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if key == nil {
+		key = IPKey
+	}
+	b.key = key
+}
+
+// Strike counts a corrupt piece against the peer and reports whether that got it banned
+func (b *Bans) Strike(peer peers.Peer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := b.key(peer)
+	if b.banned[key] {
+		return false
+	}
+	b.strikes[key]++
+	if b.strikes[key] < b.threshold {
+		return false
+	}
+	b.banned[key] = true
+	return true
+}
+
+// Banned reports whether the peer is banned
+func (b *Bans) Banned(peer peers.Peer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[b.key(peer)]
+}
+
+// Len returns the number of banned peers
+func (b *Bans) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.banned)
+}
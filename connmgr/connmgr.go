@@ -0,0 +1,480 @@
+// Package connmgr decides which peers get a connection: it caps connections
+// globally, per torrent and while dialing, ranks candidate peers, keeps the
+// ban list and the IP filter and replaces connections that turn out slow
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/ipfilter"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+const (
+	// DefaultMaxConns is the global number of peer connections across all torrents
+	DefaultMaxConns = 200
+	// DefaultMaxConnsPerTorrent is the number of peer connections a single torrent may use
+	DefaultMaxConnsPerTorrent = 50
+	// DefaultMaxHalfOpen is the number of dials that may be in flight at once
+	DefaultMaxHalfOpen = 20
+)
+
+// MaxFailures is the number of failed sessions after which a candidate is forgotten
+const maxFailures = 5
+
+// RetryBackoff is how long a failed candidate waits before it may be dialed again, per failure
+const retryBackoff = 30 * time.Second
+
+// MinConnAge is how long a connection is given before it can be replaced for being slow
+const minConnAge = time.Minute
+
+// IdleTimeout is how long a connection may go without delivering data before it can be replaced
+const idleTimeout = 90 * time.Second
+
+// SlowFactor is how many times slower than the swarm average a connection must be to get replaced
+const slowFactor = 4
+
+// Source tells where a candidate peer came from. Lower values rank higher.
+//
+// Every peer source must hand its peers to Swarm.AddPeers with its own Source,
+// never dial them directly. AddPeers is the only place the BEP 27 rule of
+// AllowedPrivate is enforced, so a new source (PEX, DHT, LSD, ...) that
+// bypasses it would leak peers into private swarms.
+type Source int
+
+const (
+	SourceTracker Source = iota
+	SourceIncoming
+	SourceLSD
+	SourcePEX
+	SourceDHT
+)
+
+// AllowedPrivate reports whether a private torrent (BEP 27) may use peers from
+// the source. Only the tracker hands out peers, those connecting to us found us there.
+// A new Source must be added here only if BEP 27 allows it.
+func (src Source) AllowedPrivate() bool {
+	return src == SourceTracker || src == SourceIncoming
+}
+
+// DialTimeout bounds a single connection attempt over one transport
+const dialTimeout = 3 * time.Second
+
+// Transport connects to peers over one protocol, e.g. uTP or TCP
+type Transport struct {
+	Name string
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// TCP dials peers over TCP
+var TCP = Transport{
+	Name: "tcp",
+	Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	},
+}
+
+// Manager enforces the limits shared by every torrent
+type Manager struct {
+	mu         sync.Mutex
+	maxConns   int
+	conns      int
+	halfOpen   chan struct{}
+	transports []Transport
+	bans       *Bans
+	filter     *ipfilter.Filter
+}
+
+// Default is the manager used when a torrent is not given one
+var Default = NewManager(DefaultMaxConns, DefaultMaxHalfOpen)
+
+// NewManager creates a manager allowing maxConns connections of which at most
+// maxHalfOpen may be dialing at the same time
+func NewManager(maxConns, maxHalfOpen int) *Manager {
+	return &Manager{
+		maxConns:   maxConns,
+		halfOpen:   make(chan struct{}, max(maxHalfOpen, 1)),
+		transports: []Transport{TCP},
+		bans:       NewBans(DefaultBanStrikes),
+	}
+}
+
+// SetBans replaces the ban list shared by every torrent, e.g. with one loaded from disk
+func (m *Manager) SetBans(bans *Bans) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans = bans
+}
+
+// Bans returns the ban list shared by every torrent
+func (m *Manager) Bans() *Bans {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bans
+}
+
+// SetFilter blocks the address ranges of filter, nil blocks nothing
+func (m *Manager) SetFilter(filter *ipfilter.Filter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filter = filter
+}
+
+// refused reports whether we must not talk to peer at all, because it is
+// banned or in a range of the IP filter
+func (m *Manager) refused(peer peers.Peer) bool {
+	m.mu.Lock()
+	bans, filter := m.bans, m.filter
+	m.mu.Unlock()
+	return bans.Banned(peer) || filter.Blocked(peer.IP)
+}
+
+// SetTransports sets the transports tried in order when dialing a peer
+func (m *Manager) SetTransports(transports ...Transport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transports = transports
+}
+
+func (m *Manager) reserve() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns >= m.maxConns {
+		return false
+	}
+	m.conns++
+	return true
+}
+
+func (m *Manager) release() {
+	m.mu.Lock()
+	m.conns--
+	m.mu.Unlock()
+}
+
+type candidate struct {
+	peer       peers.Peer
+	source     Source
+	failures   int
+	lastFailed time.Time
+	downloaded int64
+	// unreachable holds the transports this peer could not be dialed over
+	unreachable map[string]bool
+}
+
+// score ranks candidates by where they came from and how they did before
+func (c *candidate) score() float64 {
+	return float64(c.downloaded)/(1<<20) - float64(c.source)*10 - float64(c.failures)*20
+}
+
+type conn struct {
+	cand         *candidate
+	closer       func() error
+	connectedAt  time.Time
+	lastActivity time.Time
+	downloaded   int64
+	// replaced is set when ReplaceSlow closed the connection, which is no fault of the peer
+	replaced bool
+}
+
+// Swarm manages the candidate peers and connections of a single torrent
+type Swarm struct {
+	m          *Manager
+	maxConns   int
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	active     map[string]*conn
+	private    bool
+}
+
+// NewSwarm creates the per-torrent view of the manager allowing maxConns connections
+func (m *Manager) NewSwarm(maxConns int) *Swarm {
+	return &Swarm{
+		m:          m,
+		maxConns:   maxConns,
+		candidates: make(map[string]*candidate),
+		active:     make(map[string]*conn),
+	}
+}
+
+// SetPrivate restricts the swarm of a private torrent to peers from sources
+// that AllowedPrivate accepts
+func (s *Swarm) SetPrivate(private bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.private = private
+}
+
+// AddPeers queues peers as candidates for a connection. Banned and filtered
+// peers are dropped, as are peers of a private swarm from a source it may not use.
+// It is the entry point for every peer source and the one place AllowedPrivate
+// is checked.
+func (s *Swarm) AddPeers(list []peers.Peer, source Source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.private && !source.AllowedPrivate() {
+		return
+	}
+	for _, peer := range list {
+		if s.m.refused(peer) {
+			continue
+		}
+		addr := peer.String()
+		if c, ok := s.candidates[addr]; ok {
+			c.source = min(c.source, source)
+			continue
+		}
+		s.candidates[addr] = &candidate{peer: peer, source: source}
+	}
+}
+
+// Active returns the number of peers holding a connection slot
+func (s *Swarm) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// Waiting returns the number of candidates that could be dialed right now
+func (s *Swarm) Waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ready(time.Now()))
+}
+
+func (s *Swarm) ready(now time.Time) []*candidate {
+	var list []*candidate
+	for addr, c := range s.candidates {
+		if _, busy := s.active[addr]; busy {
+			continue
+		}
+		if c.failures > 0 && now.Sub(c.lastFailed) < time.Duration(c.failures)*retryBackoff {
+			continue
+		}
+		// The filter may have been reloaded since the peer was added
+		if s.m.refused(c.peer) {
+			continue
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// Reserve takes a connection slot for the best ranked candidate. The caller
+// must hand the slot back with Release once it is done with the peer.
+func (s *Swarm) Reserve() (peers.Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.active) >= s.maxConns {
+		return peers.Peer{}, false
+	}
+	list := s.ready(time.Now())
+	if len(list) == 0 {
+		return peers.Peer{}, false
+	}
+	if !s.m.reserve() {
+		return peers.Peer{}, false
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].score() > list[j].score() })
+	best := list[0]
+	now := time.Now()
+	s.active[best.peer.String()] = &conn{cand: best, connectedAt: now, lastActivity: now}
+	return best.peer, true
+}
+
+// Dial runs connect while holding one of the global half-open slots
+func (s *Swarm) Dial(ctx context.Context, connect func() error) error {
+	select {
+	case s.m.halfOpen <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.m.halfOpen }()
+	return connect()
+}
+
+// DialContext connects to the peer at addr over the first transport that
+// works, skipping the ones that failed for it before. It fits client.Config.Dial.
+func (s *Swarm) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	s.m.mu.Lock()
+	transports := s.m.transports
+	s.m.mu.Unlock()
+
+	var errs []error
+	for _, transport := range transports {
+		s.mu.Lock()
+		c := s.candidates[addr]
+		skip := c != nil && c.unreachable[transport.Name]
+		s.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		conn, err := transport.Dial(dialCtx, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		s.mu.Lock()
+		if c != nil {
+			if c.unreachable == nil {
+				c.unreachable = make(map[string]bool)
+			}
+			c.unreachable[transport.Name] = true
+			// Give every transport another chance once all of them failed
+			if len(c.unreachable) == len(transports) {
+				c.unreachable = nil
+			}
+		}
+		s.mu.Unlock()
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("No transport to dial " + addr)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ReserveIncoming takes a connection slot for a peer that connected to us
+func (s *Swarm) ReserveIncoming(peer peers.Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := peer.String()
+	if _, busy := s.active[addr]; busy || len(s.active) >= s.maxConns || s.m.refused(peer) {
+		return false
+	}
+	if !s.m.reserve() {
+		return false
+	}
+	c, ok := s.candidates[addr]
+	if !ok {
+		c = &candidate{peer: peer, source: SourceIncoming}
+		s.candidates[addr] = c
+	}
+	now := time.Now()
+	s.active[addr] = &conn{cand: c, connectedAt: now, lastActivity: now}
+	return true
+}
+
+// Connected registers how to close the established connection to peer, so
+// that it can be replaced when it turns out to be idle or slow
+func (s *Swarm) Connected(peer peers.Peer, closer func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.active[peer.String()]; ok {
+		now := time.Now()
+		c.closer = closer
+		c.connectedAt = now
+		c.lastActivity = now
+	}
+}
+
+// Record credits peer with n downloaded bytes
+func (s *Swarm) Record(peer peers.Peer, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.active[peer.String()]; ok {
+		c.downloaded += int64(n)
+		c.cand.downloaded += int64(n)
+		c.lastActivity = time.Now()
+	}
+}
+
+// Strike counts a corrupt piece against the peer. Once that gets it banned,
+// every connection to it is closed and it is never dialed again. It reports
+// whether the peer got banned.
+func (s *Swarm) Strike(peer peers.Peer) bool {
+	bans := s.m.Bans()
+	if !bans.Strike(peer) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, c := range s.candidates {
+		if bans.Banned(c.peer) {
+			delete(s.candidates, addr)
+		}
+	}
+	for _, c := range s.active {
+		if c.closer != nil && bans.Banned(c.cand.peer) {
+			c.closer()
+		}
+	}
+	return true
+}
+
+// Banned reports whether the peer is banned
+func (s *Swarm) Banned(peer peers.Peer) bool {
+	return s.m.Bans().Banned(peer)
+}
+
+// Release hands the slot of peer back. A failed peer is retried later with
+// a backoff, and forgotten after too many failures. A connection closed by
+// ReplaceSlow never counts as failed, the peer was only slower than the rest.
+func (s *Swarm) Release(peer peers.Peer, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := peer.String()
+	active, ok := s.active[addr]
+	if !ok {
+		return
+	}
+	delete(s.active, addr)
+	s.m.release()
+	c := s.candidates[addr]
+	if c == nil || !failed || active.replaced {
+		return
+	}
+	c.failures++
+	c.lastFailed = time.Now()
+	if c.failures >= maxFailures {
+		delete(s.candidates, addr)
+	}
+}
+
+// ReplaceSlow closes the worst connection when the swarm is full, other
+// candidates are waiting and that connection is idle or far slower than the
+// rest. It reports whether a connection was closed.
+func (s *Swarm) ReplaceSlow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.active) < s.maxConns || len(s.ready(now)) == 0 {
+		return false
+	}
+	var worst *conn
+	var worstRate, total float64
+	eligible := 0
+	for _, c := range s.active {
+		age := now.Sub(c.connectedAt)
+		if c.closer == nil || age < minConnAge {
+			continue
+		}
+		rate := float64(c.downloaded) / age.Seconds()
+		total += rate
+		eligible++
+		if now.Sub(c.lastActivity) >= idleTimeout {
+			rate = -1
+		}
+		if worst == nil || rate < worstRate {
+			worst, worstRate = c, rate
+		}
+	}
+	if worst == nil || (worstRate >= 0 && worstRate >= total/float64(eligible)/slowFactor) {
+		return false
+	}
+	worst.closer()
+	worst.closer = nil
+	worst.replaced = true
+	return true
+}
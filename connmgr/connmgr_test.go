@@ -0,0 +1,279 @@
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// peer returns test peer n at 10.0.0.n:6881
+func peer(n byte) peers.Peer {
+	return peers.Peer{IP: net.IPv4(10, 0, 0, n).To4(), Port: 6881}
+}
+
+func mustReserve(t *testing.T, s *Swarm) peers.Peer {
+	t.Helper()
+	p, ok := s.Reserve()
+	if !ok {
+		t.Fatal("Reserve found no slot")
+	}
+	return p
+}
+
+func TestCaps(t *testing.T) {
+	m := NewManager(3, 1)
+	a, b := m.NewSwarm(2), m.NewSwarm(2)
+	a.AddPeers([]peers.Peer{peer(1), peer(2), peer(3)}, SourceTracker)
+	b.AddPeers([]peers.Peer{peer(4), peer(5)}, SourceTracker)
+
+	first := mustReserve(t, a)
+	mustReserve(t, a)
+	if _, ok := a.Reserve(); ok {
+		t.Fatal("Reserve went over the per-torrent cap")
+	}
+	if a.ReserveIncoming(peer(9)) {
+		t.Fatal("ReserveIncoming went over the per-torrent cap")
+	}
+	mustReserve(t, b)
+	if _, ok := b.Reserve(); ok {
+		t.Fatal("Reserve went over the global cap")
+	}
+	if b.ReserveIncoming(peer(8)) {
+		t.Fatal("ReserveIncoming went over the global cap")
+	}
+
+	a.Release(first, false)
+	if a.Active() != 1 {
+		t.Fatalf("Active = %d after a release, want 1", a.Active())
+	}
+	// The freed global slot is open to any torrent
+	if !b.ReserveIncoming(peer(8)) {
+		t.Fatal("ReserveIncoming found no slot after a release")
+	}
+	if b.ReserveIncoming(peer(8)) {
+		t.Fatal("ReserveIncoming took a second slot for the same peer")
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	s := NewManager(10, 2).NewSwarm(10)
+	var dialing, most atomic.Int32
+	release := make(chan struct{})
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			done <- s.Dial(context.Background(), func() error {
+				n := dialing.Add(1)
+				for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+				}
+				<-release
+				dialing.Add(-1)
+				return nil
+			})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := dialing.Load(); n != 2 {
+		t.Fatalf("%d dials in flight, want 2", n)
+	}
+	// A dial waiting for a slot gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Dial(ctx, func() error { return nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dial = %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := most.Load(); n != 2 {
+		t.Fatalf("Up to %d dials were in flight, want 2", n)
+	}
+}
+
+func TestRanking(t *testing.T) {
+	s := NewManager(10, 1).NewSwarm(10)
+	s.AddPeers([]peers.Peer{peer(5)}, SourceDHT)
+	s.AddPeers([]peers.Peer{peer(4)}, SourcePEX)
+	s.AddPeers([]peers.Peer{peer(3)}, SourceLSD)
+	s.AddPeers([]peers.Peer{peer(1), peer(2)}, SourceTracker)
+	// A peer seen again from a better source ranks by the better one
+	s.AddPeers([]peers.Peer{peer(5)}, SourceTracker)
+	s.Record(peer(2), 1) // not connected, not credited
+
+	// Tracker peers come first, then by source
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		p := mustReserve(t, s)
+		got[p.String()] = true
+	}
+	for _, n := range []byte{1, 2, 5} {
+		if p := peer(n); !got[p.String()] {
+			t.Fatalf("Reserved %v, want the tracker peers 1, 2 and 5", got)
+		}
+	}
+	if p := mustReserve(t, s); !p.IP.Equal(peer(3).IP) {
+		t.Fatalf("Reserved %v, want the LSD peer", p)
+	}
+	for _, n := range []byte{1, 2, 3, 5} {
+		s.Release(peer(n), false)
+	}
+
+	// A failed peer waits out its backoff, then ranks below the others of its source
+	p := mustReserve(t, s)
+	s.Release(p, true)
+	var others []peers.Peer
+	for i := 0; i < 4; i++ {
+		next := mustReserve(t, s)
+		if next.String() == p.String() {
+			t.Fatal("Failed peer redialed during its backoff")
+		}
+		others = append(others, next)
+	}
+	if _, ok := s.Reserve(); ok {
+		t.Fatal("Failed peer redialed during its backoff")
+	}
+	for _, other := range others {
+		s.Release(other, false)
+	}
+	s.mu.Lock()
+	for _, c := range s.candidates {
+		c.lastFailed = time.Now().Add(-time.Hour)
+	}
+	s.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if next := mustReserve(t, s); next.String() == p.String() {
+			t.Fatal("Failed peer ranked above the other tracker peers")
+		}
+	}
+	if s.Waiting() != 3 {
+		t.Fatalf("%d candidates waiting, want the failed peer back among them", s.Waiting())
+	}
+}
+
+func TestDownloadedRanksFirst(t *testing.T) {
+	s := NewManager(10, 1).NewSwarm(10)
+	s.AddPeers([]peers.Peer{peer(1)}, SourceTracker)
+	s.AddPeers([]peers.Peer{peer(2)}, SourceDHT)
+	p := mustReserve(t, s)
+	s.Release(p, false)
+	// Enough data makes up for a worse source
+	if !s.ReserveIncoming(peer(2)) {
+		t.Fatal("ReserveIncoming found no slot")
+	}
+	s.Record(peer(2), 100<<20)
+	s.Release(peer(2), false)
+	if p := mustReserve(t, s); !p.IP.Equal(peer(2).IP) {
+		t.Fatalf("Reserved %v, want the peer that delivered data", p)
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	s := NewManager(10, 1).NewSwarm(10)
+	s.AddPeers([]peers.Peer{peer(1)}, SourceTracker)
+	for i := 0; i < maxFailures; i++ {
+		s.mu.Lock()
+		for _, c := range s.candidates {
+			c.lastFailed = time.Time{}
+		}
+		s.mu.Unlock()
+		s.Release(mustReserve(t, s), true)
+	}
+	if _, ok := s.Reserve(); ok || s.Waiting() != 0 {
+		t.Fatalf("Peer still a candidate after %d failures", maxFailures)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	for _, source := range []Source{SourceTracker, SourceIncoming, SourceLSD, SourcePEX, SourceDHT} {
+		s := NewManager(10, 1).NewSwarm(10)
+		s.SetPrivate(true)
+		s.AddPeers([]peers.Peer{peer(1)}, source)
+		if got := s.Waiting() == 1; got != source.AllowedPrivate() {
+			t.Errorf("Private swarm took a peer from source %d: %t, want %t", source, got, source.AllowedPrivate())
+		}
+		if source != SourceTracker && source != SourceIncoming && source.AllowedPrivate() {
+			t.Errorf("Source %d allowed in private swarms", source)
+		}
+		// Public swarms take every source
+		s.SetPrivate(false)
+		s.AddPeers([]peers.Peer{peer(2)}, source)
+		if s.Waiting() == 0 {
+			t.Errorf("Public swarm dropped a peer from source %d", source)
+		}
+	}
+	// Peers connecting to a private swarm found it through the tracker
+	s := NewManager(10, 1).NewSwarm(10)
+	s.SetPrivate(true)
+	if !s.ReserveIncoming(peer(1)) {
+		t.Fatal("Private swarm refused an incoming peer")
+	}
+}
+
+func TestRefused(t *testing.T) {
+	m := NewManager(10, 1)
+	m.SetBans(NewBans(1))
+	s := m.NewSwarm(10)
+	s.AddPeers([]peers.Peer{peer(1), peer(2)}, SourceTracker)
+	if !s.Strike(peer(1)) {
+		t.Fatal("Strike did not ban at the threshold")
+	}
+	// Banned peers are dropped and refused, whatever their port
+	other := peer(1)
+	other.Port++
+	s.AddPeers([]peers.Peer{other}, SourceTracker)
+	if s.Waiting() != 1 || s.ReserveIncoming(other) {
+		t.Fatal("Banned peer still accepted")
+	}
+}
+
+func TestReplaceSlow(t *testing.T) {
+	s := NewManager(10, 1).NewSwarm(2)
+	s.AddPeers([]peers.Peer{peer(1), peer(2), peer(3)}, SourceTracker)
+	closed := map[string]bool{}
+	var reserved []peers.Peer
+	for i := 0; i < 2; i++ {
+		p := mustReserve(t, s)
+		reserved = append(reserved, p)
+		s.Connected(p, func() error {
+			closed[p.String()] = true
+			return nil
+		})
+	}
+	if s.ReplaceSlow() {
+		t.Fatal("Replaced a connection younger than minConnAge")
+	}
+	s.mu.Lock()
+	for _, c := range s.active {
+		c.connectedAt = time.Now().Add(-2 * minConnAge)
+	}
+	s.mu.Unlock()
+	fast, slow := reserved[0], reserved[1]
+	s.Record(fast, 10<<20)
+	s.Record(slow, 1<<10)
+	if !s.ReplaceSlow() || !closed[slow.String()] || closed[fast.String()] {
+		t.Fatalf("Closed %v, want only the slow peer %v", closed, slow)
+	}
+	if s.ReplaceSlow() {
+		t.Fatal("Replaced a connection twice")
+	}
+
+	// The worker sees the closed connection fail, the peer must not pay for it
+	s.Release(slow, true)
+	s.mu.Lock()
+	failures := s.candidates[slow.String()].failures
+	s.mu.Unlock()
+	if failures != 0 {
+		t.Fatalf("Replaced peer has %d failures, want 0", failures)
+	}
+	if s.Waiting() != 2 {
+		t.Fatalf("%d candidates waiting, want the replaced peer and the unused one", s.Waiting())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCreate implements `nebula create`, writing a .torrent for a file or directory
+func runCreate(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds stringList
+	fs.Var(&trackers, "tracker", "Announce URL, may be repeated to build an announce-list (required)")
+	fs.Var(&webSeeds, "webseed", "Web seed URL (BEP 19), may be repeated")
+	outputFile := fs.String("output", "", "Path of the .torrent to write (default: <name>.torrent)")
+	pieceLength := fs.Int("piece-length", 0, "Piece length in KiB, a power of two (default: picked from the content size)")
+	comment := fs.String("comment", "", "Comment stored in the torrent")
+	createdBy := fs.String("created-by", "nebula", "Created by field of the torrent")
+	noDate := fs.Bool("no-date", false, "Leave out the creation date so the output is reproducible")
+	private := fs.Bool("private", false, "Mark the torrent private (BEP 27)")
+	source := fs.String("source", "", "Source tag stored in the info dictionary")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nebula create [flags] <file or directory>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || len(trackers) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path, err := resolveFilePath(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Error resolving path:", err)
+		os.Exit(1)
+	}
+
+	opts := torrentfile.CreateOptions{
+		Trackers:    trackers,
+		PieceLength: *pieceLength * 1024,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		Source:      *source,
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+	data, err := torrentfile.Create(path, opts)
+	if err != nil {
+		fmt.Println("Error creating torrent:", err)
+		os.Exit(1)
+	}
+
+	out := *outputFile
+	if out == "" {
+		out = filepath.Base(path) + ".torrent"
+	}
+	if err := os.WriteFile(out, data, 0644); err != nil {
+		fmt.Println("Error writing torrent:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Created", out)
+}
@@ -5,12 +5,37 @@ import (
 	"io"
 )
 
+// The reserved bytes advertise protocol extensions, Fast Extension (BEP 6) is
+// bit 0x04 of the last byte and BitTorrent v2 (BEP 52) bit 0x10
+const (
+	fastExtensionByte = 7
+	fastExtensionBit  = 0x04
+	v2Byte            = 7
+	v2Bit             = 0x10
+)
+
 type HandShake struct {
 	Pstr     string
+	Reserved [8]byte
 	PeerID   [20]byte
 	InfoHash [20]byte
 }
 
+// SupportsFast reports whether the Fast Extension bit is set
+func (h *HandShake) SupportsFast() bool {
+	return h.Reserved[fastExtensionByte]&fastExtensionBit != 0
+}
+
+// SupportsV2 reports whether the peer speaks BitTorrent v2
+func (h *HandShake) SupportsV2() bool {
+	return h.Reserved[v2Byte]&v2Bit != 0
+}
+
+// SetV2 advertises BitTorrent v2 support, for v2 and hybrid torrents
+func (h *HandShake) SetV2() {
+	h.Reserved[v2Byte] |= v2Bit
+}
+
 func (h *HandShake) Serialize() []byte {
 	// Check the format of the handshake https://blog.jse.li/posts/torrent/
 	buffer := make([]byte, len(h.Pstr)+49)
@@ -19,7 +44,7 @@ func (h *HandShake) Serialize() []byte {
 	offset := 1
 
 	offset += copy(buffer[offset:], h.Pstr)
-	offset += copy(buffer[offset:], make([]byte, 8))
+	offset += copy(buffer[offset:], h.Reserved[:])
 	offset += copy(buffer[offset:], h.InfoHash[:])
 	offset += copy(buffer[offset:], h.PeerID[:])
 	return buffer
@@ -48,15 +73,19 @@ func Read(r io.Reader) (*HandShake, error) {
 	// Parse the buffer
 	h := &HandShake{}
 	h.Pstr = string(hadnshakeBuffer[:pstrLength])
+	copy(h.Reserved[:], hadnshakeBuffer[pstrLength:pstrLength+8])
 	copy(h.InfoHash[:], hadnshakeBuffer[pstrLength+8:pstrLength+28])
 	copy(h.PeerID[:], hadnshakeBuffer[pstrLength+28:])
 	return h, nil
 }
 
+// New creates the handshake we send, advertising the extensions we support
 func New(peerID, infoHash [20]byte) *HandShake {
-	return &HandShake{
+	h := &HandShake{
 		Pstr:     "BitTorrent protocol",
 		PeerID:   peerID,
 		InfoHash: infoHash,
 	}
+	h.Reserved[fastExtensionByte] |= fastExtensionBit
+	return h
 }
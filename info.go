@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Harry-kp/nebula/magnet"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// torrentInfo is the JSON schema of `nebula info --json`. Every key is always
+// present, values that are unknown, e.g. for a magnet link, are empty.
+type torrentInfo struct {
+	Source       string     `json:"source"` // "torrent" or "magnet"
+	Name         string     `json:"name"`
+	InfoHashV1   string     `json:"info_hash_v1"`
+	InfoHashV2   string     `json:"info_hash_v2"`
+	PieceLength  int        `json:"piece_length"`
+	PieceCount   int        `json:"piece_count"`
+	TotalSize    int64      `json:"total_size"`
+	Private      bool       `json:"private"`
+	Files        []fileInfo `json:"files"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	Comment      string     `json:"comment"`
+	CreatedBy    string     `json:"created_by"`
+	CreationDate *time.Time `json:"creation_date"`
+}
+
+type fileInfo struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// parseInterspersed parses flags that may appear before or after the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runInfo implements `nebula info`, describing a .torrent file or a magnet link
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the information as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nebula info [--json] <torrent file or magnet link>")
+		fs.PrintDefaults()
+	}
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var info torrentInfo
+	var err error
+	if strings.HasPrefix(positional[0], "magnet:") {
+		info, err = magnetInfo(positional[0])
+	} else {
+		info, err = fileTorrentInfo(positional[0])
+	}
+	if err != nil {
+		fmt.Println("Error reading torrent:", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	printInfo(info)
+}
+
+func fileTorrentInfo(path string) (torrentInfo, error) {
+	tf, err := torrentfile.Open(path)
+	if err != nil {
+		return torrentInfo{}, err
+	}
+	info := torrentInfo{
+		Source:      "torrent",
+		Name:        tf.Name,
+		PieceLength: tf.PieceLength,
+		PieceCount:  max(len(tf.PieceHashes), len(tf.PieceRoots)),
+		Private:     tf.Private,
+		Trackers:    tf.Trackers(),
+		WebSeeds:    append(append([]string{}, tf.WebSeeds...), tf.HTTPSeeds...),
+		Comment:     tf.Comment,
+		CreatedBy:   tf.CreatedBy,
+		Files:       []fileInfo{},
+	}
+	if tf.PieceHashes != nil {
+		info.InfoHashV1 = hex.EncodeToString(tf.InfoHash[:])
+	}
+	if tf.IsV2() {
+		info.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+	}
+	if !tf.CreationDate.IsZero() {
+		info.CreationDate = &tf.CreationDate
+	}
+	if tf.Files == nil {
+		info.Files = append(info.Files, fileInfo{Path: tf.Name, Length: int64(tf.Length)})
+	}
+	for _, f := range tf.Files {
+		if !f.Padding {
+			info.Files = append(info.Files, fileInfo{Path: strings.Join(f.Path, "/"), Length: int64(f.Length)})
+		}
+	}
+	for _, f := range info.Files {
+		info.TotalSize += f.Length
+	}
+	return info, nil
+}
+
+func magnetInfo(link string) (torrentInfo, error) {
+	m, err := magnet.Parse(link)
+	if err != nil {
+		return torrentInfo{}, err
+	}
+	info := torrentInfo{
+		Source:    "magnet",
+		Name:      m.Name,
+		TotalSize: m.Length,
+		Files:     []fileInfo{},
+		Trackers:  [][]string{},
+		WebSeeds:  append([]string{}, m.WebSeeds...),
+	}
+	if m.HasV1 {
+		info.InfoHashV1 = hex.EncodeToString(m.InfoHash[:])
+	}
+	if m.HasV2 {
+		info.InfoHashV2 = hex.EncodeToString(m.InfoHashV2[:])
+	}
+	// Magnet trackers have no tiers, each one gets its own
+	for _, tracker := range m.Trackers {
+		info.Trackers = append(info.Trackers, []string{tracker})
+	}
+	return info, nil
+}
+
+// formatBytes renders a size in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+func printInfo(info torrentInfo) {
+	row := func(label, value string) {
+		if value != "" {
+			fmt.Printf("%-15s %s\n", label+":", value)
+		}
+	}
+	row("Name", info.Name)
+	row("Info hash v1", info.InfoHashV1)
+	row("Info hash v2", info.InfoHashV2)
+	if info.PieceCount > 0 {
+		row("Pieces", fmt.Sprintf("%d x %s", info.PieceCount, formatBytes(int64(info.PieceLength))))
+	}
+	if info.TotalSize > 0 {
+		row("Total size", fmt.Sprintf("%s (%d bytes)", formatBytes(info.TotalSize), info.TotalSize))
+	}
+	if info.Private {
+		row("Private", "yes")
+	} else if info.Source == "torrent" {
+		row("Private", "no")
+	}
+	row("Created by", info.CreatedBy)
+	if info.CreationDate != nil {
+		row("Creation date", info.CreationDate.Format(time.RFC1123))
+	}
+	row("Comment", info.Comment)
+
+	if len(info.Trackers) > 0 {
+		fmt.Println("Trackers:")
+		for i, tier := range info.Trackers {
+			fmt.Printf("  tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
+	if len(info.WebSeeds) > 0 {
+		fmt.Println("Web seeds:")
+		for _, ws := range info.WebSeeds {
+			fmt.Println(" ", ws)
+		}
+	}
+	if len(info.Files) > 0 {
+		fmt.Printf("Files (%d):\n", len(info.Files))
+		for _, f := range info.Files {
+			fmt.Printf("  %10s  %s\n", formatBytes(f.Length), f.Path)
+		}
+	}
+}
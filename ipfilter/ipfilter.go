@@ -0,0 +1,231 @@
+// Package ipfilter blocks address ranges loaded from eMule ipfilter.dat,
+// PeerGuardian P2P and CIDR list files
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// allowedLevel is the eMule access level from which a range is allowed rather than blocked
+const allowedLevel = 128
+
+// Range is an inclusive range of addresses of one family
+type Range struct {
+	From, To netip.Addr
+}
+
+// ranges are sorted by From and never overlap, so a lookup is a binary search
+type ranges []Range
+
+func (rs ranges) contains(addr netip.Addr) bool {
+	i := sort.Search(len(rs), func(i int) bool { return addr.Less(rs[i].From) })
+	return i > 0 && !rs[i-1].To.Less(addr)
+}
+
+// merge sorts the ranges and joins those that overlap or touch
+func merge(list []Range) ranges {
+	sort.Slice(list, func(i, j int) bool { return list[i].From.Less(list[j].From) })
+	var merged ranges
+	for _, r := range list {
+		if n := len(merged); n > 0 && merged[n-1].To.Is4() == r.From.Is4() {
+			last := &merged[n-1]
+			// Next is invalid past the last address of the family, nothing can follow that
+			if next := last.To.Next(); !next.IsValid() || !next.Less(r.From) {
+				if last.To.Less(r.To) {
+					last.To = r.To
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Filter blocks the ranges of its files. It is safe for concurrent use, and
+// Reload swaps in the new ranges without blocking lookups.
+type Filter struct {
+	paths   []string
+	ranges  atomic.Pointer[ranges]
+	skipped atomic.Int64
+}
+
+// Load reads the files, each of them may be in any of the supported formats
+func Load(paths ...string) (*Filter, error) {
+	f := &Filter{paths: paths}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the files again. On error the ranges loaded before stay in place.
+func (f *Filter) Reload() error {
+	var list []Range
+	skipped := 0
+	for _, path := range f.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		parsed, bad, err := Parse(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		list = append(list, parsed...)
+		skipped += bad
+	}
+	merged := merge(list)
+	f.ranges.Store(&merged)
+	f.skipped.Store(int64(skipped))
+	return nil
+}
+
+// Len returns the number of distinct ranges blocked
+func (f *Filter) Len() int {
+	return len(*f.ranges.Load())
+}
+
+// Skipped returns the number of malformed lines the last load left out
+func (f *Filter) Skipped() int {
+	return int(f.skipped.Load())
+}
+
+// Blocked reports whether ip falls in a blocked range. A nil filter blocks nothing.
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return f.ranges.Load().contains(addr.Unmap())
+}
+
+// Parse reads the blocked ranges of a list. Every line may be an eMule entry
+// ("1.2.3.0 - 1.2.3.255 , 000 , description"), a P2P entry
+// ("description:1.2.3.0-1.2.3.255"), a CIDR block or a single address.
+// Blank lines and lines starting with # or // are skipped. Published lists
+// often carry a few broken entries, so malformed lines are left out and
+// counted rather than failing the whole list.
+func Parse(r io.Reader) ([]Range, int, error) {
+	var list []Range
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		r, blocked, err := parseLine(text)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if blocked {
+			list = append(list, r)
+		}
+	}
+	return list, skipped, scanner.Err()
+}
+
+func parseLine(text string) (Range, bool, error) {
+	// P2P: the description may contain anything, the IPv4 range follows the last colon
+	if i := strings.LastIndex(text, ":"); i >= 0 && strings.Contains(text[i:], "-") && !strings.ContainsAny(text[i:], ", ") {
+		r, err := parseRange(text[i+1:])
+		return r, true, err
+	}
+	switch {
+	case strings.Contains(text, ","):
+		// eMule: range, access level, description
+		fields := strings.SplitN(text, ",", 3)
+		if len(fields) < 2 {
+			return Range{}, false, fmt.Errorf("entry %q", text)
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("access level %q", fields[1])
+		}
+		r, err := parseRange(fields[0])
+		return r, level < allowedLevel, err
+	case strings.Contains(text, "/"):
+		prefix, err := netip.ParsePrefix(text)
+		if err != nil {
+			return Range{}, false, err
+		}
+		return prefixRange(prefix.Masked()), true, nil
+	case strings.Contains(text, "-"):
+		r, err := parseRange(text)
+		return r, true, err
+	default:
+		addr, err := parseAddr(text)
+		return Range{From: addr, To: addr}, true, err
+	}
+}
+
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("range %q", s)
+	}
+	var r Range
+	var err error
+	if r.From, err = parseAddr(from); err != nil {
+		return r, err
+	}
+	if r.To, err = parseAddr(to); err != nil {
+		return r, err
+	}
+	if r.From.Is4() != r.To.Is4() || r.To.Less(r.From) {
+		return r, fmt.Errorf("range %q", s)
+	}
+	return r, nil
+}
+
+// parseAddr accepts IPv4 octets padded with zeros as ipfilter.dat writes them
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if octets := strings.Split(s, "."); len(octets) == 4 && !strings.Contains(s, ":") {
+		var ip [4]byte
+		for i, octet := range octets {
+			n, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("address %q", s)
+			}
+			ip[i] = byte(n)
+		}
+		return netip.AddrFrom4(ip), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addr, err
+	}
+	return addr.Unmap(), nil
+}
+
+// prefixRange returns the first and last address of a masked prefix. An
+// IPv4-mapped prefix becomes an IPv4 range, as lookups unmap addresses.
+func prefixRange(prefix netip.Prefix) Range {
+	from := prefix.Addr()
+	if from.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(from.Unmap(), prefix.Bits()-96)
+		from = prefix.Addr()
+	}
+	to := from.AsSlice()
+	for bit := prefix.Bits(); bit < len(to)*8; bit++ {
+		to[bit/8] |= 1 << (7 - uint(bit%8))
+	}
+	last, _ := netip.AddrFromSlice(to)
+	return Range{From: from, To: last}
+}
@@ -0,0 +1,194 @@
+package ipfilter
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rng(from, to string) Range {
+	return Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to)}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Range
+		blocked bool
+	}{
+		// eMule, blocked below access level 128
+		{"001.002.003.000 - 001.002.003.255 , 000 , Some ISP", rng("1.2.3.0", "1.2.3.255"), true},
+		{"1.2.3.0 - 1.2.3.255 , 127 , x", rng("1.2.3.0", "1.2.3.255"), true},
+		{"1.2.3.0 - 1.2.3.255 , 128 , allowed", rng("1.2.3.0", "1.2.3.255"), false},
+		{"1.2.3.0-1.2.3.255,100", rng("1.2.3.0", "1.2.3.255"), true},
+		{"fe80:: - fe80::ffff , 000 , link local", rng("fe80::", "fe80::ffff"), true},
+		// P2P, the description may hold colons
+		{"Some Org:1.2.3.0-1.2.3.255", rng("1.2.3.0", "1.2.3.255"), true},
+		{"Org: with: colons:10.0.0.0-10.0.0.9", rng("10.0.0.0", "10.0.0.9"), true},
+		// CIDR, masked first
+		{"10.0.0.0/8", rng("10.0.0.0", "10.255.255.255"), true},
+		{"10.1.2.3/24", rng("10.1.2.0", "10.1.2.255"), true},
+		{"1.2.3.4/32", rng("1.2.3.4", "1.2.3.4"), true},
+		{"2001:db8::/32", rng("2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), true},
+		{"::ffff:10.0.0.0/104", rng("10.0.0.0", "10.255.255.255"), true},
+		{"::ffff:1.2.3.4/128", rng("1.2.3.4", "1.2.3.4"), true},
+		// Plain ranges and single addresses
+		{"1.2.3.4 - 1.2.3.9", rng("1.2.3.4", "1.2.3.9"), true},
+		{"1.2.3.4", rng("1.2.3.4", "1.2.3.4"), true},
+		{"::ffff:1.2.3.4", rng("1.2.3.4", "1.2.3.4"), true},
+		{"2001:db8::1", rng("2001:db8::1", "2001:db8::1"), true},
+	}
+	for _, test := range tests {
+		got, blocked, err := parseLine(test.line)
+		if err != nil || got != test.want || blocked != test.blocked {
+			t.Errorf("parseLine(%q) = %v, %v, %v, want %v, %v", test.line, got, blocked, err, test.want, test.blocked)
+		}
+	}
+
+	for _, line := range []string{
+		"1.2.3.4 - 1.2.3.0",
+		"1.2.3.0 - ::1",
+		"1.2.3.0 - 1.2.3.255 , high , x",
+		"1.2.3.256",
+		"1.2.3",
+		"10.0.0.0/33",
+		"Org:1.2.3.0-1.2.3.x",
+		"garbage",
+	} {
+		if r, _, err := parseLine(line); err == nil {
+			t.Errorf("parseLine(%q) = %v, want an error", line, r)
+		}
+	}
+}
+
+func TestParseSkipsBadLines(t *testing.T) {
+	list := strings.Join([]string{
+		"# comment",
+		"// another",
+		"",
+		"1.2.3.0 - 1.2.3.255 , 000 , bad ISP",
+		"not an entry",
+		"1.2.3.0 - 1.2.3.255 , 200 , allowed",
+		"Org:10.0.0.0-10.0.0.255",
+		"300.0.0.1",
+		"2001:db8::/32",
+	}, "\n")
+	got, skipped, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Range{rng("1.2.3.0", "1.2.3.255"), rng("10.0.0.0", "10.0.0.255"), rng("2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")}
+	if skipped != 2 || len(got) != len(want) {
+		t.Fatalf("Got %v with %d skipped, want %v with 2 skipped", got, skipped, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{"overlapping",
+			[]Range{rng("1.0.0.10", "1.0.0.30"), rng("1.0.0.0", "1.0.0.20")},
+			[]Range{rng("1.0.0.0", "1.0.0.30")}},
+		{"touching",
+			[]Range{rng("1.0.1.0", "1.0.1.255"), rng("1.0.0.0", "1.0.0.255")},
+			[]Range{rng("1.0.0.0", "1.0.1.255")}},
+		{"gap",
+			[]Range{rng("1.0.0.0", "1.0.0.9"), rng("1.0.0.11", "1.0.0.20")},
+			[]Range{rng("1.0.0.0", "1.0.0.9"), rng("1.0.0.11", "1.0.0.20")}},
+		{"contained",
+			[]Range{rng("1.0.0.0", "1.0.0.255"), rng("1.0.0.5", "1.0.0.6"), rng("1.0.0.7", "1.0.0.7")},
+			[]Range{rng("1.0.0.0", "1.0.0.255")}},
+		{"end of IPv4 next to IPv6",
+			[]Range{rng("::", "::ff"), rng("255.255.255.0", "255.255.255.255"), rng("255.255.255.255", "255.255.255.255")},
+			[]Range{rng("255.255.255.0", "255.255.255.255"), rng("::", "::ff")}},
+		{"end of IPv6",
+			[]Range{rng("ffff::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), rng("ffff::1", "ffff::2")},
+			[]Range{rng("ffff::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")}},
+	}
+	for _, test := range tests {
+		got := merge(test.in)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	rs := merge([]Range{rng("1.0.0.0", "1.0.0.255"), rng("2.0.0.5", "2.0.0.5"), rng("2001:db8::", "2001:db8::ff")})
+	tests := map[string]bool{
+		"0.255.255.255": false,
+		"1.0.0.0":       true,
+		"1.0.0.128":     true,
+		"1.0.0.255":     true,
+		"1.0.1.0":       false,
+		"2.0.0.4":       false,
+		"2.0.0.5":       true,
+		"2.0.0.6":       false,
+		"2001:db8::":    true,
+		"2001:db8::ff":  true,
+		"2001:db8::100": false,
+		"::1.0.0.1":     false,
+	}
+	for addr, want := range tests {
+		if got := rs.contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if (ranges{}).contains(netip.MustParseAddr("1.0.0.0")) {
+		t.Error("Empty list contains an address")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter.dat")
+	if err := os.WriteFile(path, []byte("::ffff:10.0.0.0/104\nbroken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 1 || f.Skipped() != 1 {
+		t.Fatalf("Got %d ranges and %d skipped lines", f.Len(), f.Skipped())
+	}
+	if !f.Blocked(net.ParseIP("10.1.2.3")) || !f.Blocked(net.ParseIP("10.1.2.3").To4()) || f.Blocked(net.ParseIP("11.0.0.1")) {
+		t.Fatal("IPv4-mapped CIDR block does not match IPv4 peers")
+	}
+
+	if err := os.WriteFile(path, []byte("11.0.0.0/8\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Blocked(net.ParseIP("10.1.2.3")) || !f.Blocked(net.ParseIP("11.0.0.1")) || f.Skipped() != 0 {
+		t.Fatal("Reload kept the old ranges")
+	}
+
+	os.Remove(path)
+	if err := f.Reload(); err == nil || !f.Blocked(net.ParseIP("11.0.0.1")) {
+		t.Fatal("Failed reload dropped the ranges loaded before")
+	}
+	var none *Filter
+	if none.Blocked(net.ParseIP("11.0.0.1")) {
+		t.Fatal("Nil filter blocks")
+	}
+}
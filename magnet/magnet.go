@@ -0,0 +1,106 @@
+// Package magnet parses magnet links (BEP 9), including the v2 info hashes of BEP 52.
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet is what a magnet link tells about a torrent before its metadata is fetched
+type Magnet struct {
+	// InfoHash is the v1 info hash, HasV1 tells whether the link carries one
+	InfoHash [20]byte
+	HasV1    bool
+	// InfoHashV2 is the SHA-256 v2 info hash, HasV2 tells whether the link carries one
+	InfoHashV2 [32]byte
+	HasV2      bool
+	Name       string
+	Trackers   []string
+	WebSeeds   []string
+	// Length is the exact length if the link has one, zero otherwise
+	Length int64
+}
+
+// multihashSHA256 prefixes a SHA-256 digest in a btmh URN
+const multihashSHA256 = "1220"
+
+// Parse reads a magnet link, which must carry at least one info hash
+func Parse(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Not a magnet link: %s", link)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+		WebSeeds: query["ws"],
+	}
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			hash, err := parseV1(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return nil, err
+			}
+			m.InfoHash, m.HasV1 = hash, true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			hash, err := parseV2(strings.TrimPrefix(xt, "urn:btmh:"))
+			if err != nil {
+				return nil, err
+			}
+			m.InfoHashV2, m.HasV2 = hash, true
+		}
+	}
+	if !m.HasV1 && !m.HasV2 {
+		return nil, fmt.Errorf("Magnet link without a BitTorrent info hash")
+	}
+	if xl := query.Get("xl"); xl != "" {
+		if m.Length, err = strconv.ParseInt(xl, 10, 64); err != nil || m.Length < 0 {
+			return nil, fmt.Errorf("Invalid exact length %q", xl)
+		}
+	}
+	return m, nil
+}
+
+// parseV1 accepts the 40 character hex and the 32 character base32 forms
+func parseV1(s string) ([20]byte, error) {
+	var hash [20]byte
+	var raw []byte
+	var err error
+	switch len(s) {
+	case 40:
+		raw, err = hex.DecodeString(s)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("unexpected length %d", len(s))
+	}
+	if err != nil {
+		return hash, fmt.Errorf("Invalid info hash %q: %v", s, err)
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+// parseV2 accepts a hex encoded SHA-256 multihash
+func parseV2(s string) ([32]byte, error) {
+	var hash [32]byte
+	raw, err := hex.DecodeString(strings.TrimPrefix(s, multihashSHA256))
+	if err != nil || !strings.HasPrefix(s, multihashSHA256) || len(raw) != len(hash) {
+		return hash, fmt.Errorf("Invalid v2 info hash %q", s)
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
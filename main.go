@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
+	"github.com/Harry-kp/nebula/client"
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/ipfilter"
 	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/mse"
+	"github.com/Harry-kp/nebula/p2p"
+	"github.com/Harry-kp/nebula/ratelimit"
 	"github.com/Harry-kp/nebula/torrentfile"
 	"github.com/Harry-kp/nebula/utils"
 )
@@ -21,11 +31,53 @@ func resolveFilePath(path string) (string, error) {
 	return absPath, nil
 }
 
+// reloadOnHangup reloads the IP filter whenever the process gets SIGHUP
+func reloadOnHangup(filter *ipfilter.Filter) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := filter.Reload(); err != nil {
+			fmt.Println("Error reloading IP filter, keeping the old one:", err)
+			continue
+		}
+		logger.Println("IP filter reloaded, blocking", filter.Len(), "ranges, skipped", filter.Skipped(), "invalid lines")
+	}
+}
+
 func main() {
+	// Subcommands bring their own flags, without one nebula downloads a torrent
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "create":
+			runCreate(os.Args[2:])
+			return
+		case "info":
+			runInfo(os.Args[2:])
+			return
+		case "scrape":
+			runScrape(os.Args[2:])
+			return
+		case "tracker":
+			runTracker(os.Args[2:])
+			return
+		}
+	}
+
 	// Define flags for input and output file paths
 	inputFile := flag.String("input", "", "Path to the input torrent file (required)")
 	outputFile := flag.String("output", ".", "Path to the output file or directory (default: current directory)")
 	logEnabled := flag.Bool("log", false, "Enable logging")
+	maxDown := flag.Int("max-down", 0, "Maximum download rate in KiB/s (default: unlimited)")
+	maxUp := flag.Int("max-up", 0, "Maximum upload rate in KiB/s (default: unlimited)")
+	maxConns := flag.Int("max-conns", connmgr.DefaultMaxConns, "Maximum number of peer connections")
+	maxHalfOpen := flag.Int("max-half-open", connmgr.DefaultMaxHalfOpen, "Maximum number of peer connections being dialed at once")
+	encryption := flag.String("encryption", mse.Prefer.String(), "Peer connection encryption: prefer, require or disable")
+	utpEnabled := flag.Bool("utp", true, "Connect to peers over uTP as well as TCP")
+	var ipFilters stringList
+	flag.Var(&ipFilters, "ip-filter", "IP filter list in ipfilter.dat, P2P or CIDR format, may be repeated. Reloaded on SIGHUP")
+	banFile := flag.String("ban-file", "", "File keeping the peers banned for sending corrupt data across sessions (default: bans last for this session)")
+	idleTimeout := flag.Duration("idle-timeout", client.DefaultIdleTimeout, "Drop peers that send nothing, not even a keep-alive, for this long")
+	stallTimeout := flag.Duration("stall-timeout", p2p.DefaultStallTimeout, "Give up after the swarm makes no progress for this long, even after re-announcing")
 
 	// Parse the flags
 	flag.Parse()
@@ -43,6 +95,34 @@ func main() {
 	}
 	logger.Init(config)
 
+	// Apply the bandwidth caps to every connection
+	ratelimit.GlobalDownload.SetRate(*maxDown * 1024)
+	ratelimit.GlobalUpload.SetRate(*maxUp * 1024)
+	connmgr.Default = connmgr.NewManager(*maxConns, *maxHalfOpen)
+	if *banFile != "" {
+		bans, err := connmgr.LoadBans(*banFile, connmgr.DefaultBanStrikes)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error reading ban file: %v", err))
+		}
+		connmgr.Default.SetBans(bans)
+	}
+	if len(ipFilters) > 0 {
+		filter, err := ipfilter.Load(ipFilters...)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error reading IP filter: %v", err))
+		}
+		logger.Println("IP filter blocks", filter.Len(), "ranges, skipped", filter.Skipped(), "invalid lines")
+		connmgr.Default.SetFilter(filter)
+		go reloadOnHangup(filter)
+	}
+
+	encryptionPolicy, err := mse.ParsePolicy(*encryption)
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Display banner
 	utils.Banner()
 
@@ -69,13 +149,34 @@ func main() {
 		outPath = filepath.Join(outPath, tf.Name)
 	}
 
-	// Validate the output path
+	// Validate the output path, an unfinished download with resume data is picked up again
 	if _, err := os.Stat(outPath); err == nil {
-		logger.Fatal("Error: output file already exists")
+		if _, err := os.Stat(torrentfile.ResumePath(outPath)); err != nil {
+			logger.Fatal("Error: output file already exists")
+		}
 	}
 
+	// Stop the download cleanly on Ctrl-C or a termination request
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Download the torrent file to the specified output path
-	err = tf.DownloadToFile(outPath)
+	err = tf.DownloadToFile(ctx, outPath, torrentfile.DownloadOptions{
+		StallTimeout: *stallTimeout,
+		IdleTimeout:  *idleTimeout,
+		Encryption:   encryptionPolicy,
+		UTP:          *utpEnabled,
+	})
+	if *banFile != "" {
+		if saveErr := connmgr.Default.Bans().Save(*banFile); saveErr != nil {
+			fmt.Println("Error saving ban file:", saveErr)
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Download interrupted, progress saved. Run the same command again to resume")
+		stop()
+		os.Exit(130)
+	}
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("Error downloading torrent file: %v", err))
 	}
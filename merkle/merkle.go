@@ -0,0 +1,202 @@
+// Package merkle implements the SHA-256 hash trees of BitTorrent v2 (BEP 52).
+// The leaves are the hashes of 16 KiB blocks of a file, leaves past the end
+// of the file are zero and every tree is padded to a power of two leaves.
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// BlockSize is the amount of file data covered by a leaf
+const BlockSize = 16384
+
+// HashSize is the size of every node of the tree
+const HashSize = sha256.Size
+
+// Hash is a node of a tree
+type Hash = [HashSize]byte
+
+// HashBlock returns the leaf of a block of at most BlockSize bytes
+func HashBlock(block []byte) Hash {
+	return sha256.Sum256(block)
+}
+
+// hashPair returns the parent of two nodes
+func hashPair(left, right Hash) Hash {
+	var buf [2 * HashSize]byte
+	copy(buf[:HashSize], left[:])
+	copy(buf[HashSize:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// NextPowerOfTwo rounds n up to a power of two, at least 1
+func NextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Log2 returns the base 2 logarithm of a power of two
+func Log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+// PadHash returns the root of a tree of 2^layer zero leaves, the value of
+// nodes at that layer that lie past the end of the file
+func PadHash(layer int) Hash {
+	var h Hash
+	for i := 0; i < layer; i++ {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// Root returns the root of the tree over nodes, padded with pad up to width
+// nodes. Width must be a power of two of at least len(nodes).
+func Root(nodes []Hash, width int, pad Hash) Hash {
+	layer := make([]Hash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// Leaves returns the leaf of every block of data
+func Leaves(data []byte) []Hash {
+	leaves := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		leaves = append(leaves, HashBlock(data[begin:min(begin+BlockSize, len(data))]))
+	}
+	return leaves
+}
+
+// DataRoot returns the root of the tree over the blocks of data with width leaves
+func DataRoot(data []byte, width int) Hash {
+	return Root(Leaves(data), width, Hash{})
+}
+
+// FileRoot returns the pieces root of a file from its piece layer, the roots
+// of its pieces of pieceLength bytes
+func FileRoot(pieceLayer []Hash, pieceLength int) Hash {
+	return Root(pieceLayer, NextPowerOfTwo(len(pieceLayer)), PadHash(Log2(pieceLength/BlockSize)))
+}
+
+// VerifyProof reports whether node, the index'th node of its layer, leads to
+// root through the uncle hashes, which are ordered from the lowest layer up
+func VerifyProof(node Hash, index int, uncles []Hash, root Hash) bool {
+	for _, uncle := range uncles {
+		if index%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		index /= 2
+	}
+	return index == 0 && node == root
+}
+
+// Proof returns the uncle hashes that lead from the subtree of width nodes at
+// index of the padded layer up through proofLayers layers
+func Proof(layer []Hash, pad Hash, index, width, proofLayers int) []Hash {
+	full := make([]Hash, NextPowerOfTwo(len(layer)))
+	copy(full, layer)
+	for i := len(layer); i < len(full); i++ {
+		full[i] = pad
+	}
+	// Climb to the layer holding the root of the requested subtree
+	for ; width > 1; width /= 2 {
+		full = parents(full)
+		index /= 2
+	}
+	var uncles []Hash
+	for i := 0; i < proofLayers && len(full) > 1; i++ {
+		uncles = append(uncles, full[index^1])
+		full = parents(full)
+		index /= 2
+	}
+	return uncles
+}
+
+func parents(layer []Hash) []Hash {
+	up := make([]Hash, len(layer)/2)
+	for i := range up {
+		up[i] = hashPair(layer[2*i], layer[2*i+1])
+	}
+	return up
+}
+
+// Piece tells how a piece is verified. Pieces never span files in v2, data
+// past Length up to the end of the piece is padding between files.
+type Piece struct {
+	// Root is the root of the piece's subtree, zero while the piece layer is unknown
+	Root Hash
+	// Width is the number of leaves of the subtree
+	Width int
+	// Length is the number of bytes of file data in the piece
+	Length int
+	// FileRoot is the pieces root of the file, Index the piece's position
+	// in the file and FilePieces the number of pieces of the file
+	FileRoot   Hash
+	Index      int
+	FilePieces int
+}
+
+// Known reports whether the hash of the piece is known
+func (p *Piece) Known() bool {
+	return p.Root != Hash{}
+}
+
+// Verify checks the file data of the piece against its root
+func (p *Piece) Verify(data []byte) bool {
+	if !p.Known() || len(data) < p.Length {
+		return false
+	}
+	// Whatever follows the file data is padding and must be zero
+	for _, b := range data[p.Length:] {
+		if b != 0 {
+			return false
+		}
+	}
+	return DataRoot(data[:p.Length], p.Width) == p.Root
+}
+
+// BadBlocks checks the piece block by block against leaves, the Width leaves
+// of its subtree. It reports false if the leaves do not lead to Root, and
+// otherwise returns the blocks whose data differs from their leaf. Blocks
+// past the file data must be all zero, as their leaves are.
+func (p *Piece) BadBlocks(data []byte, leaves []Hash) ([]int, bool) {
+	if !p.Known() || len(leaves) != p.Width || Root(leaves, p.Width, Hash{}) != p.Root {
+		return nil, false
+	}
+	var bad []int
+	for block, leaf := range leaves {
+		begin := block * BlockSize
+		if begin >= len(data) {
+			break
+		}
+		end := min(begin+BlockSize, len(data))
+		fileEnd := min(max(begin, p.Length), end)
+		var ok bool
+		if begin < fileEnd {
+			ok = HashBlock(data[begin:fileEnd]) == leaf
+		} else {
+			ok = leaf == Hash{}
+		}
+		for _, b := range data[fileEnd:end] {
+			ok = ok && b == 0
+		}
+		if !ok {
+			bad = append(bad, block)
+		}
+	}
+	return bad, true
+}
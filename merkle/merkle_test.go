@@ -0,0 +1,176 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHash(t *testing.T, s string) Hash {
+	t.Helper()
+	var h Hash
+	if n, err := hex.Decode(h[:], []byte(s)); err != nil || n != HashSize {
+		t.Fatalf("Bad hash %q", s)
+	}
+	return h
+}
+
+// pattern returns n bytes of a repeating pattern, the vectors below were
+// computed for it independently of this package
+func pattern(n, mul, add int, mod int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte((i*mul + add) % mod)
+	}
+	return data
+}
+
+func TestPadHash(t *testing.T) {
+	// The roots of trees of zero leaves, SHA-256 of two zero hashes and so on
+	want := []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"f5a5fd42d16a20302798ef6ed309979b43003d2320d9f0e8ea9831a92759fb4b",
+		"db56114e00fdd4c1f85c892bf35ac9a89289aaecb1ebd0a96cde606a748b5d71",
+		"c78009fdf07fc56a11f122370658a353aaa542ed63e44c4bc15ff4cd105ab33c",
+		"536d98837f2dd165a55d5eeae91485954472d56f246df256bf3cae19352a123c",
+	}
+	for layer, w := range want {
+		if got := PadHash(layer); got != mustHash(t, w) {
+			t.Errorf("PadHash(%d) = %x, want %s", layer, got, w)
+		}
+	}
+}
+
+func TestRoot(t *testing.T) {
+	// Three full blocks and a short one, a tree of four leaves
+	data := pattern(3*BlockSize+100, 7, 3, 256)
+	want := mustHash(t, "65dd6a616361ca92c07bac198cd68fe2265cfa2164328ff544c0233774b0b52e")
+	if got := DataRoot(data, 4); got != want {
+		t.Fatalf("DataRoot = %x, want %x", got, want)
+	}
+
+	// A file of four and a half pieces of two blocks: its pieces root comes
+	// from the piece layer padded with roots of zero pieces, and equals the
+	// root over all of its leaves padded with zero leaves
+	const pieceLength = 2 * BlockSize
+	file := pattern(4*pieceLength+BlockSize+5, 13, 1, 251)
+	var layer []Hash
+	for begin := 0; begin < len(file); begin += pieceLength {
+		layer = append(layer, DataRoot(file[begin:min(begin+pieceLength, len(file))], 2))
+	}
+	want = mustHash(t, "84461651fe3ce3d8132a279726043d65b9f12e43d95f4f8e3b8bc5782f9070d1")
+	if got := FileRoot(layer, pieceLength); got != want {
+		t.Fatalf("FileRoot = %x, want %x", got, want)
+	}
+	if got := DataRoot(file, 16); got != want {
+		t.Fatalf("DataRoot of the whole file = %x, want %x", got, want)
+	}
+}
+
+func TestProof(t *testing.T) {
+	// Layers whose length is not a power of two get padded with pad
+	pad := PadHash(1)
+	for size := 1; size <= 9; size++ {
+		layer := make([]Hash, size)
+		for i := range layer {
+			layer[i] = HashBlock([]byte{byte(size), byte(i)})
+		}
+		full := NextPowerOfTwo(size)
+		root := Root(layer, full, pad)
+		padded := make([]Hash, full)
+		copy(padded, layer)
+		for i := size; i < full; i++ {
+			padded[i] = pad
+		}
+		for width := 1; width <= full; width *= 2 {
+			proofLayers := Log2(full) - Log2(width)
+			for index := 0; index < full; index += width {
+				subtree := Root(padded[index:index+width], width, pad)
+				uncles := Proof(layer, pad, index, width, proofLayers)
+				if len(uncles) != proofLayers {
+					t.Fatalf("Proof of %d nodes at %d of %d has %d uncles, want %d", width, index, size, len(uncles), proofLayers)
+				}
+				if !VerifyProof(subtree, index/width, uncles, root) {
+					t.Fatalf("Proof of %d nodes at %d of %d does not verify", width, index, size)
+				}
+				if proofLayers > 0 {
+					tampered := append([]Hash(nil), uncles...)
+					tampered[len(tampered)-1][0] ^= 1
+					if VerifyProof(subtree, index/width, tampered, root) {
+						t.Fatalf("Tampered proof of %d nodes at %d of %d verifies", width, index, size)
+					}
+					// Two subtrees of padding only are alike, either index is right
+					sibling := Root(padded[index^width:index^width+width], width, pad)
+					if sibling != subtree && VerifyProof(subtree, index/width^1, uncles, root) {
+						t.Fatalf("Proof of %d nodes at %d of %d verifies at the wrong index", width, index, size)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// The last piece of a file, padded with zeros up to the piece length
+	data := make([]byte, 4*BlockSize)
+	copy(data, pattern(2*BlockSize+10, 5, 0, 256))
+	piece := Piece{Root: DataRoot(data[:2*BlockSize+10], 4), Width: 4, Length: 2*BlockSize + 10}
+	if !piece.Verify(data) {
+		t.Fatal("Good piece failed")
+	}
+	data[len(data)-1] = 1
+	if piece.Verify(data) {
+		t.Fatal("Piece with non-zero padding passed")
+	}
+	data[len(data)-1] = 0
+	data[BlockSize] ^= 1
+	if piece.Verify(data) {
+		t.Fatal("Corrupt piece passed")
+	}
+	if (&Piece{Width: 4, Length: 10}).Verify(data) {
+		t.Fatal("Piece without a known root passed")
+	}
+}
+
+func TestBadBlocks(t *testing.T) {
+	good := make([]byte, 4*BlockSize)
+	copy(good, pattern(2*BlockSize+10, 5, 0, 256))
+	length := 2*BlockSize + 10
+	leaves := Leaves(good[:length])
+	leaves = append(leaves, Hash{}) // the fourth block is padding only
+	piece := Piece{Root: DataRoot(good[:length], 4), Width: 4, Length: length}
+
+	tests := []struct {
+		name    string
+		corrupt []int // offsets of flipped bytes
+		bad     []int
+	}{
+		{"good", nil, nil},
+		{"first block", []int{0}, []int{0}},
+		{"two blocks", []int{BlockSize + 1, 2*BlockSize + 9}, []int{1, 2}},
+		{"padding in the last data block", []int{2*BlockSize + 10}, []int{2}},
+		{"padding block", []int{4*BlockSize - 1}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), good...)
+			for _, offset := range tt.corrupt {
+				data[offset] ^= 0xff
+			}
+			bad, ok := piece.BadBlocks(data, leaves)
+			if !ok || !reflect.DeepEqual(bad, tt.bad) {
+				t.Fatalf("BadBlocks = %v, %t, want %v", bad, ok, tt.bad)
+			}
+		})
+	}
+
+	// Leaves that do not lead to the root cannot be trusted
+	forged := append([]Hash(nil), leaves...)
+	forged[1] = HashBlock([]byte("forged"))
+	if _, ok := piece.BadBlocks(good, forged); ok {
+		t.Fatal("BadBlocks took forged leaves")
+	}
+	if _, ok := piece.BadBlocks(good, leaves[:2]); ok {
+		t.Fatal("BadBlocks took too few leaves")
+	}
+}
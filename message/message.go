@@ -19,6 +19,18 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+
+	// Fast Extension (BEP 6)
+	MsgSuggest     messageID = 13
+	MsgHaveAll     messageID = 14
+	MsgHaveNone    messageID = 15
+	MsgReject      messageID = 16
+	MsgAllowedFast messageID = 17
+
+	// BitTorrent v2 (BEP 52)
+	MsgHashRequest messageID = 21
+	MsgHashes      messageID = 22
+	MsgHashReject  messageID = 23
 )
 
 type Message struct {
@@ -50,27 +62,25 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
-func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
+// ParsePiece returns the offset within the piece and the data of the block
+// carried by a PIECE message. The data aliases the payload, it is up to the
+// caller to check the block before copying it anywhere.
+func ParsePiece(index int, msg *Message) (int, []byte, error) {
 	if msg.ID != MsgPiece {
-		return 0, fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+		return 0, nil, fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
 	}
 
 	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("Expected payload length at least 8, got %d", len(msg.Payload))
+		return 0, nil, fmt.Errorf("Expected payload length at least 8, got %d", len(msg.Payload))
 	}
 
 	pieceIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 
 	if pieceIndex != index {
-		return 0, fmt.Errorf("Expected piece index %d, got %d", index, pieceIndex)
-	}
-	data := msg.Payload[8:]
-	if begin+len(data) > len(buf) {
-		return 0, fmt.Errorf("Data too long [%d] for offset %d with length %d", len(data), begin, len(buf))
+		return 0, nil, fmt.Errorf("Expected piece index %d, got %d", index, pieceIndex)
 	}
-	copy(buf[begin:], msg.Payload[8:])
-	return len(data), nil
+	return begin, msg.Payload[8:], nil
 }
 
 // FormatRequest creates a REQUEST message for the given piece if the peer has it
@@ -82,6 +92,130 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatSuggest creates a SUGGEST PIECE message advising the peer to download index
+func FormatSuggest(index int) *Message {
+	m := FormatHave(index)
+	m.ID = MsgSuggest
+	return m
+}
+
+// FormatAllowedFast creates an ALLOWED FAST message for a piece the peer may request while choked
+func FormatAllowedFast(index int) *Message {
+	m := FormatHave(index)
+	m.ID = MsgAllowedFast
+	return m
+}
+
+// FormatReject creates a REJECT REQUEST message for a request we will not serve
+func FormatReject(index, begin, length int) *Message {
+	m := FormatRequest(index, begin, length)
+	m.ID = MsgReject
+	return m
+}
+
+// ParseIndex parses the piece index carried by HAVE, SUGGEST PIECE and ALLOWED FAST messages
+func ParseIndex(msg *Message) (int, error) {
+	if msg.ID != MsgHave && msg.ID != MsgSuggest && msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("Expected HAVE, SUGGEST PIECE or ALLOWED FAST, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Expected payload length 4, got %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// ParseRequest parses the index, begin and length of REQUEST, CANCEL and REJECT REQUEST messages
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST, CANCEL or REJECT REQUEST, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// HashRequest asks for Length hashes of the layer BaseLayer of the tree with
+// root PiecesRoot, starting at Index, along with ProofLayers uncle hashes
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+func (r *HashRequest) payload() []byte {
+	payload := make([]byte, 48)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+// FormatHashRequest creates a HASH REQUEST message
+func FormatHashRequest(r HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.payload()}
+}
+
+// FormatHashReject creates a HASH REJECT message for a request we will not serve
+func FormatHashReject(r HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.payload()}
+}
+
+// FormatHashes creates a HASHES message answering r, hashes holds the
+// requested hashes followed by the uncle hashes
+func FormatHashes(r HashRequest, hashes [][32]byte) *Message {
+	payload := r.payload()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashRequest parses the request carried by HASH REQUEST, HASHES and HASH REJECT messages
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashes && msg.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("Expected HASH REQUEST, HASHES or HASH REJECT, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < 48 || (msg.ID != MsgHashes && len(msg.Payload) != 48) {
+		return HashRequest{}, fmt.Errorf("Unexpected payload length %d", len(msg.Payload))
+	}
+	r := HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(msg.Payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(msg.Payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(msg.Payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(msg.Payload[44:48])),
+	}
+	copy(r.PiecesRoot[:], msg.Payload[0:32])
+	return r, nil
+}
+
+// ParseHashes parses a HASHES message into the request it answers and the hashes it carries
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("Expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	r, err := ParseHashRequest(msg)
+	if err != nil {
+		return r, nil, err
+	}
+	data := msg.Payload[48:]
+	if len(data)%32 != 0 {
+		return r, nil, fmt.Errorf("Hashes payload of %d bytes is not a multiple of 32", len(data))
+	}
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:])
+	}
+	return r, hashes, nil
+}
+
 // Create a new message from the stream
 func Read(r io.Reader) (*Message, error) {
 	// Read the length of the message
@@ -145,6 +279,22 @@ func (m *Message) name() string {
 		return "piece"
 	case MsgCancel:
 		return "cancel"
+	case MsgSuggest:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgHashRequest:
+		return "hash request"
+	case MsgHashes:
+		return "hashes"
+	case MsgHashReject:
+		return "hash reject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
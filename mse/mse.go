@@ -0,0 +1,397 @@
+// Package mse implements Message Stream Encryption, the obfuscated handshake
+// that negotiates an RC4 stream (or plaintext) before the BitTorrent handshake.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Policy decides whether connections are encrypted
+type Policy int
+
+const (
+	// Prefer tries the encrypted handshake first and falls back to plaintext
+	Prefer Policy = iota
+	// Require only accepts RC4 encrypted connections
+	Require
+	// Disable never encrypts and refuses encrypted handshakes
+	Disable
+)
+
+// Methods offered in crypto_provide and chosen in crypto_select
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const (
+	keySize    = 96  // size of a public key in bytes
+	maxPadSize = 512 // largest random padding
+	discard    = 1024
+)
+
+// prime is the 768 bit safe prime used for the Diffie-Hellman key exchange, the generator is 2
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var generator = big.NewInt(2)
+
+// verificationConstant is the VC field, 8 zero bytes
+var verificationConstant = make([]byte, 8)
+
+// plaintextHeader starts every unencrypted BitTorrent handshake
+var plaintextHeader = []byte("\x13BitTorrent protocol")
+
+var errNoCommonMethod = errors.New("mse: no common encryption method")
+
+// ParsePolicy parses the name of a policy as given on the command line
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "prefer":
+		return Prefer, nil
+	case "require":
+		return Require, nil
+	case "disable":
+		return Disable, nil
+	default:
+		return Prefer, fmt.Errorf("Unknown encryption policy %q, expected prefer, require or disable", s)
+	}
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	case Disable:
+		return "disable"
+	default:
+		return fmt.Sprintf("Policy#%d", int(p))
+	}
+}
+
+// provide returns the methods we offer or accept under the policy
+func (p Policy) provide() uint32 {
+	switch p {
+	case Require:
+		return cryptoRC4
+	case Disable:
+		return cryptoPlaintext
+	default:
+		return cryptoRC4 | cryptoPlaintext
+	}
+}
+
+// Conn is a connection whose payload stream may be RC4 encrypted
+type Conn struct {
+	net.Conn
+	r   io.Reader
+	enc *rc4.Cipher
+	dec *rc4.Cipher
+	// initial is the already decrypted payload sent along with the handshake
+	initial []byte
+}
+
+// Encrypted reports whether the payload stream is RC4 encrypted
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.initial) > 0 {
+		n := copy(p, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(key string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(key), secret, skey[:]))
+	c.XORKeyStream(make([]byte, discard), make([]byte, discard))
+	return c
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+	return &keyPair{private: private, public: public.FillBytes(make([]byte, keySize))}, nil
+}
+
+func (k *keyPair) secret(remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(y, k.private, prime).FillBytes(make([]byte, keySize))
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadSize+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// synchronize consumes bytes from r until pattern has been read, giving up after limit bytes
+func synchronize(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("mse: could not synchronize with the remote stream")
+}
+
+// selectMethod picks the method we use out of the ones the remote offers
+func selectMethod(provided uint32, policy Policy) (uint32, error) {
+	common := provided & policy.provide()
+	switch {
+	case common&cryptoRC4 != 0:
+		return cryptoRC4, nil
+	case common&cryptoPlaintext != 0:
+		return cryptoPlaintext, nil
+	default:
+		return 0, errNoCommonMethod
+	}
+}
+
+// Initiate runs the outgoing side of the handshake for the torrent identified
+// by infoHash and returns the connection to run the BitTorrent protocol over
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disable {
+		return &Conn{Conn: conn, r: conn}, nil
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, padA...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	remote := make([]byte, keySize)
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, err
+	}
+	secret := keys.secret(remote)
+
+	enc := newCipher("keyA", secret, infoHash)
+	dec := newCipher("keyB", secret, infoHash)
+
+	// Step 3: prove we know the secret and the info hash, and offer our methods
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), secret))
+	req2 := hash([]byte("req2"), infoHash[:])
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	msg.Write(req2)
+	plain := make([]byte, 0, 16)
+	plain = append(plain, verificationConstant...)
+	plain = binary.BigEndian.AppendUint32(plain, policy.provide())
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(PadC)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(IA)
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Step 4: find the encrypted VC after PadB, then read the selected method
+	encryptedVC := make([]byte, len(verificationConstant))
+	dec.XORKeyStream(encryptedVC, verificationConstant)
+	if err := synchronize(r, encryptedVC, maxPadSize+len(encryptedVC)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if len(padD) > maxPadSize {
+		return nil, fmt.Errorf("mse: padding too long (%d bytes)", len(padD))
+	}
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	if selected&policy.provide() == 0 || (selected != cryptoRC4 && selected != cryptoPlaintext) {
+		return nil, fmt.Errorf("mse: remote selected unsupported method %#x", selected)
+	}
+	if selected == cryptoPlaintext {
+		return &Conn{Conn: conn, r: r}, nil
+	}
+	return &Conn{Conn: conn, r: r, enc: enc, dec: dec}, nil
+}
+
+// Accept runs the incoming side of the handshake. The remote proves which of
+// infoHashes it wants; that info hash is returned with the connection. A
+// plaintext BitTorrent handshake is passed through untouched unless the
+// policy requires encryption, in which case the info hash is left zero.
+func Accept(conn net.Conn, infoHashes [][20]byte, policy Policy) (*Conn, [20]byte, error) {
+	var matched [20]byte
+	r := bufio.NewReader(conn)
+	start, err := r.Peek(len(plaintextHeader))
+	if err != nil {
+		return nil, matched, err
+	}
+	if bytes.Equal(start, plaintextHeader) {
+		if policy == Require {
+			return nil, matched, errors.New("mse: refusing plaintext connection")
+		}
+		return &Conn{Conn: conn, r: r}, matched, nil
+	}
+	if policy == Disable {
+		return nil, matched, errors.New("mse: refusing encrypted connection")
+	}
+
+	remote := make([]byte, keySize)
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, matched, err
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, matched, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, matched, err
+	}
+	if _, err := conn.Write(append(keys.public, padB...)); err != nil {
+		return nil, matched, err
+	}
+	secret := keys.secret(remote)
+
+	// Step 3: find HASH('req1', S) after PadA, then work out the info hash
+	if err := synchronize(r, hash([]byte("req1"), secret), maxPadSize+sha1.Size); err != nil {
+		return nil, matched, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, matched, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	found := false
+	for _, infoHash := range infoHashes {
+		req2 := hash([]byte("req2"), infoHash[:])
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+		if bytes.Equal(req2, obfuscated) {
+			matched, found = infoHash, true
+			break
+		}
+	}
+	if !found {
+		return nil, matched, errors.New("mse: remote asked for an unknown torrent")
+	}
+
+	dec := newCipher("keyA", secret, matched)
+	enc := newCipher("keyB", secret, matched)
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, matched, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, matched, errors.New("mse: invalid verification constant")
+	}
+	selected, err := selectMethod(binary.BigEndian.Uint32(header[8:12]), policy)
+	if err != nil {
+		return nil, matched, err
+	}
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+	if len(padC) > maxPadSize {
+		return nil, matched, fmt.Errorf("mse: padding too long (%d bytes)", len(padC))
+	}
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, matched, err
+	}
+	dec.XORKeyStream(padC, padC)
+	lengthIA := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthIA); err != nil {
+		return nil, matched, err
+	}
+	dec.XORKeyStream(lengthIA, lengthIA)
+	initial := make([]byte, binary.BigEndian.Uint16(lengthIA))
+	if _, err := io.ReadFull(r, initial); err != nil {
+		return nil, matched, err
+	}
+	// The initial payload is always encrypted, even if plaintext gets selected
+	dec.XORKeyStream(initial, initial)
+
+	// Step 4: confirm the method, without padding
+	reply := make([]byte, 0, 14)
+	reply = append(reply, verificationConstant...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, 0) // len(PadD)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, matched, err
+	}
+
+	c := &Conn{Conn: conn, r: r, initial: initial}
+	if selected == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, matched, nil
+}
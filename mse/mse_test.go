@@ -0,0 +1,163 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder keeps a copy of everything read from the connection
+type recorder struct {
+	net.Conn
+	mu   sync.Mutex
+	seen bytes.Buffer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.mu.Lock()
+	r.seen.Write(p[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *recorder) contains(b []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Contains(r.seen.Bytes(), b)
+}
+
+func TestPolicies(t *testing.T) {
+	const (
+		fail = iota
+		plaintext
+		encrypted
+	)
+	tests := []struct {
+		initiator, acceptor Policy
+		want                int
+	}{
+		{Prefer, Prefer, encrypted},
+		{Prefer, Require, encrypted},
+		// Falling back to plaintext takes a new connection, which is up to the caller
+		{Prefer, Disable, fail},
+		{Require, Prefer, encrypted},
+		{Require, Require, encrypted},
+		{Require, Disable, fail},
+		{Disable, Prefer, plaintext},
+		{Disable, Require, fail},
+		{Disable, Disable, plaintext},
+	}
+	infoHash := [20]byte{1, 2, 3}
+	other := [20]byte{4, 5, 6}
+	// The first bytes of a BitTorrent handshake, which tell Accept a plaintext peer apart
+	request := append(append([]byte(nil), plaintextHeader...), "request from the initiator"...)
+	response := []byte("response from the acceptor")
+
+	for _, tt := range tests {
+		t.Run(tt.initiator.String()+"/"+tt.acceptor.String(), func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			deadline := time.Now().Add(10 * time.Second)
+			a.SetDeadline(deadline)
+			b.SetDeadline(deadline)
+			wire := &recorder{Conn: b}
+
+			type result struct {
+				conn *Conn
+				err  error
+			}
+			initiated := make(chan result, 1)
+			go func() {
+				c, err := Initiate(a, infoHash, tt.initiator)
+				if err == nil {
+					_, err = c.Write(request)
+				}
+				if err != nil {
+					// Unblock the acceptor, net.Pipe has no buffer
+					a.Close()
+				}
+				initiated <- result{c, err}
+			}()
+
+			accepted, matched, err := Accept(wire, [][20]byte{other, infoHash}, tt.acceptor)
+			if err != nil {
+				b.Close()
+				<-initiated
+				if tt.want != fail {
+					t.Fatalf("Accept: %v", err)
+				}
+				return
+			}
+			got := make([]byte, len(request))
+			if _, err := io.ReadFull(accepted, got); err != nil {
+				b.Close()
+				<-initiated
+				if tt.want != fail {
+					t.Fatalf("Read at the acceptor: %v", err)
+				}
+				return
+			}
+			r := <-initiated
+			if tt.want == fail {
+				t.Fatalf("Handshake succeeded, want it to fail (initiator error %v)", r.err)
+			}
+			if r.err != nil {
+				t.Fatalf("Initiate: %v", r.err)
+			}
+			if !bytes.Equal(got, request) {
+				t.Fatalf("Acceptor read %q, want %q", got, request)
+			}
+
+			sent := make(chan error, 1)
+			go func() {
+				_, err := accepted.Write(response)
+				sent <- err
+			}()
+			got = make([]byte, len(response))
+			if _, err := io.ReadFull(r.conn, got); err != nil {
+				t.Fatalf("Read at the initiator: %v", err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, response) {
+				t.Fatalf("Initiator read %q, want %q", got, response)
+			}
+
+			wantEncrypted := tt.want == encrypted
+			if r.conn.Encrypted() != wantEncrypted || accepted.Encrypted() != wantEncrypted {
+				t.Fatalf("Encrypted = %t at the initiator and %t at the acceptor, want %t",
+					r.conn.Encrypted(), accepted.Encrypted(), wantEncrypted)
+			}
+			if inClear := wire.contains(request); inClear == wantEncrypted {
+				t.Fatalf("Request in the clear on the wire = %t, want %t", inClear, !wantEncrypted)
+			}
+			if wantEncrypted && matched != infoHash {
+				t.Fatalf("Accept matched info hash %x, want %x", matched, infoHash)
+			}
+		})
+	}
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Initiate(a, [20]byte{1}, Require)
+		done <- err
+	}()
+	if _, _, err := Accept(b, [][20]byte{{2}}, Prefer); err == nil {
+		t.Fatal("Accept took a connection for a torrent it does not know")
+	}
+	b.Close()
+	if err := <-done; err == nil {
+		t.Fatal("Initiate succeeded against a refusing peer")
+	}
+}
@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/Harry-kp/nebula/client"
+	"github.com/Harry-kp/nebula/merkle"
+	"github.com/Harry-kp/nebula/message"
+)
+
+// MaxHashesPerRequest is the largest number of piece layer hashes asked for or served at once
+const maxHashesPerRequest = 512
+
+// leavesTimeout is how long a peer gets to send the leaves of a failed piece
+const leavesTimeout = 10 * time.Second
+
+// pieceRoot returns the v2 hash of a piece, which peers may fill in while downloading
+func (t *Torrent) pieceRoot(index int) merkle.Piece {
+	t.rootsMu.Lock()
+	defer t.rootsMu.Unlock()
+	return t.PieceRoots[index]
+}
+
+// needsHashes reports whether a piece cannot be verified until its piece layer
+// is fetched from a peer. Hybrid pieces can always fall back to SHA-1.
+func (t *Torrent) needsHashes(index int) bool {
+	if t.PieceHashes != nil || t.PieceRoots == nil {
+		return false
+	}
+	piece := t.pieceRoot(index)
+	return !piece.Known()
+}
+
+// checkIntegrity verifies a piece under every hash scheme of the torrent
+func (t *Torrent) checkIntegrity(pw *pieceWork, data []byte) bool {
+	if t.PieceHashes != nil {
+		hash := sha1.Sum(data)
+		if !bytes.Equal(hash[:], pw.hash[:]) {
+			return false
+		}
+	}
+	if t.PieceRoots != nil {
+		piece := t.pieceRoot(pw.index)
+		if piece.Known() || t.PieceHashes == nil {
+			return piece.Verify(data)
+		}
+	}
+	return true
+}
+
+// pieceLayer returns the layer of the merkle tree that holds the piece hashes
+func (t *Torrent) pieceLayer() int {
+	return merkle.Log2(t.PieceLength / merkle.BlockSize)
+}
+
+// hashRequest asks for the part of the piece layer that covers piece index,
+// with the uncle hashes needed to check it against the pieces root
+func (t *Torrent) hashRequest(index int) message.HashRequest {
+	piece := t.pieceRoot(index)
+	width := merkle.NextPowerOfTwo(piece.FilePieces)
+	length := min(width, maxHashesPerRequest)
+	return message.HashRequest{
+		PiecesRoot:  piece.FileRoot,
+		BaseLayer:   t.pieceLayer(),
+		Index:       piece.Index / length * length,
+		Length:      length,
+		ProofLayers: merkle.Log2(width) - merkle.Log2(length),
+	}
+}
+
+// fileStart returns the index of the first piece of the file with the given pieces root
+func (t *Torrent) fileStart(root merkle.Hash) (int, bool) {
+	for index, piece := range t.PieceRoots {
+		if piece.FileRoot == root {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// addHashes stores the piece hashes a peer sent once they check out against the pieces root
+func (t *Torrent) addHashes(r message.HashRequest, hashes [][32]byte) error {
+	t.rootsMu.Lock()
+	defer t.rootsMu.Unlock()
+	first, ok := t.fileStart(r.PiecesRoot)
+	if !ok || r.BaseLayer != t.pieceLayer() {
+		return fmt.Errorf("Unsolicited hashes for %x", r.PiecesRoot)
+	}
+	filePieces := t.PieceRoots[first].FilePieces
+	width := merkle.NextPowerOfTwo(filePieces)
+	if r.Length < 2 || r.Length&(r.Length-1) != 0 || r.Index%r.Length != 0 ||
+		merkle.Log2(r.Length)+r.ProofLayers != merkle.Log2(width) || len(hashes) != r.Length+r.ProofLayers {
+		return fmt.Errorf("Malformed hashes for %x", r.PiecesRoot)
+	}
+	subtree := merkle.Root(hashes[:r.Length], r.Length, merkle.Hash{})
+	if !merkle.VerifyProof(subtree, r.Index/r.Length, hashes[r.Length:], r.PiecesRoot) {
+		return fmt.Errorf("Hashes for %x do not match the pieces root", r.PiecesRoot)
+	}
+	for i, hash := range hashes[:r.Length] {
+		if r.Index+i < filePieces {
+			t.PieceRoots[first+r.Index+i].Root = hash
+		}
+	}
+	return nil
+}
+
+// answerHashRequest serves a request from the piece layer of a file if we know
+// all of it, and rejects it otherwise
+func (t *Torrent) answerHashRequest(c *client.Client, r message.HashRequest) error {
+	t.rootsMu.Lock()
+	var layer []merkle.Hash
+	if first, ok := t.fileStart(r.PiecesRoot); ok && r.BaseLayer == t.pieceLayer() {
+		for _, piece := range t.PieceRoots[first : first+t.PieceRoots[first].FilePieces] {
+			if !piece.Known() {
+				layer = nil
+				break
+			}
+			layer = append(layer, piece.Root)
+		}
+	}
+	t.rootsMu.Unlock()
+
+	width := merkle.NextPowerOfTwo(len(layer))
+	if len(layer) < 2 || r.Length < 2 || r.Length > maxHashesPerRequest || r.Length&(r.Length-1) != 0 ||
+		r.Index%r.Length != 0 || r.Index+r.Length > width || merkle.Log2(r.Length)+r.ProofLayers > merkle.Log2(width) {
+		return c.SendHashReject(r)
+	}
+	pad := merkle.PadHash(t.pieceLayer())
+	hashes := make([][32]byte, 0, r.Length+r.ProofLayers)
+	for i := r.Index; i < r.Index+r.Length; i++ {
+		if i < len(layer) {
+			hashes = append(hashes, layer[i])
+		} else {
+			hashes = append(hashes, pad)
+		}
+	}
+	hashes = append(hashes, merkle.Proof(layer, pad, r.Index, r.Length, r.ProofLayers)...)
+	return c.SendHashes(r, hashes)
+}
+
+// fetchLeaves asks the peer for the leaves of a failed v2 piece, the SHA-256
+// of each of its blocks, to tell which blocks were bad. It is only worth it
+// for a piece several peers sent. Nil means the peer could not send leaves
+// that match the piece root.
+func (t *Torrent) fetchLeaves(c *client.Client, pw *pieceWork) []merkle.Hash {
+	if _, single := pw.culprit(); single || pw.senders == nil || t.PieceRoots == nil || !c.V2 {
+		return nil
+	}
+	piece := t.pieceRoot(pw.index)
+	if !piece.Known() || piece.Width < 2 || piece.Width > maxHashesPerRequest {
+		return nil
+	}
+	r := message.HashRequest{
+		PiecesRoot: piece.FileRoot,
+		Index:      piece.Index * piece.Width,
+		Length:     piece.Width,
+	}
+	if c.SendHashRequest(r) != nil {
+		return nil
+	}
+	timer := time.NewTimer(leavesTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg, ok := <-c.Events():
+			if !ok {
+				return nil
+			}
+			switch msg.ID {
+			case message.MsgHashes:
+				got, hashes, err := message.ParseHashes(msg)
+				if err != nil {
+					return nil
+				}
+				if got != r {
+					// A late answer to a piece layer request is still good
+					t.addHashes(got, hashes)
+					continue
+				}
+				leaves := hashes[:min(len(hashes), r.Length)]
+				if _, ok := piece.BadBlocks(nil, leaves); !ok {
+					return nil
+				}
+				return leaves
+			case message.MsgHashReject:
+				if got, err := message.ParseHashRequest(msg); err != nil || got == r {
+					return nil
+				}
+			case message.MsgHashRequest:
+				got, err := message.ParseHashRequest(msg)
+				if err != nil || t.answerHashRequest(c, got) != nil {
+					return nil
+				}
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
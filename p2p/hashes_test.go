@@ -0,0 +1,284 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/client"
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/handshake"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/merkle"
+	"github.com/Harry-kp/nebula/message"
+	"github.com/Harry-kp/nebula/mse"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+const testPieceLength = 2 * maxBlockSize
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.Config{})
+	os.Exit(m.Run())
+}
+
+// testData returns n bytes that differ from piece to piece
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/testPieceLength)
+	}
+	return data
+}
+
+// v2Torrent returns a v2 torrent of a single file holding data, with its whole piece layer known
+func v2Torrent(data []byte) *Torrent {
+	numPieces := (len(data) + testPieceLength - 1) / testPieceLength
+	layer := make([]merkle.Hash, numPieces)
+	for i := range layer {
+		layer[i] = merkle.DataRoot(data[i*testPieceLength:min((i+1)*testPieceLength, len(data))], testPieceLength/merkle.BlockSize)
+	}
+	fileRoot := merkle.FileRoot(layer, testPieceLength)
+	t := &Torrent{V2: true, PieceLength: testPieceLength, Length: len(data), Name: "a.bin"}
+	for i, root := range layer {
+		t.PieceRoots = append(t.PieceRoots, merkle.Piece{
+			Root:       root,
+			Width:      testPieceLength / merkle.BlockSize,
+			Length:     min(testPieceLength, len(data)-i*testPieceLength),
+			FileRoot:   fileRoot,
+			Index:      i,
+			FilePieces: numPieces,
+		})
+	}
+	return t
+}
+
+// forgetHashes returns a copy of t that has to fetch its piece layer from peers
+func forgetHashes(t *Torrent) *Torrent {
+	empty := &Torrent{V2: t.V2, PieceLength: t.PieceLength, Length: t.Length, Name: t.Name}
+	empty.PieceRoots = append([]merkle.Piece(nil), t.PieceRoots...)
+	for i := range empty.PieceRoots {
+		empty.PieceRoots[i].Root = merkle.Hash{}
+	}
+	return empty
+}
+
+// remotePeer is the far end of a client connected over net.Pipe
+type remotePeer struct {
+	conn net.Conn
+	msgs chan *message.Message
+}
+
+// connectV2 connects a client to a remote peer that speaks v2 and the Fast Extension and has no pieces
+func connectV2(t *testing.T, numPieces int) (*client.Client, *remotePeer) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	b.SetDeadline(time.Now().Add(20 * time.Second))
+	infoHash := [20]byte{4, 5, 6}
+	r := &remotePeer{conn: b, msgs: make(chan *message.Message, 1024)}
+	go func() {
+		defer close(r.msgs)
+		if _, err := handshake.Read(b); err != nil {
+			return
+		}
+		reply := handshake.New([20]byte{'-', 'R', 'M'}, infoHash)
+		reply.SetV2()
+		if _, err := b.Write(reply.Serialize()); err != nil {
+			return
+		}
+		// net.Pipe has no buffer, the client writes its HAVE NONE while we write ours
+		go b.Write((&message.Message{ID: message.MsgHaveNone}).Serialize())
+		for {
+			msg, err := message.Read(b)
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				r.msgs <- msg
+			}
+		}
+	}()
+	cfg := client.Config{
+		NumPieces:  numPieces,
+		Encryption: mse.Disable,
+		V2:         true,
+		Dial: func(context.Context, string) (net.Conn, error) {
+			return a, nil
+		},
+	}
+	c, err := client.New(context.Background(), peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, infoHash, [20]byte{'-', 'N', 'B'}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if !c.V2 {
+		t.Fatal("V2 not negotiated")
+	}
+	return c, r
+}
+
+// next returns the next message of the client with the ID of want, skipping others
+func (r *remotePeer) next(t *testing.T, want *message.Message) *message.Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-r.msgs:
+			if !ok {
+				t.Fatal("Connection closed")
+			}
+			if msg.ID == want.ID {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("No message %v from the client", want)
+		}
+	}
+}
+
+func TestHashExchange(t *testing.T) {
+	// Five pieces, the piece layer is padded to eight
+	full := v2Torrent(testData(4*testPieceLength + 100))
+	c, r := connectV2(t, len(full.PieceRoots))
+	fileRoot := full.PieceRoots[0].FileRoot
+
+	tests := []message.HashRequest{
+		full.hashRequest(3),
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 0, Length: 2, ProofLayers: 2},
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 4, Length: 2, ProofLayers: 2},
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 4, Length: 4, ProofLayers: 1},
+	}
+	for _, req := range tests {
+		if err := full.answerHashRequest(c, req); err != nil {
+			t.Fatal(err)
+		}
+		got, hashes, err := message.ParseHashes(r.next(t, &message.Message{ID: message.MsgHashes}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != req {
+			t.Fatalf("Answered %+v to %+v", got, req)
+		}
+
+		empty := forgetHashes(full)
+		if err := empty.addHashes(got, hashes); err != nil {
+			t.Fatalf("%+v: %v", req, err)
+		}
+		for i, piece := range empty.PieceRoots {
+			covered := i >= req.Index && i < req.Index+req.Length
+			if covered && piece.Root != full.PieceRoots[i].Root || !covered && piece.Known() {
+				t.Fatalf("%+v: piece #%d has root %x", req, i, piece.Root)
+			}
+		}
+
+		for i := range hashes {
+			tampered := append([][32]byte(nil), hashes...)
+			tampered[i][0] ^= 1
+			empty := forgetHashes(full)
+			if err := empty.addHashes(got, tampered); err == nil {
+				t.Fatalf("%+v: took hashes with #%d tampered", req, i)
+			}
+			for _, piece := range empty.PieceRoots {
+				if piece.Known() {
+					t.Fatal("Tampered hashes were stored")
+				}
+			}
+		}
+	}
+
+	rejected := []message.HashRequest{
+		{PiecesRoot: merkle.Hash{1}, BaseLayer: full.pieceLayer(), Index: 0, Length: 8},
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 8, Length: 8},
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 1, Length: 2, ProofLayers: 2},
+		{PiecesRoot: fileRoot, BaseLayer: full.pieceLayer(), Index: 0, Length: 4, ProofLayers: 2},
+	}
+	for _, req := range rejected {
+		if err := full.answerHashRequest(c, req); err != nil {
+			t.Fatal(err)
+		}
+		got, err := message.ParseHashRequest(r.next(t, &message.Message{ID: message.MsgHashReject}))
+		if err != nil || got != req {
+			t.Fatalf("Rejected %+v for %+v, %v", got, req, err)
+		}
+	}
+	// Without the whole piece layer there is nothing to serve
+	if err := forgetHashes(full).answerHashRequest(c, tests[0]); err != nil {
+		t.Fatal(err)
+	}
+	r.next(t, &message.Message{ID: message.MsgHashReject})
+}
+
+func TestFetchLeavesStrikesSender(t *testing.T) {
+	data := testData(3 * testPieceLength)
+	tr := v2Torrent(data)
+	manager := connmgr.NewManager(10, 10)
+	manager.SetBans(connmgr.NewBans(1))
+	tr.Conns = manager.NewSwarm(10)
+	c, r := connectV2(t, len(tr.PieceRoots))
+
+	good, bad := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	index := 1
+	piece := data[index*testPieceLength : (index+1)*testPieceLength]
+	buf := append([]byte(nil), piece...)
+	buf[maxBlockSize+10] ^= 1
+	pw := &pieceWork{index: index, length: testPieceLength, buf: buf, blocks: []bool{true, true}}
+	pw.record(0, good)
+	pw.record(1, bad)
+
+	go func() {
+		msg, ok := <-r.msgs
+		for ok && msg.ID != message.MsgHashRequest {
+			msg, ok = <-r.msgs
+		}
+		if !ok {
+			return
+		}
+		req, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return
+		}
+		leaves := merkle.Leaves(piece)
+		r.conn.Write(message.FormatHashes(req, leaves).Serialize())
+	}()
+	leaves := tr.fetchLeaves(c, pw)
+	if len(leaves) != 2 {
+		t.Fatalf("Got %d leaves", len(leaves))
+	}
+	tr.pieceFailed(pw, buf, leaves)
+	if !tr.Conns.Banned(bad) || tr.Conns.Banned(good) {
+		t.Fatal("Struck the wrong peer")
+	}
+	if pw.bad != nil {
+		t.Fatal("Remembered the blocks although the leaves named the culprit")
+	}
+}
+
+func TestFetchLeavesForged(t *testing.T) {
+	data := testData(2 * testPieceLength)
+	tr := v2Torrent(data)
+	c, r := connectV2(t, len(tr.PieceRoots))
+	pw := &pieceWork{index: 0, length: testPieceLength, blocks: []bool{true, true}}
+	pw.record(0, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	pw.record(1, peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+
+	go func() {
+		for msg := range r.msgs {
+			if msg.ID != message.MsgHashRequest {
+				continue
+			}
+			req, _ := message.ParseHashRequest(msg)
+			// Leaves of other data cannot hash up to the piece root
+			r.conn.Write(message.FormatHashes(req, merkle.Leaves(make([]byte, testPieceLength))).Serialize())
+			return
+		}
+	}()
+	if leaves := tr.fetchLeaves(c, pw); leaves != nil {
+		t.Fatal("Took leaves that do not match the piece root")
+	}
+}
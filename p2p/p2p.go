@@ -1,16 +1,27 @@
 package p2p
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
+	"errors"
 	"fmt"
-	"runtime"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/Harry-kp/nebula/bitfield"
 	"github.com/Harry-kp/nebula/client"
+	"github.com/Harry-kp/nebula/connmgr"
 	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/merkle"
 	"github.com/Harry-kp/nebula/message"
+	"github.com/Harry-kp/nebula/mse"
 	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/ratelimit"
+	"github.com/Harry-kp/nebula/webseed"
 	"github.com/k0kubun/go-ansi"
 	"github.com/schollz/progressbar/v3"
 )
@@ -21,20 +32,150 @@ const maxBlockSize = 16384
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const maxBacklog = 5
 
+// PieceTimeout is how long a peer gets to deliver a piece we started downloading from it
+const pieceTimeout = 30 * time.Second
+
+// InterestCheckInterval is how often a worker skipping pieces its peer lacks
+// checks whether the peer still has anything we want
+const interestCheckInterval = time.Second
+
+// SkipWait is how long a worker that handed back a piece its peer cannot serve
+// waits for news from the peer before it takes the next piece
+const skipWait = 200 * time.Millisecond
+
+// MaxReconnects is the number of times a dropped peer is redialed before it is given up
+const maxReconnects = 3
+
+// ReconnectBackoff is the delay before the first redial, doubled on every further attempt
+const reconnectBackoff = 2 * time.Second
+
+// WebSeedRetry is how long a web seed waits after a failed request
+const webSeedRetry = 10 * time.Second
+
+// WebSeedPenalty is how long a web seed that served bad data sits out, per bad piece
+const webSeedPenalty = 30 * time.Second
+
+// MaxWebSeedStrikes is the number of bad pieces after which a web seed is dropped
+const maxWebSeedStrikes = 3
+
+// DefaultStallTimeout is how long a download may go without completing a piece before the swarm is considered stalled
+const DefaultStallTimeout = 2 * time.Minute
+
+// MaxReannounces is the number of re-announces without progress before a stalled download is given up
+const maxReannounces = 3
+
+// HealthCheckInterval is how often the swarm health is checked
+const healthCheckInterval = 5 * time.Second
+
+// MinReannounceInterval is the shortest time between two re-announces to the tracker
+const minReannounceInterval = 30 * time.Second
+
+// WebSeed serves pieces over HTTP, see the webseed package
+type WebSeed interface {
+	// FetchPiece downloads piece index, which spans length bytes from offset begin
+	FetchPiece(ctx context.Context, index int, begin int64, length int) ([]byte, error)
+	String() string
+}
+
 type Torrent struct {
-	Peers       []peers.Peer
-	PeerID      [20]byte
-	InfoHash    [20]byte
+	Peers    []peers.Peer
+	PeerID   [20]byte
+	InfoHash [20]byte
+	// PieceHashes are the v1 SHA-1 hashes, PieceRoots the v2 merkle roots of the
+	// pieces. A hybrid torrent has both, every piece is checked against each.
 	PieceHashes [][20]byte
+	PieceRoots  []merkle.Piece
+	// V2 advertises BitTorrent v2 support, so peers can send missing piece layers
+	V2          bool
 	PieceLength int
 	Length      int
 	Name        string
+	// StallTimeout overrides DefaultStallTimeout when set
+	StallTimeout time.Duration
+	// ReannounceInterval overrides the shortest time between two re-announces when set
+	ReannounceInterval time.Duration
+	// IdleTimeout overrides client.DefaultIdleTimeout when set
+	IdleTimeout time.Duration
+	// Reannounce, if set, is used to ask the tracker for fresh peers when the swarm stalls
+	Reannounce func(ctx context.Context) ([]peers.Peer, error)
+	// Storage receives every verified piece at its offset in the torrent
+	Storage io.WriterAt
+	// Completed marks the pieces already present in Storage, e.g. from resume
+	// data. Download sets the bit of every piece it writes.
+	Completed *bitfield.Bitfield
+	// DownloadLimiter and UploadLimiter cap this torrent on top of the global
+	// limits in ratelimit. Nil means no per-torrent limit.
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// Encryption decides whether peer connections use Message Stream Encryption
+	Encryption mse.Policy
+	// WebSeeds are HTTP mirrors that are used like peers
+	WebSeeds []WebSeed
+	// Private torrents (BEP 27) only take peers from the tracker and incoming connections
+	Private bool
+	// Listeners accept incoming peer connections, e.g. over TCP and uTP
+	Listeners []net.Listener
+	// Conns decides which peers get a connection. Nil uses connmgr.Default
+	// with connmgr.DefaultMaxConnsPerTorrent.
+	Conns *connmgr.Swarm
+
+	// rootsMu guards PieceRoots, which fill in as piece layers arrive from peers
+	rootsMu sync.Mutex
+	// verifiedMu guards verified, the pieces no peer needs to send us any more
+	verifiedMu sync.Mutex
+	verified   *bitfield.Bitfield
+}
+
+// clientConfig returns the connection settings shared by all peers of the torrent
+func (t *Torrent) clientConfig() client.Config {
+	return client.Config{
+		NumPieces:        t.NumPieces(),
+		DownloadLimiters: []*ratelimit.Limiter{ratelimit.GlobalDownload, t.DownloadLimiter},
+		UploadLimiters:   []*ratelimit.Limiter{ratelimit.GlobalUpload, t.UploadLimiter},
+		Encryption:       t.Encryption,
+		Dial:             t.Conns.DialContext,
+		V2:               t.V2,
+		IdleTimeout:      t.IdleTimeout,
+		Wanted:           t.wanted,
+		Have:             t.have(),
+	}
+}
+
+// have returns a snapshot of the pieces verified so far
+func (t *Torrent) have() *bitfield.Bitfield {
+	t.verifiedMu.Lock()
+	defer t.verifiedMu.Unlock()
+	return t.verified.Clone()
+}
+
+// wanted reports whether the piece still has to be downloaded
+func (t *Torrent) wanted(index int) bool {
+	t.verifiedMu.Lock()
+	defer t.verifiedMu.Unlock()
+	done, _ := t.verified.HasPiece(index)
+	return !done
+}
+
+// pieceDone marks a piece as verified, peers that only have done pieces are no longer interesting
+func (t *Torrent) pieceDone(index int) {
+	t.verifiedMu.Lock()
+	defer t.verifiedMu.Unlock()
+	t.verified.SetPiece(index)
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	// Blocks received so far survive a failed attempt, so the next peer
+	// that picks up the piece only has to request the missing ones.
+	buf    []byte
+	blocks []bool
+	// senders holds the peer each block came from, bad the blocks of every
+	// attempt that failed the integrity check since the last one at failedAt
+	senders  []peers.Peer
+	bad      [][]badBlock
+	failedAt time.Time
 }
 
 type pieceResult struct {
@@ -42,67 +183,189 @@ type pieceResult struct {
 	buf   []byte
 }
 
+// errRequestRejected is returned when a choking peer rejects our requests, so
+// the piece can go back to the queue right away
+var errRequestRejected = errors.New("Requests rejected by choking peer")
+
+// errBanned ends the connection to a peer banned for sending corrupt data
+var errBanned = errors.New("Peer banned for sending corrupt data")
+
+// errPieceTimeout counts as a timeout, so the peer is redialed like after a dropped connection
+var errPieceTimeout = fmt.Errorf("Piece took longer than %s: %w", pieceTimeout, os.ErrDeadlineExceeded)
+
 type pieceProgress struct {
-	index      int
+	t          *Torrent
+	pw         *pieceWork
 	client     *client.Client
 	downloaded int
-	requested  int
+	nextBlock  int
 	backlog    int
-	buf        []byte
+	// requested marks the blocks asked for and not answered yet, backlog counts them
+	requested []bool
+	deadline  <-chan time.Time
+	// hashRequest is the pending request for the piece layer of the piece, if any
+	hashRequest *message.HashRequest
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
+func (pw *pieceWork) numBlocks() int {
+	return (pw.length + maxBlockSize - 1) / maxBlockSize
+}
+
+func (pw *pieceWork) blockSize(block int) int {
+	begin := block * maxBlockSize
+	if pw.length-begin < maxBlockSize {
+		return pw.length - begin
+	}
+	return maxBlockSize
+}
+
+// reset drops every block received so far, e.g. after a failed integrity check
+func (pw *pieceWork) reset() {
+	pw.buf = nil
+	pw.blocks = nil
+	pw.senders = nil
+}
+
+// canRequest reports whether the peer currently accepts requests for the piece
+func (state *pieceProgress) canRequest() bool {
+	return !state.client.PeerChoking() || state.client.AllowedFast(state.pw.index)
+}
+
+// answered settles the outstanding request for block. It reports false if
+// the block was never requested from the peer or is already settled.
+func (state *pieceProgress) answered(block int) bool {
+	if block >= len(state.requested) || !state.requested[block] {
+		return false
 	}
-	// keep alive connection
-	if msg == nil {
-		return nil
+	state.requested[block] = false
+	state.backlog--
+	return true
+}
+
+// readMessage handles the next message of the peer. The client has already
+// applied it to the peer state, what is left is the progress of the piece.
+func (state *pieceProgress) readMessage() error {
+	var msg *message.Message
+	select {
+	case m, ok := <-state.client.Events():
+		if !ok {
+			return state.client.Err()
+		}
+		msg = m
+	case <-state.deadline:
+		return errPieceTimeout
 	}
 	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
 	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
+		// Without the Fast Extension a choke silently drops our pending requests
+		if !state.client.FastExtension {
+			state.backlog = 0
+			state.nextBlock = 0
+			clear(state.requested)
+		}
+	case message.MsgReject:
+		index, begin, _, err := message.ParseRequest(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		block := begin / maxBlockSize
+		if index != state.pw.index || begin%maxBlockSize != 0 || !state.answered(block) || state.pw.blocks[block] {
+			return nil
+		}
+		// Free the block so it is requested again
+		state.nextBlock = min(state.nextBlock, block)
+		if !state.canRequest() {
+			return errRequestRejected
+		}
+	case message.MsgHashes:
+		r, hashes, err := message.ParseHashes(msg)
+		if err != nil {
+			return err
+		}
+		if err := state.t.addHashes(r, hashes); err != nil {
+			return err
+		}
+		if state.hashRequest != nil && *state.hashRequest == r {
+			state.hashRequest = nil
+		}
+	case message.MsgHashReject:
+		r, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return err
+		}
+		// Without the hashes the piece cannot be verified, the next peer may have them
+		if state.hashRequest != nil && *state.hashRequest == r {
+			state.hashRequest = nil
+		}
+	case message.MsgHashRequest:
+		r, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return err
+		}
+		return state.t.answerHashRequest(state.client, r)
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		begin, data, err := message.ParsePiece(state.pw.index, msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		block := begin / maxBlockSize
+		if begin%maxBlockSize != 0 || block >= len(state.pw.blocks) || len(data) != state.pw.blockSize(block) {
+			return fmt.Errorf("Unexpected block at offset %d with length %d", begin, len(data))
+		}
+		state.answered(block)
+		// A block we already have must not overwrite the data it was recorded with
+		if state.pw.blocks[block] {
+			return nil
+		}
+		copy(state.pw.buf[begin:], data)
+		state.pw.blocks[block] = true
+		state.pw.record(block, state.client.Peer())
+		state.downloaded += len(data)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+func (t *Torrent) attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+	if pw.buf == nil {
+		pw.buf = make([]byte, pw.length)
+		pw.blocks = make([]bool, pw.numBlocks())
+	}
 	s := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-	for s.downloaded < pw.length {
-		if !s.client.Choked {
-			for s.backlog < maxBacklog && s.requested < pw.length {
-				blockSize := maxBlockSize
-				if pw.length-s.requested < blockSize {
-					blockSize = pw.length - s.requested
+		t:         t,
+		pw:        pw,
+		client:    c,
+		requested: make([]bool, pw.numBlocks()),
+	}
+	if t.needsHashes(pw.index) {
+		r := t.hashRequest(pw.index)
+		if err := c.SendHashRequest(r); err != nil {
+			return nil, err
+		}
+		s.hashRequest = &r
+	}
+	for block, done := range pw.blocks {
+		if done {
+			s.downloaded += pw.blockSize(block)
+		}
+	}
+	timer := time.NewTimer(pieceTimeout)
+	defer timer.Stop()
+	s.deadline = timer.C
+	// Keep reading after the last block until the piece layer arrives or is rejected
+	for s.downloaded < pw.length || s.hashRequest != nil {
+		if s.canRequest() {
+			for s.backlog < maxBacklog && s.nextBlock < len(pw.blocks) {
+				if pw.blocks[s.nextBlock] || s.requested[s.nextBlock] {
+					s.nextBlock++
+					continue
 				}
-				err := c.SendRequest(pw.index, s.requested, blockSize)
+				err := c.SendRequest(pw.index, s.nextBlock*maxBlockSize, pw.blockSize(s.nextBlock))
 				if err != nil {
 					return nil, err
 				}
+				s.requested[s.nextBlock] = true
 				s.backlog++
-				s.requested += blockSize
+				s.nextBlock++
 			}
 		}
 
@@ -111,46 +374,283 @@ func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
 			return nil, err
 		}
 	}
-	return s.buf, nil
+	return pw.buf, nil
 }
 
-func checkIntegrity(pw *pieceWork, data []byte) bool {
-	hash := sha1.Sum(data)
-	return bytes.Equal(hash[:], pw.hash[:])
+// isTransient reports whether a peer connection was lost for a reason that
+// is worth a reconnect, as opposed to the peer refusing or misbehaving.
+func isTransient(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func (t *Torrent) downloadTorrentWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.InfoHash, t.PeerID)
-	if err != nil {
-		logger.Printf("Could not able to handshake with %s. Disconnecting...\n", peer.IP)
-		return
+// downloadTorrentWorker downloads from peer until the download is done or the
+// peer is given up. Incoming is the connection the peer opened to us, if any;
+// reconnects always dial out.
+func (t *Torrent) downloadTorrentWorker(ctx context.Context, peer peers.Peer, incoming net.Conn, workQueue chan *pieceWork, results chan *pieceResult) {
+	failed := true
+	defer func() { t.Conns.Release(peer, failed) }()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := reconnectBackoff << (attempt - 1)
+			logger.Printf("Reconnecting to %s in %s (attempt %d/%d)\n", peer.IP, delay, attempt, maxReconnects)
+			if !sleep(ctx, delay) {
+				return
+			}
+		}
+
+		var c *client.Client
+		var err error
+		if incoming != nil {
+			c, err = client.Accept(ctx, incoming, t.InfoHash, t.PeerID, t.clientConfig())
+			incoming = nil
+		} else {
+			err = t.Conns.Dial(ctx, func() (err error) {
+				c, err = client.New(ctx, peer, t.InfoHash, t.PeerID, t.clientConfig())
+				return err
+			})
+		}
+		if err != nil {
+			logger.Printf("Could not able to handshake with %s. Disconnecting...\n", peer.IP)
+			if attempt == 0 || attempt >= maxReconnects {
+				return
+			}
+			continue
+		}
+		logger.Printf("Handshake with %s successful", peer.IP)
+		t.Conns.Connected(peer, c.Close)
+
+		err = t.downloadFromClient(ctx, c, workQueue, results)
+		c.Close()
+		if err == nil || ctx.Err() != nil {
+			failed = false
+			return
+		}
+		if !isTransient(err) || attempt >= maxReconnects {
+			return
+		}
+		// The connection was usable, so the next drop gets a fresh set of attempts
+		attempt = 0
 	}
-	defer c.Conn.Close()
-	logger.Printf("Handshake with %s successful", peer.IP)
+}
 
-	c.SendUnchoke()
-	c.SendInterested()
+// downloadFromClient downloads pieces from an established connection until the
+// context is done or the connection fails.
+func (t *Torrent) downloadFromClient(ctx context.Context, c *client.Client, workQueue chan *pieceWork, results chan *pieceResult) error {
+	peer := c.Peer()
+	// We never upload, so the peer stays choked and the client rejects its requests
+	if _, err := c.UpdateInterest(); err != nil {
+		return err
+	}
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
+	var lastInterestCheck time.Time
+	// skipped fires once a worker that handed back a piece may take the next one
+	var skipped <-chan time.Time
+	for {
+		// A peer without pieces we want is left alone until it announces one,
+		// the client then turns interested by itself
+		var work chan *pieceWork
+		if c.AmInterested() && skipped == nil {
+			work = workQueue
+		}
+		var pw *pieceWork
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-skipped:
+			skipped = nil
+			continue
+		case msg, ok := <-c.Events():
+			if !ok {
+				return c.Err()
+			}
+			// The peer may have announced a piece it skipped
+			skipped = nil
+			// Between pieces only hash requests need an answer, the client keeps the peer state
+			if msg.ID == message.MsgHashRequest {
+				r, err := message.ParseHashRequest(msg)
+				if err != nil {
+					return err
+				}
+				if err := t.answerHashRequest(c, r); err != nil {
+					return err
+				}
+			}
+			continue
+		case pw = <-work:
+		}
+
+		// A v2 piece without a known hash is only worth fetching from a peer that can send it
+		// Neither is a piece this peer sent bad blocks for, until another peer had a go at it
+		if !c.HasPiece(pw.index) || (t.needsHashes(pw.index) && !c.V2) || pw.suspect(peer) {
 			workQueue <- pw
+			// Taking it straight back would spin while it is the only piece left
+			skipped = time.After(skipWait)
+			// Other workers may have finished the pieces this peer has
+			if time.Since(lastInterestCheck) >= interestCheckInterval {
+				lastInterestCheck = time.Now()
+				if _, err := c.UpdateInterest(); err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		buf, err := t.attemptDownloadPiece(c, pw)
+		if errors.Is(err, errRequestRejected) {
+			logger.Println("Piece", pw.index, "rejected by", peer.IP)
+			workQueue <- pw
+			continue
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			logger.Println("Error downloading piece", pw.index, "from", peer.IP, ":", err)
 			workQueue <- pw
-			return
+			return err
 		}
 
-		if !checkIntegrity(pw, buf) {
+		if !t.checkIntegrity(pw, buf) {
 			logger.Println("Piece failed integrity check", pw.index, "from", peer.IP)
+			t.pieceFailed(pw, buf, t.fetchLeaves(c, pw))
 			workQueue <- pw
+			if t.Conns.Banned(peer) {
+				return errBanned
+			}
 			continue
 		}
+		t.pieceVerified(pw, buf)
+		t.pieceDone(pw.index)
 		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		t.Conns.Record(peer, len(buf))
+		select {
+		case <-ctx.Done():
+			return nil
+		case results <- &pieceResult{pw.index, buf}:
+		}
+		// A closed connection shows up on the events of the next round
+		c.UpdateInterest()
+	}
+}
+
+// sleep waits for d and reports false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// webSeedWorker downloads pieces from a web seed. A seed that serves data
+// failing the integrity check sits out longer each time and is eventually dropped.
+func (t *Torrent) webSeedWorker(ctx context.Context, ws WebSeed, workQueue chan *pieceWork, results chan *pieceResult) {
+	strikes := 0
+	for {
+		var pw *pieceWork
+		select {
+		case <-ctx.Done():
+			return
+		case pw = <-workQueue:
+		}
+
+		// Web seeds cannot send piece layers, leave the piece to the peers for now
+		if t.needsHashes(pw.index) {
+			workQueue <- pw
+			if !sleep(ctx, webSeedRetry) {
+				return
+			}
+			continue
+		}
+
+		begin, _ := t.calculateBoundsForPiece(pw.index)
+		buf, err := ws.FetchPiece(ctx, pw.index, int64(begin), pw.length)
+		if err != nil {
+			workQueue <- pw
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Println("Error downloading piece", pw.index, "from web seed", ws, ":", err)
+			wait := webSeedRetry
+			// A busy BEP 17 seed tells how long to stay away
+			var busy *webseed.BusyError
+			if errors.As(err, &busy) {
+				wait = max(wait, busy.RetryAfter)
+			}
+			if !sleep(ctx, wait) {
+				return
+			}
+			continue
+		}
+
+		if !t.checkIntegrity(pw, buf) {
+			workQueue <- pw
+			strikes++
+			if strikes >= maxWebSeedStrikes {
+				logger.Println("Dropping web seed", ws, "after", strikes, "bad pieces")
+				return
+			}
+			logger.Println("Piece failed integrity check", pw.index, "from web seed", ws)
+			if !sleep(ctx, time.Duration(strikes)*webSeedPenalty) {
+				return
+			}
+			continue
+		}
+		t.pieceVerified(pw, buf)
+		t.pieceDone(pw.index)
+		select {
+		case <-ctx.Done():
+			return
+		case results <- &pieceResult{pw.index, buf}:
+		}
+	}
+}
+
+// startWorkers hands every free connection slot to the best candidate peer.
+// Wake is signalled whenever a worker exits so its slot can be reused.
+func (t *Torrent) startWorkers(ctx context.Context, workQueue chan *pieceWork, results chan *pieceResult, wake chan struct{}) {
+	for {
+		peer, ok := t.Conns.Reserve()
+		if !ok {
+			return
+		}
+		go func() {
+			defer func() {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}()
+			t.downloadTorrentWorker(ctx, peer, nil, workQueue, results)
+		}()
+	}
+}
+
+// acceptPeers hands connections from the listener to workers while there is room for them
+func (t *Torrent) acceptPeers(ctx context.Context, l net.Listener, workQueue chan *pieceWork, results chan *pieceResult) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				logger.Println("Error accepting peer:", err)
+			}
+			return
+		}
+		peer, err := peers.FromAddr(conn.RemoteAddr())
+		if err != nil || !t.Conns.ReserveIncoming(peer) {
+			conn.Close()
+			continue
+		}
+		logger.Printf("Incoming connection from %s\n", peer.IP)
+		go t.downloadTorrentWorker(ctx, peer, conn, workQueue, results)
 	}
 }
 
@@ -168,20 +668,78 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-func (t *Torrent) Download() []byte {
+// NumPieces returns the number of pieces in the torrent
+func (t *Torrent) NumPieces() int {
+	return max(len(t.PieceHashes), len(t.PieceRoots))
+}
+
+// Download fetches every missing piece from the swarm and writes it to Storage.
+// It fails if the context is done or the swarm stays stalled after re-announcing;
+// Completed then tells which pieces made it to Storage.
+func (t *Torrent) Download(ctx context.Context) error {
 	logger.Println("Starting download for", t.Name)
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the workers once we are done
+	if t.Completed == nil {
+		t.Completed = bitfield.New(t.NumPieces())
+	}
+	t.verified = t.Completed.Clone()
+	numPieces := t.NumPieces()
+	workQueue := make(chan *pieceWork, numPieces)
 	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
+	donePieces := 0
+	doneBytes := 0
+	for index := 0; index < numPieces; index++ {
 		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+		if done, _ := t.Completed.HasPiece(index); done {
+			donePieces++
+			doneBytes += length
+			continue
+		}
+		pw := &pieceWork{index: index, length: length}
+		if t.PieceHashes != nil {
+			pw.hash = t.PieceHashes[index]
+		}
+		workQueue <- pw
 	}
 
-	for _, peer := range t.Peers {
-		go t.downloadTorrentWorker(peer, workQueue, results)
+	if t.Conns == nil {
+		t.Conns = connmgr.Default.NewSwarm(connmgr.DefaultMaxConnsPerTorrent)
+	}
+	wake := make(chan struct{}, 1)
+	if t.Private {
+		logger.Println("Private torrent, only using peers from the tracker")
+		t.Conns.SetPrivate(true)
+	}
+	t.Conns.AddPeers(t.Peers, connmgr.SourceTracker)
+	t.startWorkers(ctx, workQueue, results, wake)
+	for _, l := range t.Listeners {
+		go t.acceptPeers(ctx, l, workQueue, results)
+	}
+	var activeWebSeeds atomic.Int32
+	for _, ws := range t.WebSeeds {
+		activeWebSeeds.Add(1)
+		go func() {
+			defer activeWebSeeds.Add(-1)
+			t.webSeedWorker(ctx, ws, workQueue, results)
+		}()
 	}
 
-	buf := make([]byte, t.Length)
+	stallTimeout := t.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = DefaultStallTimeout
+	}
+	reannounceInterval := t.ReannounceInterval
+	if reannounceInterval <= 0 {
+		reannounceInterval = minReannounceInterval
+	}
+	// A short stall timeout, as in tests, is checked more often
+	ticker := time.NewTicker(min(healthCheckInterval, stallTimeout/2))
+	defer ticker.Stop()
+	lastProgress := time.Now()
+	var lastAnnounce time.Time
+	reannounces := 0
+
 	bar := progressbar.NewOptions(t.Length,
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
@@ -197,18 +755,66 @@ func (t *Torrent) Download() []byte {
 			BarStart:      "[",
 			BarEnd:        "]",
 		}))
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
-		bar.Add(end - begin)
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		logger.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
-	}
-	close(workQueue)
+	bar.Add(doneBytes)
+	for donePieces < numPieces {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return ctx.Err()
+		case res := <-results:
+			begin, end := t.calculateBoundsForPiece(res.index)
+			if _, err := t.Storage.WriteAt(res.buf, int64(begin)); err != nil {
+				fmt.Println()
+				return fmt.Errorf("Error writing piece #%d: %w", res.index, err)
+			}
+			t.Completed.SetPiece(res.index)
+			donePieces++
+			lastProgress = time.Now()
+			reannounces = 0
+			bar.Add(end - begin)
+			percent := float64(donePieces) / float64(numPieces) * 100
+			logger.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, t.Conns.Active())
+		case <-wake:
+			t.startWorkers(ctx, workQueue, results, wake)
+		case <-ticker.C:
+			if t.Conns.ReplaceSlow() {
+				logger.Println("Replacing a slow peer connection")
+			}
+			t.startWorkers(ctx, workQueue, results, wake)
+			activePeers := t.Conns.Active() + int(activeWebSeeds.Load())
+			stalledFor := time.Since(lastProgress)
+			// Peers from a re-announce get a full stall timeout to make progress
+			sinceActivity := stalledFor
+			if lastAnnounce.After(lastProgress) {
+				sinceActivity = time.Since(lastAnnounce)
+			}
+			if activePeers > 0 && sinceActivity < stallTimeout {
+				continue
+			}
+			if time.Since(lastAnnounce) < reannounceInterval {
+				continue
+			}
+			if t.Reannounce == nil || reannounces >= maxReannounces {
+				// Without peers we re-announce early, but only give up after a full stall timeout
+				if stalledFor < stallTimeout {
+					continue
+				}
+				fmt.Println()
+				return fmt.Errorf("Download stalled with %d/%d pieces done: %d active peers and no progress for %s",
+					donePieces, numPieces, activePeers, stalledFor.Round(time.Second))
+			}
+			reannounces++
+			lastAnnounce = time.Now()
+			logger.Printf("Swarm stalled with %d active peers, re-announcing (%d/%d)\n", activePeers, reannounces, maxReannounces)
+			fresh, err := t.Reannounce(ctx)
+			if err != nil {
+				logger.Println("Re-announce failed:", err)
+				continue
+			}
+			t.Conns.AddPeers(fresh, connmgr.SourceTracker)
+			t.startWorkers(ctx, workQueue, results, wake)
+		}
+	}
 	fmt.Println()
-	return buf
+	return nil
 }
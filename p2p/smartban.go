@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"time"
+
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/merkle"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// suspectWait is how long the peers that sent blocks of a failed piece have
+// to leave it to others, so the re-download tells who sent the bad data
+const suspectWait = 10 * time.Second
+
+// badBlock is what one block of a failed piece looked like
+type badBlock struct {
+	sender peers.Peer
+	hash   [20]byte
+}
+
+// record notes which peer sent block
+func (pw *pieceWork) record(block int, sender peers.Peer) {
+	if pw.senders == nil {
+		pw.senders = make([]peers.Peer, len(pw.blocks))
+	}
+	pw.senders[block] = sender
+}
+
+// suspect reports whether the peer sent part of the piece when it last
+// failed and should leave it to the others for now
+func (pw *pieceWork) suspect(peer peers.Peer) bool {
+	if time.Since(pw.failedAt) >= suspectWait {
+		return false
+	}
+	for _, blocks := range pw.bad {
+		for _, b := range blocks {
+			if b.sender.IP.Equal(peer.IP) && b.sender.Port == peer.Port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// culprit returns the peer that sent every block of the piece, if a single one did
+func (pw *pieceWork) culprit() (peers.Peer, bool) {
+	var culprit peers.Peer
+	for _, sender := range pw.senders {
+		if sender.IP == nil {
+			return peers.Peer{}, false
+		}
+		if culprit.IP == nil {
+			culprit = sender
+		} else if !culprit.IP.Equal(sender.IP) || culprit.Port != sender.Port {
+			return peers.Peer{}, false
+		}
+	}
+	return culprit, culprit.IP != nil
+}
+
+// pieceFailed handles a piece that failed its integrity check. A piece that
+// came from a single peer convicts that peer right away, as do the blocks of
+// a v2 piece that differ from their leaves, if the peer sent those. Otherwise
+// the blocks are remembered until the piece is downloaded again, comparing
+// them with the good data then tells which peer was at fault.
+func (t *Torrent) pieceFailed(pw *pieceWork, buf []byte, leaves []merkle.Hash) {
+	defer pw.reset()
+	if pw.senders == nil {
+		return
+	}
+	if culprit, ok := pw.culprit(); ok {
+		t.strike(culprit, pw.index)
+		return
+	}
+	if leaves != nil {
+		piece := t.pieceRoot(pw.index)
+		if bad, ok := piece.BadBlocks(buf, leaves); ok && len(bad) > 0 {
+			struck := make(map[string]bool)
+			for _, block := range bad {
+				sender := pw.senders[block]
+				if sender.IP != nil && !struck[sender.String()] {
+					struck[sender.String()] = true
+					t.strike(sender, pw.index)
+				}
+			}
+			return
+		}
+	}
+	blocks := make([]badBlock, len(pw.senders))
+	sent := false
+	for block, sender := range pw.senders {
+		if sender.IP == nil {
+			continue
+		}
+		sent = true
+		begin := block * maxBlockSize
+		blocks[block] = badBlock{sender: sender, hash: sha1.Sum(buf[begin : begin+pw.blockSize(block)])}
+	}
+	if !sent {
+		return
+	}
+	pw.bad = append(pw.bad, blocks)
+	pw.failedAt = time.Now()
+}
+
+// pieceVerified strikes every peer that sent a block of an earlier failed
+// attempt at the piece that differs from the verified data
+func (t *Torrent) pieceVerified(pw *pieceWork, buf []byte) {
+	struck := make(map[string]bool)
+	for _, blocks := range pw.bad {
+		for block, b := range blocks {
+			if b.sender.IP == nil || struck[b.sender.String()] {
+				continue
+			}
+			begin := block * maxBlockSize
+			if sha1.Sum(buf[begin:begin+pw.blockSize(block)]) != b.hash {
+				struck[b.sender.String()] = true
+				t.strike(b.sender, pw.index)
+			}
+		}
+	}
+	pw.bad = nil
+}
+
+func (t *Torrent) strike(peer peers.Peer, index int) {
+	logger.Println("Peer", peer.String(), "sent corrupt data for piece", index)
+	if t.Conns.Strike(peer) {
+		logger.Println("Banned peer", peer.String(), "for sending corrupt data")
+	}
+}
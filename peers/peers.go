@@ -27,6 +27,58 @@ func Unmarshal(peersBytes []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// Unmarshal6 parses compact IPv6 peers (BEP 7)
+func Unmarshal6(peersBytes []byte) ([]Peer, error) {
+	const peerSize = 18
+	if len(peersBytes)%peerSize != 0 {
+		return nil, fmt.Errorf("Invalid Peers Response")
+	}
+	totalPeers := len(peersBytes) / peerSize
+	peers := make([]Peer, totalPeers)
+	for i := 0; i < totalPeers; i++ {
+		startIdx := i * peerSize
+		peers[i].IP = net.IP(peersBytes[startIdx : startIdx+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBytes[startIdx+16 : startIdx+18])
+	}
+	return peers, nil
+}
+
+// Marshal writes the IPv4 peers of the list in compact form, skipping the others
+func Marshal(list []Peer) []byte {
+	var buf []byte
+	for _, p := range list {
+		if ip := p.IP.To4(); ip != nil {
+			buf = append(buf, ip...)
+			buf = binary.BigEndian.AppendUint16(buf, p.Port)
+		}
+	}
+	return buf
+}
+
+// Marshal6 writes the IPv6 peers of the list in compact form, skipping the others
+func Marshal6(list []Peer) []byte {
+	var buf []byte
+	for _, p := range list {
+		if p.IP.To4() == nil && len(p.IP) == net.IPv6len {
+			buf = append(buf, p.IP...)
+			buf = binary.BigEndian.AppendUint16(buf, p.Port)
+		}
+	}
+	return buf
+}
+
+// FromAddr returns the peer behind a TCP or UDP address
+func FromAddr(addr net.Addr) (Peer, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return Peer{IP: a.IP, Port: uint16(a.Port)}, nil
+	case *net.UDPAddr:
+		return Peer{IP: a.IP, Port: uint16(a.Port)}, nil
+	default:
+		return Peer{}, fmt.Errorf("Unsupported peer address %s", addr)
+	}
+}
+
 func (p *Peer) String() string {
 	return fmt.Sprintf("%s:%d", p.IP, p.Port)
 }
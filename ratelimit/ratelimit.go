@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MinBurst is the smallest bucket size, large enough to pass a full block request at once
+const minBurst = 32 * 1024
+
+// Limiter is a token bucket handing out bytes at a rate that can be changed at any time
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int // bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+	// changed is closed and replaced by SetRate, waiters then redo their math
+	changed chan struct{}
+}
+
+// GlobalDownload and GlobalUpload are shared by every torrent and connection
+var (
+	GlobalDownload = New(0)
+	GlobalUpload   = New(0)
+)
+
+// New creates a limiter allowing rate bytes per second, 0 means unlimited
+func New(rate int) *Limiter {
+	l := &Limiter{last: time.Now(), changed: make(chan struct{})}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *Limiter) burst() float64 {
+	return float64(max(l.rate, minBurst))
+}
+
+// SetRate changes the allowed bytes per second, 0 means unlimited
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.refill(time.Now())
+	l.rate = rate
+	l.tokens = min(l.tokens, l.burst())
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the allowed bytes per second, 0 means unlimited
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), l.burst())
+	}
+	l.last = now
+}
+
+// WaitN takes n bytes from the bucket, blocking until the rate allows them.
+// Requests larger than the bucket run it into debt which later callers pay
+// off. A rate change applies to the bytes still owed by waiting callers.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	// owed is what has to flow into the bucket before our bytes are paid for
+	owed := -l.tokens
+	for owed > 0 && l.rate > 0 {
+		rate, changed := l.rate, l.changed
+		start := time.Now()
+		l.mu.Unlock()
+
+		timer := time.NewTimer(time.Duration(owed / float64(rate) * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed:
+			timer.Stop()
+		}
+		l.mu.Lock()
+		owed -= time.Since(start).Seconds() * float64(rate)
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// WaitAll takes n bytes from every limiter in turn
+func WaitAll(ctx context.Context, limiters []*Limiter, n int) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
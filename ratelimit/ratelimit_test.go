@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// tolerance is how much later than planned a wait may end on a busy machine
+const tolerance = 150 * time.Millisecond
+
+// timeWait runs WaitN and checks that it took about want
+func timeWait(t *testing.T, l *Limiter, n int, want time.Duration) {
+	t.Helper()
+	start := time.Now()
+	if err := l.WaitN(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < want-10*time.Millisecond || elapsed > want+tolerance {
+		t.Fatalf("WaitN(%d) took %s, want about %s", n, elapsed, want)
+	}
+}
+
+// fill makes the bucket full, as if it had been idle for long
+func fill(l *Limiter) {
+	l.mu.Lock()
+	l.last = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+}
+
+func TestUnlimited(t *testing.T) {
+	timeWait(t, New(0), 1<<30, 0)
+}
+
+func TestBurst(t *testing.T) {
+	const rate = 1 << 20
+	l := New(rate)
+	fill(l)
+	// A full bucket passes its size at once, the rest flows at the rate
+	timeWait(t, l, rate, 0)
+	timeWait(t, l, rate/5, 200*time.Millisecond)
+
+	// Slow rates still get a bucket of minBurst
+	l = New(1024)
+	fill(l)
+	timeWait(t, l, minBurst, 0)
+}
+
+func TestDebt(t *testing.T) {
+	const rate = 1 << 20
+	l := New(rate)
+	fill(l)
+	// A request over the bucket size waits for the excess only
+	timeWait(t, l, rate+rate/5, 200*time.Millisecond)
+	// Its debt is paid off, the next caller waits for its own bytes only
+	timeWait(t, l, rate/10, 100*time.Millisecond)
+
+	// Concurrent callers queue behind each other's debt
+	go l.WaitN(context.Background(), rate/5)
+	time.Sleep(20 * time.Millisecond)
+	timeWait(t, l, rate/5, 380*time.Millisecond)
+}
+
+func TestSetRateDuringWait(t *testing.T) {
+	const rate = 100 << 10
+	l := New(rate)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		// 90% of the bytes are still owed, at ten times the rate they take 90ms
+		l.SetRate(10 * rate)
+	}()
+	timeWait(t, l, rate, 190*time.Millisecond)
+
+	// Lifting the limit releases a waiting caller right away
+	l.SetRate(rate)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.SetRate(0)
+	}()
+	timeWait(t, l, rate, 100*time.Millisecond)
+	if l.Rate() != 0 {
+		t.Fatalf("Rate = %d, want 0", l.Rate())
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.WaitN(ctx, 1<<20); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond+tolerance {
+		t.Fatalf("Canceled WaitN returned after %s", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// scrapeReply is what one tracker answered for all the torrents it was asked about
+type scrapeReply struct {
+	results map[[20]byte]torrentfile.ScrapeResult
+	err     error
+}
+
+// runScrape implements `nebula scrape`, asking every tracker of the given
+// torrents about their swarms. Torrents sharing a tracker go into one request.
+func runScrape(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "Give up on trackers that have not answered after this long")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nebula scrape [flags] <torrent file>...")
+		fs.PrintDefaults()
+	}
+	positional := parseInterspersed(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var torrents []torrentfile.TorrentFile
+	hashesByTracker := make(map[string][][20]byte)
+	for _, path := range positional {
+		tf, err := torrentfile.Open(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		torrents = append(torrents, tf)
+		for _, tier := range tf.Trackers() {
+			for _, tracker := range tier {
+				hashesByTracker[tracker] = append(hashesByTracker[tracker], tf.InfoHash)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	replies := make(map[string]scrapeReply)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for tracker, hashes := range hashesByTracker {
+		wg.Add(1)
+		go func(tracker string, hashes [][20]byte) {
+			defer wg.Done()
+			results, err := torrentfile.Scrape(ctx, tracker, hashes)
+			mu.Lock()
+			replies[tracker] = scrapeReply{results: results, err: err}
+			mu.Unlock()
+		}(tracker, hashes)
+	}
+	wg.Wait()
+
+	for i, tf := range torrents {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (%s)\n", tf.Name, hex.EncodeToString(tf.InfoHash[:]))
+		for t, tier := range tf.Trackers() {
+			fmt.Printf("  tier %d:\n", t+1)
+			for _, tracker := range tier {
+				reply := replies[tracker]
+				result, ok := reply.results[tf.InfoHash]
+				switch {
+				case reply.err != nil:
+					fmt.Printf("    %s: %v\n", tracker, reply.err)
+				case !ok:
+					fmt.Printf("    %s: torrent not known to the tracker\n", tracker)
+				default:
+					fmt.Printf("    %s: %d seeders, %d leechers, %d completed\n", tracker, result.Seeders, result.Leechers, result.Completed)
+				}
+			}
+		}
+	}
+}
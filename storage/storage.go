@@ -0,0 +1,165 @@
+// Package storage maps the byte range of a torrent onto the files it contains.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is a file of the torrent, Path is relative to the storage root
+type File struct {
+	Path   string
+	Length int64
+	// Padding files (BEP 47) only align the next file to a piece boundary,
+	// they are all zeros and never written to disk
+	Padding bool
+}
+
+type openFile struct {
+	f      *os.File // nil for padding
+	offset int64    // offset of the file within the torrent
+	length int64
+}
+
+// Storage reads and writes torrent offsets across its files
+type Storage struct {
+	files  []openFile
+	length int64
+}
+
+// Open creates or opens every file below root, sized to its final length
+func Open(root string, files []File) (*Storage, error) {
+	s := &Storage{}
+	for _, file := range files {
+		if file.Padding {
+			s.files = append(s.files, openFile{offset: s.length, length: file.Length})
+			s.length += file.Length
+			continue
+		}
+		path := filepath.Join(root, file.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := f.Truncate(file.Length); err != nil {
+			f.Close()
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, openFile{f: f, offset: s.length, length: file.Length})
+		s.length += file.Length
+	}
+	return s, nil
+}
+
+// OpenReadOnly opens existing files below root for reading, e.g. to hash them.
+// Every file must have exactly its expected length.
+func OpenReadOnly(root string, files []File) (*Storage, error) {
+	s := &Storage{}
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(root, file.Path))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			s.Close()
+			return nil, err
+		}
+		if stat.Size() != file.Length {
+			f.Close()
+			s.Close()
+			return nil, fmt.Errorf("File %s is %d bytes, expected %d", file.Path, stat.Size(), file.Length)
+		}
+		s.files = append(s.files, openFile{f: f, offset: s.length, length: file.Length})
+		s.length += file.Length
+	}
+	return s, nil
+}
+
+// span calls fn for every file overlapping [off, off+n) with the part of
+// the file and of the buffer that overlap
+func (s *Storage) span(off int64, n int, fn func(f *os.File, fileOff int64, from, to int) error) error {
+	if off < 0 || off+int64(n) > s.length {
+		return fmt.Errorf("Range %d+%d outside of storage of %d bytes", off, n, s.length)
+	}
+	for _, file := range s.files {
+		start := max(off, file.offset)
+		end := min(off+int64(n), file.offset+file.length)
+		if start >= end {
+			continue
+		}
+		if err := fn(file.f, start-file.offset, int(start-off), int(end-off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	err := s.span(off, len(p), func(f *os.File, fileOff int64, from, to int) error {
+		if f == nil {
+			return nil
+		}
+		_, err := f.WriteAt(p[from:to], fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	err := s.span(off, len(p), func(f *os.File, fileOff int64, from, to int) error {
+		if f == nil {
+			clear(p[from:to])
+			return nil
+		}
+		_, err := f.ReadAt(p[from:to], fileOff)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync flushes every file to disk
+func (s *Storage) Sync() error {
+	for _, file := range s.files {
+		if file.f == nil {
+			continue
+		}
+		if err := file.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every file
+func (s *Storage) Close() error {
+	var firstErr error
+	for _, file := range s.files {
+		if file.f == nil {
+			continue
+		}
+		if err := file.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,102 @@
+package swarmsim
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/mse"
+	"github.com/Harry-kp/nebula/p2p"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// Memory is an in-memory io.WriterAt the leechers store their pieces in
+type Memory struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copy(m.data[off:], p), nil
+}
+
+// Bytes returns a copy of what has been written so far
+func (m *Memory) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.data...)
+}
+
+// Leecher is a Nebula peer downloading the torrent. Torrent may be adjusted
+// before Download, e.g. to set limiters or the encryption policy.
+type Leecher struct {
+	Torrent *p2p.Torrent
+	Storage *Memory
+	// Conns is the connection manager of the leecher, holding its ban list
+	Conns *connmgr.Manager
+
+	swarm    *Swarm
+	listener net.Listener
+}
+
+func newLeecher(s *Swarm, stallTimeout time.Duration) (*Leecher, error) {
+	peerID, err := randomPeerID("-NB0001-")
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	storage := &Memory{data: make([]byte, s.Torrent.Length)}
+	// Each leecher gets its own connection limits, as separate processes would
+	conns := connmgr.NewManager(connmgr.DefaultMaxConns, connmgr.DefaultMaxHalfOpen)
+	// Every simulated peer shares 127.0.0.1, a ban must only hit the one that cheated
+	conns.Bans().SetKey(connmgr.AddrKey)
+	leecher := &Leecher{Storage: storage, Conns: conns, swarm: s, listener: l}
+	leecher.Torrent = &p2p.Torrent{
+		PeerID:       peerID,
+		InfoHash:     s.Torrent.InfoHash,
+		PieceHashes:  s.Torrent.PieceHashes,
+		PieceLength:  s.Torrent.PieceLength,
+		Length:       s.Torrent.Length,
+		Name:         s.Torrent.Name,
+		StallTimeout: stallTimeout,
+		Reannounce: func(ctx context.Context) ([]peers.Peer, error) {
+			return s.announce(ctx, peerID, port, s.Torrent.Length, "")
+		},
+		Storage:    storage,
+		Encryption: mse.Prefer,
+		Listeners:  []net.Listener{l},
+		Conns:      conns.NewSwarm(connmgr.DefaultMaxConnsPerTorrent),
+	}
+	return leecher, nil
+}
+
+// Download announces the leecher, downloads the torrent, announces the
+// completion and checks the content
+func (l *Leecher) Download(ctx context.Context) error {
+	t := l.Torrent
+	port := uint16(l.listener.Addr().(*net.TCPAddr).Port)
+	swarm, err := l.swarm.announce(ctx, t.PeerID, port, t.Length, "started")
+	if err != nil {
+		return err
+	}
+	t.Peers = swarm
+	if err := t.Download(ctx); err != nil {
+		return err
+	}
+	if _, err := l.swarm.announce(ctx, t.PeerID, port, 0, "completed"); err != nil {
+		return err
+	}
+	return l.swarm.Verify(l)
+}
+
+func (l *Leecher) close() {
+	l.listener.Close()
+}
@@ -0,0 +1,298 @@
+package swarmsim
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Harry-kp/nebula/bitfield"
+	"github.com/Harry-kp/nebula/handshake"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/message"
+	"github.com/Harry-kp/nebula/mse"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// blockSize is the block size peers request, 16 KiB
+const blockSize = 16 << 10
+
+// Faults are the ways a seeder misbehaves
+type Faults struct {
+	// Delay is how long the seeder waits before sending each block, making it a slow peer
+	Delay time.Duration
+	// CorruptPieces are always served with a flipped byte, CorruptRate is the
+	// chance that any other piece is
+	CorruptPieces []int
+	CorruptRate   float64
+	// DisconnectRate is the chance that the seeder drops the connection after sending a block
+	DisconnectRate float64
+	// ChokeInterval, if set, chokes and unchokes every peer that often
+	ChokeInterval time.Duration
+	// Missing are pieces the seeder does not have, making it a partial seed
+	Missing []int
+	// StrayBlocks sends an unrequested corrupt copy of the previous block of
+	// the piece whenever the peer got that block from someone else, overlapping
+	// data another seeder is accountable for
+	StrayBlocks bool
+	// LeaveAfter, if set, makes the seeder leave the swarm once it served that
+	// many blocks: it announces stopped and drops every connection
+	LeaveAfter int
+}
+
+// Seeder serves the torrent over the peer wire protocol. It accepts plaintext
+// and encrypted connections and speaks the Fast Extension.
+type Seeder struct {
+	Addr peers.Peer
+	// BlocksServed counts the blocks sent to every peer, corrupt ones included
+	BlocksServed atomic.Int64
+
+	swarm    *Swarm
+	faults   Faults
+	peerID   [20]byte
+	have     *bitfield.Bitfield
+	corrupt  map[int]bool
+	listener net.Listener
+
+	// rand drives the fault decisions, it is shared by all connections
+	randMu sync.Mutex
+	rand   *mathrand.Rand
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newSeeder(s *Swarm, faults Faults, seed int64) (*Seeder, error) {
+	peerID, err := randomPeerID("-SIM001-")
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	seeder := &Seeder{
+		Addr:     peers.Peer{IP: addr.IP, Port: uint16(addr.Port)},
+		swarm:    s,
+		faults:   faults,
+		peerID:   peerID,
+		have:     bitfield.New(len(s.Torrent.PieceHashes)),
+		corrupt:  make(map[int]bool),
+		listener: l,
+		rand:     mathrand.New(mathrand.NewSource(seed)),
+		conns:    make(map[net.Conn]bool),
+	}
+	for index := range s.Torrent.PieceHashes {
+		seeder.have.SetPiece(index)
+	}
+	for _, index := range faults.Missing {
+		seeder.have.ClearPiece(index)
+	}
+	for _, index := range faults.CorruptPieces {
+		seeder.corrupt[index] = true
+	}
+	seeder.wg.Add(1)
+	go seeder.accept()
+	return seeder, nil
+}
+
+// chance reports true with probability p
+func (s *Seeder) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return s.rand.Float64() < p
+}
+
+func (s *Seeder) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close stops accepting peers and drops every connection
+func (s *Seeder) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// leave tells the tracker the seeder stopped and closes it
+func (s *Seeder) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.swarm.announce(ctx, s.peerID, s.Addr.Port, 0, "stopped"); err != nil {
+		logger.Println("Error announcing a leaving seeder:", err)
+	}
+	s.Close()
+}
+
+// peerConn is one connection of the seeder, writes come from the request loop
+// and the choke storm
+type peerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	choked  atomic.Bool
+	fast    bool
+	// asked holds the offsets of the blocks requested so far, only the request loop uses it
+	asked map[int]bool
+}
+
+func (c *peerConn) send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(msg.Serialize())
+	return err
+}
+
+func (s *Seeder) serve(rawConn net.Conn) {
+	rawConn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, _, err := mse.Accept(rawConn, [][20]byte{s.swarm.Torrent.InfoHash}, mse.Prefer)
+	if err != nil {
+		return
+	}
+	hsk, err := handshake.Read(conn)
+	if err != nil || hsk.InfoHash != s.swarm.Torrent.InfoHash {
+		return
+	}
+	if _, err := conn.Write(handshake.New(s.peerID, s.swarm.Torrent.InfoHash).Serialize()); err != nil {
+		return
+	}
+	rawConn.SetDeadline(time.Time{})
+
+	pc := &peerConn{conn: conn, fast: hsk.SupportsFast(), asked: make(map[int]bool)}
+	pc.choked.Store(true)
+	if err := pc.send(&message.Message{ID: message.MsgBitfield, Payload: s.have.Bytes()}); err != nil {
+		return
+	}
+	if s.faults.ChokeInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.chokeStorm(pc, done)
+	}
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if pc.choked.Swap(false) {
+				if err := pc.send(&message.Message{ID: message.MsgUnchoke}); err != nil {
+					return
+				}
+			}
+		case message.MsgRequest:
+			if len(msg.Payload) != 12 {
+				return
+			}
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+			length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+			if err := s.serveBlock(pc, index, begin, length); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveBlock answers one request, injecting the configured faults
+func (s *Seeder) serveBlock(pc *peerConn, index, begin, length int) error {
+	t := s.swarm.Torrent
+	offset := index*t.PieceLength + begin
+	if has, _ := s.have.HasPiece(index); pc.choked.Load() || !has || begin+length > t.PieceLength || offset+length > len(s.swarm.Data) {
+		// Without the Fast Extension the request is silently dropped
+		if pc.fast {
+			return pc.send(message.FormatReject(index, begin, length))
+		}
+		return nil
+	}
+	if s.faults.Delay > 0 {
+		time.Sleep(s.faults.Delay)
+	}
+
+	pc.asked[offset] = true
+	if s.faults.StrayBlocks && begin >= blockSize && !pc.asked[offset-blockSize] {
+		stray := make([]byte, 8+blockSize)
+		binary.BigEndian.PutUint32(stray[0:4], uint32(index))
+		binary.BigEndian.PutUint32(stray[4:8], uint32(begin-blockSize))
+		copy(stray[8:], s.swarm.Data[offset-blockSize:offset])
+		stray[8] ^= 0xff
+		if err := pc.send(&message.Message{ID: message.MsgPiece, Payload: stray}); err != nil {
+			return err
+		}
+	}
+
+	payload := make([]byte, 8+length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], s.swarm.Data[offset:offset+length])
+	if begin == 0 && (s.corrupt[index] || s.chance(s.faults.CorruptRate)) {
+		payload[8] ^= 0xff
+	}
+	if err := pc.send(&message.Message{ID: message.MsgPiece, Payload: payload}); err != nil {
+		return err
+	}
+	if served := s.BlocksServed.Add(1); s.faults.LeaveAfter > 0 && served == int64(s.faults.LeaveAfter) {
+		// Close waits for this connection, so leave from another goroutine
+		go s.leave()
+	}
+	if s.chance(s.faults.DisconnectRate) {
+		return io.EOF
+	}
+	return nil
+}
+
+// chokeStorm flips the choke state of the connection every ChokeInterval
+func (s *Seeder) chokeStorm(pc *peerConn, done chan struct{}) {
+	ticker := time.NewTicker(s.faults.ChokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		msg := &message.Message{ID: message.MsgChoke}
+		if pc.choked.Load() {
+			msg.ID = message.MsgUnchoke
+		}
+		pc.choked.Store(msg.ID == message.MsgChoke)
+		if pc.send(msg) != nil {
+			return
+		}
+	}
+}
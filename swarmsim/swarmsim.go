@@ -0,0 +1,228 @@
+// Package swarmsim runs a whole swarm on loopback for integration tests: a
+// tracker, seeders serving a generated torrent with injected faults and
+// Nebula leechers downloading it through p2p.Torrent. Nebula does not upload,
+// so every seeder is simulated and a leecher that finished serves nobody.
+package swarmsim
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+	"github.com/Harry-kp/nebula/tracker"
+)
+
+// announceInterval keeps simulated peers announcing often, tests run for seconds
+const announceInterval = time.Second
+
+// Config describes the swarm New starts
+type Config struct {
+	// Length is the size of the generated content, at least one byte
+	Length int
+	// PieceLength is a power of two of at least 16 KiB, zero picks one from Length
+	PieceLength int
+	// Seed makes the content and every injected fault reproducible
+	Seed int64
+	// Seeders holds the faults of each seeder, a zero Faults is a well behaved seeder
+	Seeders []Faults
+	// Leechers is the number of Nebula peers downloading the torrent
+	Leechers int
+	// StallTimeout overrides p2p.DefaultStallTimeout for the leechers
+	StallTimeout time.Duration
+	// Log enables the Nebula log output
+	Log bool
+}
+
+// Swarm is a running simulation. Close stops it.
+type Swarm struct {
+	// Data is the content of the torrent, what every leecher must end up with
+	Data []byte
+	// Torrent is the generated torrent, announced to Tracker
+	Torrent  torrentfile.TorrentFile
+	Tracker  *tracker.Server
+	Announce string
+	Seeders  []*Seeder
+	Leechers []*Leecher
+
+	dir        string
+	httpServer *http.Server
+}
+
+// New generates the content and its torrent, starts the tracker and the
+// seeders and prepares the leechers. On error everything started is stopped.
+func New(cfg Config) (s *Swarm, err error) {
+	if cfg.Length <= 0 {
+		return nil, fmt.Errorf("Invalid content length %d", cfg.Length)
+	}
+	logger.Init(logger.Config{LogEnabled: cfg.Log})
+
+	s = &Swarm{Data: make([]byte, cfg.Length)}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+	mathrand.New(mathrand.NewSource(cfg.Seed)).Read(s.Data)
+
+	if s.Tracker, err = tracker.New(tracker.Config{Interval: announceInterval}); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.httpServer = &http.Server{Handler: s.Tracker}
+	go s.httpServer.Serve(l)
+	s.Announce = fmt.Sprintf("http://%s/announce", l.Addr())
+
+	if err := s.generateTorrent(cfg); err != nil {
+		return nil, err
+	}
+	for i, faults := range cfg.Seeders {
+		seeder, err := newSeeder(s, faults, cfg.Seed+int64(i)+1)
+		if err != nil {
+			return nil, err
+		}
+		s.Seeders = append(s.Seeders, seeder)
+		if _, err := s.announce(context.Background(), seeder.peerID, seeder.Addr.Port, 0, "started"); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < cfg.Leechers; i++ {
+		leecher, err := newLeecher(s, cfg.StallTimeout)
+		if err != nil {
+			return nil, err
+		}
+		s.Leechers = append(s.Leechers, leecher)
+	}
+	return s, nil
+}
+
+// generateTorrent writes the content to a temporary directory and runs it
+// through torrentfile.Create and torrentfile.Open, as a user would
+func (s *Swarm) generateTorrent(cfg Config) (err error) {
+	if s.dir, err = os.MkdirTemp("", "swarmsim"); err != nil {
+		return err
+	}
+	content := filepath.Join(s.dir, "content.bin")
+	if err := os.WriteFile(content, s.Data, 0644); err != nil {
+		return err
+	}
+	data, err := torrentfile.Create(content, torrentfile.CreateOptions{
+		Trackers:    []string{s.Announce},
+		PieceLength: cfg.PieceLength,
+	})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, "content.bin.torrent")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	s.Torrent, err = torrentfile.Open(path)
+	return err
+}
+
+// announce registers a simulated peer with the tracker and returns the peers it hands out
+func (s *Swarm) announce(ctx context.Context, peerID [20]byte, port uint16, left int, event string) ([]peers.Peer, error) {
+	params := url.Values{}
+	params.Add("info_hash", string(s.Torrent.InfoHash[:]))
+	params.Add("peer_id", string(peerID[:]))
+	params.Add("port", strconv.Itoa(int(port)))
+	params.Add("left", strconv.Itoa(left))
+	if event != "" {
+		params.Add("event", event)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Announce+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var trackerResp torrentfile.TrackerResponse
+	if err := bencode.NewDecoder(response.Body).Decode(&trackerResp); err != nil {
+		return nil, err
+	}
+	if trackerResp.FailureReason != "" {
+		return nil, errors.New(trackerResp.FailureReason)
+	}
+	return trackerResp.PeerList()
+}
+
+// Run downloads the torrent with every leecher at once and checks that each
+// ended up with the right content
+func (s *Swarm) Run(ctx context.Context) error {
+	errs := make([]error, len(s.Leechers))
+	var wg sync.WaitGroup
+	for i, leecher := range s.Leechers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = leecher.Download(ctx)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("Leecher %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Verify reports whether the leecher holds exactly the content of the torrent
+func (s *Swarm) Verify(l *Leecher) error {
+	got := l.Storage.Bytes()
+	for index := range s.Torrent.PieceHashes {
+		begin := index * s.Torrent.PieceLength
+		end := min(begin+s.Torrent.PieceLength, len(s.Data))
+		if !bytes.Equal(got[begin:end], s.Data[begin:end]) {
+			return fmt.Errorf("Piece #%d differs from the content", index)
+		}
+	}
+	return nil
+}
+
+// Close stops the seeders and the tracker and removes the generated files
+func (s *Swarm) Close() error {
+	for _, leecher := range s.Leechers {
+		leecher.close()
+	}
+	for _, seeder := range s.Seeders {
+		seeder.Close()
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if s.dir != "" {
+		return os.RemoveAll(s.dir)
+	}
+	return nil
+}
+
+// randomPeerID returns a peer ID with the given client prefix
+func randomPeerID(prefix string) ([20]byte, error) {
+	var id [20]byte
+	n := copy(id[:], prefix)
+	_, err := rand.Read(id[n:])
+	return id, err
+}
@@ -0,0 +1,166 @@
+package swarmsim
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/peers"
+)
+
+// corrupter serves the first block of every piece with a flipped byte. Each
+// scenario runs one next to the seeders under test, as seeder 0.
+var corrupter = Faults{CorruptRate: 1}
+
+// misbehaves reports whether a seeder with the faults sends bad data it may
+// be struck for
+func misbehaves(f Faults) bool {
+	return f.CorruptRate > 0 || len(f.CorruptPieces) > 0 || f.StrayBlocks
+}
+
+// run starts the swarm, downloads the torrent with every leecher and checks
+// the content and the bans each leecher ended up with
+func run(t *testing.T, cfg Config) {
+	t.Helper()
+	if cfg.Length == 0 {
+		cfg.Length = 2<<20 + 123
+	}
+	if cfg.PieceLength == 0 {
+		cfg.PieceLength = 64 << 10
+	}
+	if cfg.Leechers == 0 {
+		cfg.Leechers = 1
+	}
+	cfg.StallTimeout = 20 * time.Second
+	cfg.Seeders = append([]Faults{corrupter}, cfg.Seeders...)
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, l := range s.Leechers {
+		// A single strike bans, so an honest seeder struck even once fails the test
+		bans := connmgr.NewBans(1)
+		bans.SetKey(connmgr.AddrKey)
+		l.Conns.SetBans(bans)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sha256.Sum256(s.Data)
+	for i, l := range s.Leechers {
+		if got := sha256.Sum256(l.Storage.Bytes()); got != want {
+			t.Errorf("Leecher %d: file hash %x, want %x", i, got, want)
+		}
+		bans := l.Conns.Bans()
+		for j, seeder := range s.Seeders {
+			banned := bans.Banned(seeder.Addr)
+			switch {
+			case j == 0 && !banned:
+				t.Errorf("Leecher %d: corrupt seeder 0 not banned", i)
+			case j > 0 && banned && !misbehaves(seeder.faults):
+				t.Errorf("Leecher %d: well behaved seeder %d banned", i, j)
+			}
+		}
+	}
+}
+
+func TestBasic(t *testing.T) {
+	run(t, Config{
+		Seeders:  []Faults{{Delay: 5 * time.Millisecond}, {Delay: 5 * time.Millisecond, Missing: []int{1, 2, 3}}},
+		Leechers: 2,
+	})
+}
+
+func TestCorrupt(t *testing.T) {
+	run(t, Config{
+		Seeders: []Faults{{Delay: 5 * time.Millisecond}, {Delay: 5 * time.Millisecond, CorruptPieces: []int{3}}},
+		Seed:    1,
+	})
+}
+
+func TestDisconnect(t *testing.T) {
+	run(t, Config{
+		Seeders: []Faults{{Delay: 5 * time.Millisecond, DisconnectRate: 0.05}, {Delay: 5 * time.Millisecond, DisconnectRate: 0.05}},
+		Seed:    2,
+	})
+}
+
+func TestChoke(t *testing.T) {
+	run(t, Config{
+		Seeders: []Faults{{Delay: 5 * time.Millisecond, ChokeInterval: 200 * time.Millisecond}, {Delay: 5 * time.Millisecond, ChokeInterval: 300 * time.Millisecond}},
+		Seed:    3,
+	})
+}
+
+func TestOddLength(t *testing.T) {
+	// Neither the last piece nor its last block is full
+	run(t, Config{
+		Length:      1<<20 + 16<<10 + 77,
+		PieceLength: 32 << 10,
+		Seeders:     []Faults{{Delay: 5 * time.Millisecond}},
+		Seed:        4,
+	})
+}
+
+func TestStrayBlock(t *testing.T) {
+	// Disconnects leave pieces half done for the stray seeder to finish, its
+	// stray blocks then overlap blocks of the others. They must not make the
+	// pieces fail and get the honest seeders struck.
+	run(t, Config{
+		Seeders: []Faults{{StrayBlocks: true}, {Delay: 5 * time.Millisecond, DisconnectRate: 0.2}, {Delay: 5 * time.Millisecond, DisconnectRate: 0.2}},
+		Seed:    5,
+	})
+}
+
+func TestStall(t *testing.T) {
+	// Every seeder leaves a third of the way in, nobody is left to finish the download
+	const stallTimeout = 2 * time.Second
+	s, err := New(Config{
+		Length:       2 << 20,
+		PieceLength:  64 << 10,
+		Seeders:      []Faults{{Delay: 5 * time.Millisecond, LeaveAfter: 20}, {Delay: 5 * time.Millisecond, LeaveAfter: 20}},
+		Leechers:     1,
+		StallTimeout: stallTimeout,
+		Seed:         6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l := s.Leechers[0]
+	l.Torrent.ReannounceInterval = 500 * time.Millisecond
+	var reannounces atomic.Int32
+	reannounce := l.Torrent.Reannounce
+	l.Torrent.Reannounce = func(ctx context.Context) ([]peers.Peer, error) {
+		reannounces.Add(1)
+		return reannounce(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = l.Download(ctx)
+	if err == nil || !strings.HasPrefix(err.Error(), "Download stalled") {
+		t.Fatalf("Download = %v, want a stalled download", err)
+	}
+	// Each re-announce gets a stall timeout to bring progress, and the last one
+	// another before Download gives up
+	if elapsed, limit := time.Since(start), 10*stallTimeout; elapsed > limit {
+		t.Fatalf("Download gave up after %s, want at most %s", elapsed, limit)
+	}
+	if got := reannounces.Load(); got != 3 {
+		t.Fatalf("Re-announced %d times, want 3", got)
+	}
+	if l.Torrent.Completed.Count() == 0 {
+		t.Fatal("No piece was downloaded before the seeders left")
+	}
+}
@@ -0,0 +1,236 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/storage"
+)
+
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	// targetPieces is roughly how many pieces an auto sized torrent gets
+	targetPieces = 1500
+)
+
+// CreateOptions describes the torrent Create builds
+type CreateOptions struct {
+	// Trackers are the announce URLs, one tier each. The first one is also the announce key.
+	Trackers []string
+	// PieceLength is a power of two of at least 16 KiB, zero picks one from the content size
+	PieceLength int
+	Comment     string
+	CreatedBy   string
+	// CreationDate is left out when zero, keeping the output reproducible
+	CreationDate time.Time
+	// Private keeps clients from finding peers anywhere but the trackers (BEP 27)
+	Private bool
+	// WebSeeds are BEP 19 url-list entries
+	WebSeeds []string
+	// Source is stored in the info dictionary, so the same files published on
+	// several trackers get different info hashes
+	Source string
+	// Workers is the number of pieces hashed in parallel, zero uses every CPU
+	Workers int
+}
+
+// AutoPieceLength picks a power of two piece length for content of the given size
+func AutoPieceLength(size int64) int {
+	length := minAutoPieceLength
+	for length < maxAutoPieceLength && size/int64(length) > targetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// Create hashes the file or directory at path and returns the bencoded
+// .torrent. Directory entries are sorted, so the same input always gives the same bytes.
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	if len(opts.Trackers) == 0 {
+		return nil, fmt.Errorf("At least one tracker is required")
+	}
+	// The name comes from the last path element, which "." or ".." do not have
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	if !validPathElement(name) {
+		return nil, fmt.Errorf("Cannot share the filesystem root %s", path)
+	}
+	root, files, err := collectFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	for _, f := range files {
+		length += f.Length
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("Nothing to share in %s", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(length)
+	}
+	if pieceLength < minAutoPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("Piece length %d is not a power of two of at least %d", pieceLength, minAutoPieceLength)
+	}
+
+	store, err := storage.OpenReadOnly(root, files)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	pieces, err := hashPieces(store, length, pieceLength, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info := bencodeInfo{
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+		Name:        name,
+		Source:      opts.Source,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+	if root == path {
+		for _, f := range files {
+			info.Files = append(info.Files, bencodeFile{
+				Length: int(f.Length),
+				Path:   strings.Split(filepath.ToSlash(f.Path), "/"),
+			})
+		}
+	} else {
+		info.Length = int(length)
+	}
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	bto := bencodeTorrent{
+		Announce:  opts.Trackers[0],
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		Info:      infoBytes,
+	}
+	if len(opts.Trackers) > 1 {
+		for _, tracker := range opts.Trackers {
+			bto.AnnounceList = append(bto.AnnounceList, []string{tracker})
+		}
+	}
+	if !opts.CreationDate.IsZero() {
+		bto.CreationDate = opts.CreationDate.Unix()
+	}
+	if len(opts.WebSeeds) > 0 {
+		bto.URLList = opts.WebSeeds
+	}
+
+	return bencode.Marshal(bto)
+}
+
+// collectFiles lists the regular files to share. For a single file root is
+// its directory, for a directory root is the directory itself.
+func collectFiles(path string) (string, []storage.File, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !stat.IsDir() {
+		return filepath.Dir(path), []storage.File{{Path: filepath.Base(path), Length: stat.Size()}}, nil
+	}
+
+	var files []storage.File
+	// WalkDir visits entries in lexical order
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, storage.File{Path: rel, Length: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(files) == 0 {
+		return "", nil, fmt.Errorf("No files found in %s", path)
+	}
+	return path, files, nil
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of every piece, hashing
+// them on several goroutines
+func hashPieces(store *storage.Storage, length int64, pieceLength, workers int) ([]byte, error) {
+	numPieces := int((length + int64(pieceLength) - 1) / int64(pieceLength))
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = min(workers, numPieces)
+
+	hashes := make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				begin := int64(index) * int64(pieceLength)
+				n := int(min(int64(pieceLength), length-begin))
+				if _, err := store.ReadAt(buf[:n], begin); err != nil {
+					errs <- err
+					return
+				}
+				hash := sha1.Sum(buf[:n])
+				copy(hashes[index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for index := 0; index < numPieces; index++ {
+		select {
+		case indexes <- index:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case err = <-errs:
+		return nil, err
+	default:
+	}
+	return hashes, nil
+}
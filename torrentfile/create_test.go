@@ -0,0 +1,188 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree creates the files under dir, keyed by slash separated path
+func writeTree(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func content(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// createAndOpen runs Create and reads its output back with Open
+func createAndOpen(t *testing.T, path string, opts CreateOptions) ([]byte, TorrentFile) {
+	t.Helper()
+	data, err := Create(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := filepath.Join(t.TempDir(), "out.torrent")
+	if err := os.WriteFile(torrent, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf, err := Open(torrent)
+	if err != nil {
+		t.Fatalf("Open of a created torrent: %v", err)
+	}
+	return data, tf
+}
+
+// checkPieces compares the piece hashes of tf with the hashes of data
+func checkPieces(t *testing.T, tf TorrentFile, data []byte) {
+	t.Helper()
+	var want [][20]byte
+	for begin := 0; begin < len(data); begin += tf.PieceLength {
+		want = append(want, sha1.Sum(data[begin:min(begin+tf.PieceLength, len(data))]))
+	}
+	if !reflect.DeepEqual(tf.PieceHashes, want) {
+		t.Fatalf("Got %d piece hashes that differ from the %d of the content", len(tf.PieceHashes), len(want))
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	data := content(100<<10+7, 1)
+	writeTree(t, dir, map[string][]byte{"movie.mkv": data})
+	opts := CreateOptions{
+		Trackers:     []string{"http://a.example/announce", "udp://b.example:6969"},
+		PieceLength:  32 << 10,
+		Comment:      "test",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		WebSeeds:     []string{"http://mirror.example/movie.mkv"},
+		Source:       "SRC",
+	}
+	_, tf := createAndOpen(t, filepath.Join(dir, "movie.mkv"), opts)
+	if tf.Name != "movie.mkv" || tf.Length != len(data) || tf.Files != nil || tf.PieceLength != 32<<10 {
+		t.Fatalf("Got name %q, length %d, %d files and piece length %d", tf.Name, tf.Length, len(tf.Files), tf.PieceLength)
+	}
+	checkPieces(t, tf, data)
+	wantTiers := [][]string{{"http://a.example/announce"}, {"udp://b.example:6969"}}
+	if tf.Announce != opts.Trackers[0] || !reflect.DeepEqual(tf.AnnounceList, wantTiers) {
+		t.Fatalf("Got announce %q and tiers %q", tf.Announce, tf.AnnounceList)
+	}
+	if !tf.Private || tf.Source != "SRC" || tf.Comment != "test" || !tf.CreationDate.Equal(opts.CreationDate) ||
+		!reflect.DeepEqual(tf.WebSeeds, opts.WebSeeds) {
+		t.Fatalf("Options did not survive: %+v", tf)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "album")
+	files := map[string][]byte{
+		"b.flac":         content(40<<10, 2),
+		"a.flac":         content(10<<10+3, 3),
+		"sub/cover.jpg":  content(5<<10, 4),
+		"sub/deep/z.txt": content(1, 5),
+	}
+	writeTree(t, dir, files)
+	_, tf := createAndOpen(t, dir, CreateOptions{Trackers: []string{"http://a.example/announce"}, PieceLength: 16 << 10})
+
+	// Files are in lexical order, the pieces run across them in that order
+	order := []string{"a.flac", "b.flac", "sub/cover.jpg", "sub/deep/z.txt"}
+	var want []File
+	var all []byte
+	for _, name := range order {
+		want = append(want, File{Length: len(files[name]), Path: strings.Split(name, "/")})
+		all = append(all, files[name]...)
+	}
+	if tf.Name != "album" || tf.Length != len(all) || !reflect.DeepEqual(tf.Files, want) {
+		t.Fatalf("Got name %q, length %d and files %v", tf.Name, tf.Length, tf.Files)
+	}
+	if tf.AnnounceList != nil {
+		t.Fatalf("A single tracker got an announce-list %q", tf.AnnounceList)
+	}
+	checkPieces(t, tf, all)
+}
+
+func TestCreateDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string][]byte{
+		"x/1.bin": content(70<<10, 6),
+		"x/2.bin": content(3, 7),
+		"x/3.bin": content(33<<10, 8),
+	})
+	opts := CreateOptions{Trackers: []string{"http://a.example/announce"}, PieceLength: 16 << 10, Workers: 1}
+	first, err := Create(filepath.Join(dir, "x"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither another run nor parallel hashing may change a byte
+	opts.Workers = 8
+	second, err := Create(filepath.Join(dir, "x"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("Two runs over the same files gave different torrents")
+	}
+	// Without a creation date nothing depends on the time of the run
+	if bytes.Contains(first, []byte("creation date")) {
+		t.Fatal("Torrent without CreationDate carries a creation date")
+	}
+}
+
+func TestCreateRelativePath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "share")
+	writeTree(t, dir, map[string][]byte{"sub/f.bin": content(100, 9)})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	opts := CreateOptions{Trackers: []string{"http://a.example/announce"}}
+	// "." and ".." are named after the directory they stand for
+	for path, name := range map[string]string{".": "sub", "..": "share", "./": "sub"} {
+		if _, tf := createAndOpen(t, path, opts); tf.Name != name {
+			t.Errorf("Create(%q) named the torrent %q, want %q", path, tf.Name, name)
+		}
+	}
+	if _, err := Create(string(filepath.Separator), opts); err == nil {
+		t.Error("Create of the filesystem root succeeded")
+	}
+}
+
+func TestCreateOptionsErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string][]byte{"f.bin": content(100, 10)})
+	path := filepath.Join(dir, "f.bin")
+	for _, opts := range []CreateOptions{
+		{},
+		{Trackers: []string{"http://a.example/announce"}, PieceLength: 1000},
+		{Trackers: []string{"http://a.example/announce"}, PieceLength: 8 << 10},
+	} {
+		if _, err := Create(path, opts); err == nil {
+			t.Errorf("Create took options %+v", opts)
+		}
+	}
+	if _, err := Create(filepath.Join(dir, "missing"), CreateOptions{Trackers: []string{"http://a.example/announce"}}); err == nil {
+		t.Error("Create of a missing path succeeded")
+	}
+}
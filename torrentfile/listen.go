@@ -0,0 +1,44 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/utp"
+)
+
+// listen opens the TCP listener and, if enabled, the uTP socket on Port. Both
+// share the port number so peers from the tracker can reach us over either.
+// A port that is taken, e.g. by another client, only means fewer incoming peers.
+func listen(utpEnabled bool) []net.Listener {
+	addr := fmt.Sprintf(":%d", Port)
+	var listeners []net.Listener
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Println("Not accepting TCP peers:", err)
+	} else {
+		listeners = append(listeners, tcp)
+	}
+
+	if !utpEnabled {
+		connmgr.Default.SetTransports(connmgr.TCP)
+		return listeners
+	}
+	socket, err := utp.Listen(addr)
+	if err != nil {
+		logger.Println("Not using uTP:", err)
+		connmgr.Default.SetTransports(connmgr.TCP)
+		return listeners
+	}
+	// uTP goes first since its congestion control yields to our other traffic
+	connmgr.Default.SetTransports(connmgr.Transport{
+		Name: "utp",
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return socket.Dial(ctx, addr)
+		},
+	}, connmgr.TCP)
+	return append(listeners, socket)
+}
@@ -0,0 +1,81 @@
+package torrentfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/Harry-kp/nebula/bitfield"
+	"github.com/Harry-kp/nebula/logger"
+)
+
+// ResumePath returns the path of the resume data kept next to an unfinished download
+func ResumePath(path string) string {
+	return path + ".resume"
+}
+
+// loadResume reads the pieces completed by an earlier run and keeps only the
+// ones whose data in storage still matches their hash. Missing or foreign
+// resume data just means starting from scratch.
+func (t *TorrentFile) loadResume(path string, storage io.ReaderAt) (*bitfield.Bitfield, error) {
+	completed := bitfield.New(t.numPieces())
+	data, err := os.ReadFile(ResumePath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 20 || !bytes.Equal(data[:20], t.InfoHash[:]) {
+		logger.Println("Ignoring resume data that does not belong to", t.Name)
+		return completed, nil
+	}
+	saved := new(bitfield.Bitfield)
+	if err := saved.UnmarshalBinary(data[20:]); err != nil || saved.Len() != t.numPieces() {
+		// Resume data written before the piece count was recorded holds the bare bits
+		if saved, err = bitfield.FromBytes(data[20:], t.numPieces()); err != nil {
+			logger.Println("Ignoring invalid resume data of", t.Name)
+			return completed, nil
+		}
+	}
+
+	for index, ok := saved.NextSet(0); ok; index, ok = saved.NextSet(index + 1) {
+		begin := index * t.PieceLength
+		end := begin + t.PieceLength
+		if end > t.Length {
+			end = t.Length
+		}
+		buf := make([]byte, end-begin)
+		if _, err := storage.ReadAt(buf, int64(begin)); err != nil {
+			return nil, fmt.Errorf("Error verifying resumed piece #%d: %w", index, err)
+		}
+		if t.verifyPiece(index, buf) {
+			completed.SetPiece(index)
+		}
+	}
+	return completed, nil
+}
+
+// saveResume records the completed pieces so an interrupted download can carry on later
+func (t *TorrentFile) saveResume(path string, completed *bitfield.Bitfield) error {
+	bits, err := completed.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, 20+len(bits))
+	data = append(data, t.InfoHash[:]...)
+	data = append(data, bits...)
+	return os.WriteFile(ResumePath(path), data, 0644)
+}
+
+// removeResume deletes the resume data once the download is complete
+func removeResume(path string) error {
+	err := os.Remove(ResumePath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Harry-kp/nebula/bencode"
+)
+
+// ScrapeResult is what a tracker knows about the swarm of one torrent
+type ScrapeResult struct {
+	// Seeders and Leechers are the peers currently announcing with and without the whole torrent
+	Seeders  int
+	Leechers int
+	// Completed counts every download the tracker saw finish
+	Completed int
+}
+
+// ScrapeFile is what a scrape response tells about one torrent
+type ScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// ScrapeResponse is the bencoded answer to an HTTP scrape, Files is keyed by
+// the raw 20 byte info hash
+type ScrapeResponse struct {
+	Files         map[string]ScrapeFile `bencode:"files"`
+	FailureReason string                `bencode:"failure reason,omitempty"`
+}
+
+// ScrapeURL derives the scrape URL of a tracker from its announce URL (BEP 48).
+// HTTP trackers only support scrape when the last path element starts with
+// "announce", UDP trackers scrape on the announce URL itself.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "udp":
+		return announce, nil
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("Unsupported tracker protocol %q", u.Scheme)
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s does not support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// Scrape asks the tracker behind the announce URL about several torrents at
+// once. Torrents the tracker does not know are missing from the result.
+func Scrape(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(scrapeURL, "udp:") {
+		return scrapeUDP(ctx, scrapeURL, infoHashes)
+	}
+	return scrapeHTTP(ctx, scrapeURL, infoHashes)
+}
+
+func scrapeHTTP(ctx context.Context, scrapeURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	params := url.Values{}
+	for _, hash := range infoHashes {
+		params.Add("info_hash", string(hash[:]))
+	}
+	separator := "?"
+	if strings.Contains(scrapeURL, "?") {
+		separator = "&"
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL+separator+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker answered the scrape with %s", response.Status)
+	}
+
+	scrapeResp := ScrapeResponse{}
+	decoder := bencode.NewDecoder(response.Body)
+	decoder.MaxSize = maxTrackerResponse
+	decoder.MaxStringLength = maxTrackerResponse
+	decoder.MaxDepth = maxTrackerDepth
+	if err := decoder.Decode(&scrapeResp); err != nil {
+		return nil, err
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, fmt.Errorf("Tracker refused the scrape: %s", scrapeResp.FailureReason)
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for key, file := range scrapeResp.Files {
+		var hash [20]byte
+		if len(key) != len(hash) {
+			continue
+		}
+		copy(hash[:], key)
+		results[hash] = ScrapeResult{Seeders: file.Complete, Leechers: file.Incomplete, Completed: file.Downloaded}
+	}
+	return results, nil
+}
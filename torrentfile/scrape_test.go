@@ -0,0 +1,66 @@
+package torrentfile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Harry-kp/nebula/bencode"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string // empty when the tracker cannot scrape
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"https://example.com:8443/announce?passkey=abc", "https://example.com:8443/scrape?passkey=abc"},
+		{"http://example.com/announce/x", ""},
+		{"http://example.com/a", ""},
+		{"http://example.com/x/announce/", ""},
+		{"http://example.com/", ""},
+		{"http://example.com", ""},
+		{"http://example.com/anounce", ""},
+		{"udp://tracker.example:6969", "udp://tracker.example:6969"},
+		{"udp://tracker.example:6969/announce", "udp://tracker.example:6969/announce"},
+		{"wss://tracker.example/announce", ""},
+		{"://bad", ""},
+	}
+	for _, test := range tests {
+		got, err := ScrapeURL(test.announce)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ScrapeURL(%q) = %q, want an error", test.announce, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ScrapeURL(%q) = %q, %v, want %q", test.announce, got, err, test.want)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	known, unknown := [20]byte{1, 2, 3}, [20]byte{4, 5, 6}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("passkey") != "abc" || len(r.URL.Query()["info_hash"]) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		bencode.NewEncoder(w).Encode(ScrapeResponse{Files: map[string]ScrapeFile{
+			string(known[:]): {Complete: 5, Downloaded: 7, Incomplete: 3},
+		}})
+	}))
+	defer server.Close()
+
+	results, err := Scrape(context.Background(), server.URL+"/announce?passkey=abc", [][20]byte{known, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[known] != (ScrapeResult{Seeders: 5, Leechers: 3, Completed: 7}) {
+		t.Fatalf("Got %+v", results)
+	}
+}
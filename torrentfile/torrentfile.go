@@ -1,78 +1,273 @@
 package torrentfile
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/bitfield"
+	"github.com/Harry-kp/nebula/connmgr"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/merkle"
+	"github.com/Harry-kp/nebula/mse"
 	"github.com/Harry-kp/nebula/p2p"
-	"github.com/jackpal/bencode-go"
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/ratelimit"
+	"github.com/Harry-kp/nebula/storage"
+	"github.com/Harry-kp/nebula/webseed"
 )
 
 const Port uint16 = 6881
 
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	// Attr holds "p" for the padding files of hybrid torrents (BEP 47)
+	Attr string `bencode:"attr,omitempty"`
+}
+
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces,omitempty"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
+	Source      string        `bencode:"source,omitempty"`
+	// BitTorrent v2 (BEP 52)
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	// Info is kept as read, the info hash covers these exact bytes
+	Info bencode.RawMessage `bencode:"info"`
+	// URLList is a single URL or a list of them (BEP 19)
+	URLList   interface{} `bencode:"url-list,omitempty"`
+	HTTPSeeds []string    `bencode:"httpseeds,omitempty"`
+	// PieceLayers maps the pieces root of every v2 file larger than a piece to its piece hashes
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+}
+
+// DownloadOptions tunes how DownloadToFile talks to the swarm
+type DownloadOptions struct {
+	// StallTimeout is how long the download may go without progress before
+	// re-announcing, and eventually giving up. Zero uses p2p.DefaultStallTimeout.
+	StallTimeout time.Duration
+	// IdleTimeout is how long a silent peer is waited on before it is dropped,
+	// zero uses client.DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// DownloadLimiter and UploadLimiter cap this torrent on top of the global
+	// limits, nil means no per-torrent limit
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// MaxConns caps the peer connections of this torrent, zero uses
+	// connmgr.DefaultMaxConnsPerTorrent
+	MaxConns int
+	// Encryption decides whether peer connections use Message Stream Encryption
+	Encryption mse.Policy
+	// UTP connects to peers over uTP as well as TCP
+	UTP bool
+}
+
+// File is one file of a multi-file torrent, Path is relative to the torrent's directory
+type File struct {
+	Length int
+	Path   []string
+	// Padding files only align the next file to a piece boundary and are not stored
+	Padding bool
 }
 
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
+	Announce string
+	// InfoHash identifies the torrent to trackers and peers, the v1 hash or,
+	// for a pure v2 torrent, the truncated v2 hash
+	InfoHash [20]byte
+	// InfoHashV2 is the SHA-256 of the info dictionary of v2 and hybrid torrents
+	InfoHashV2 [32]byte
+	// MetaVersion is 2 for v2 and hybrid torrents and 1 otherwise
+	MetaVersion int
+	// PieceHashes are the v1 SHA-1 piece hashes, nil for a pure v2 torrent
 	PieceHashes [][20]byte
+	// PieceRoots tell how every piece is verified under v2, nil for a v1 torrent
+	PieceRoots []merkle.Piece
+	// InfoBytes is the info dictionary exactly as it appears in the .torrent,
+	// both info hashes are computed over it
+	InfoBytes   []byte
 	PieceLength int
 	Length      int
 	Name        string
+	// Files is nil for a single file torrent
+	Files []File
+	// WebSeeds are BEP 19 mirrors of the files, HTTPSeeds BEP 17 piece servers
+	WebSeeds  []string
+	HTTPSeeds []string
+	// AnnounceList holds the tiers of trackers (BEP 12), nil if the torrent has only Announce
+	AnnounceList [][]string
+	// Private torrents only get peers from their trackers (BEP 27)
+	Private bool
+	// Source is the source tag of the info dictionary, if any
+	Source       string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
 }
 
-func (i *bencodeInfo) Hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
+// Trackers returns the tiers of trackers to announce to, from the
+// announce-list if the torrent has one and Announce otherwise
+func (t *TorrentFile) Trackers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	return [][]string{{t.Announce}}
+}
+
+// storageFiles lays the torrent out below root, which is the output file's
+// directory for a single file torrent and the torrent's own directory otherwise
+func (t *TorrentFile) storageFiles(path string) (string, []storage.File) {
+	if t.Files == nil {
+		return filepath.Dir(path), []storage.File{{Path: filepath.Base(path), Length: int64(t.Length)}}
+	}
+	files := make([]storage.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = storage.File{Path: filepath.Join(f.Path...), Length: int64(f.Length), Padding: f.Padding}
+	}
+	return path, files
+}
+
+// webSeeds returns the web seeds of the torrent ready for p2p
+func (t *TorrentFile) webSeeds() []p2p.WebSeed {
+	var files []webseed.File
+	for _, f := range t.Files {
+		files = append(files, webseed.File{Path: f.Path, Length: int64(f.Length), Padding: f.Padding})
+	}
+	var seeds []p2p.WebSeed
+	for _, u := range t.WebSeeds {
+		seeds = append(seeds, &webseed.URLSeed{URL: u, Name: t.Name, Files: files, Length: int64(t.Length)})
 	}
-	return sha1.Sum(buf.Bytes()), nil
+	for _, u := range t.HTTPSeeds {
+		seeds = append(seeds, &webseed.HTTPSeed{URL: u, InfoHash: t.InfoHash})
+	}
+	return seeds
 }
 
-func (t *TorrentFile) DownloadToFile(path string) error {
+// StoppedAnnounceTimeout bounds the final announce sent after the download context is done
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// DownloadToFile downloads the torrent into path. If ctx is cancelled the data
+// written so far is flushed, resume data is saved next to the file and the
+// tracker is told that we stopped, so a later call picks up where this one left.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, opts DownloadOptions) (err error) {
 	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	_, err = rand.Read(peerID[:])
 	if err != nil {
 		return err
 	}
 
-	peers, err := t.fetchPeers(peerID, Port)
+	root, files := t.storageFiles(path)
+	store, err := storage.Open(root, files)
 	if err != nil {
 		return err
 	}
-	torrent := p2p.Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-	}
-	buf := torrent.Download()
-	outFile, err := os.Create(path)
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+	defer store.Close()
+
+	completed, err := t.loadResume(path, store)
 	if err != nil {
 		return err
 	}
-	return nil
 
+	swarm, err := t.fetchPeers(ctx, peerID, Port, eventStarted, t.bytesLeft(completed))
+	if err != nil {
+		// Keep the output file resumable even though nothing was downloaded
+		if saveErr := t.saveResume(path, completed); saveErr != nil {
+			logger.Println("Error saving resume data:", saveErr)
+		}
+		return err
+	}
+	listeners := listen(opts.UTP)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	maxConns := opts.MaxConns
+	if maxConns <= 0 {
+		maxConns = connmgr.DefaultMaxConnsPerTorrent
+	}
+	torrent := p2p.Torrent{
+		Peers:        swarm,
+		PeerID:       peerID,
+		InfoHash:     t.InfoHash,
+		PieceHashes:  t.PieceHashes,
+		PieceRoots:   t.PieceRoots,
+		V2:           t.IsV2(),
+		PieceLength:  t.PieceLength,
+		Length:       t.Length,
+		Name:         t.Name,
+		StallTimeout: opts.StallTimeout,
+		IdleTimeout:  opts.IdleTimeout,
+		Reannounce: func(ctx context.Context) ([]peers.Peer, error) {
+			return t.fetchPeers(ctx, peerID, Port, eventNone, t.bytesLeft(completed))
+		},
+		Storage:         store,
+		Completed:       completed,
+		DownloadLimiter: opts.DownloadLimiter,
+		UploadLimiter:   opts.UploadLimiter,
+		Conns:           connmgr.Default.NewSwarm(maxConns),
+		Encryption:      opts.Encryption,
+		Listeners:       listeners,
+		WebSeeds:        t.webSeeds(),
+		Private:         t.Private,
+	}
+	downloadErr := torrent.Download(ctx)
+
+	// Whatever happened, make sure the pieces written so far survive
+	if err = store.Sync(); err != nil {
+		return err
+	}
+	event := eventCompleted
+	if downloadErr != nil {
+		event = eventStopped
+		if err = t.saveResume(path, completed); err != nil {
+			return err
+		}
+	} else if err = removeResume(path); err != nil {
+		return err
+	}
+
+	announceCtx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+	if _, err := t.fetchPeers(announceCtx, peerID, Port, event, t.bytesLeft(completed)); err != nil {
+		logger.Println("Final announce failed:", err)
+	}
+	return downloadErr
 }
+
+// bytesLeft returns how many bytes are still missing given the completed pieces
+func (t *TorrentFile) bytesLeft(completed *bitfield.Bitfield) int {
+	left := t.Length
+	for index, ok := completed.NextSet(0); ok; index, ok = completed.NextSet(index + 1) {
+		begin := index * t.PieceLength
+		end := min(begin+t.PieceLength, t.Length)
+		left -= end - begin
+	}
+	return left
+}
+
 func (info *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	hashLen := 20
 	if len(info.Pieces)%hashLen != 0 {
@@ -87,37 +282,114 @@ func (info *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 }
 
 func Open(path string) (TorrentFile, error) {
-	f, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer f.Close()
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(f, &bto)
-	if err != nil {
+	if err := unmarshalLenient(data, &bto); err != nil {
 		return TorrentFile{}, err
 	}
 	return bto.toTorrentFile()
 }
 
+// unmarshalLenient decodes a torrent, only logging keys whose values have an
+// unexpected type. Validation catches the ones we cannot do without.
+func unmarshalLenient(data []byte, v interface{}) error {
+	err := bencode.Unmarshal(data, v)
+	var typeErr *bencode.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		logger.Println("Ignoring torrent value:", err)
+		return nil
+	}
+	return err
+}
+
+// validPathElement rejects names that could escape the download directory
+func validPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// toTorrentFile converts the torrent, hashing the info dictionary as it was read
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	tf := TorrentFile{}
-	hash, err := bto.Info.Hash()
-	if err != nil {
+	tf := TorrentFile{MetaVersion: 1}
+	if len(bto.Info) == 0 {
+		return tf, fmt.Errorf("Torrent without an info dictionary")
+	}
+	info := bencodeInfo{}
+	if err := unmarshalLenient(bto.Info, &info); err != nil {
 		return tf, err
 	}
+	hash := sha1.Sum(bto.Info)
 	if bto.Announce == "" {
 		return tf, fmt.Errorf("Not able to find the Tracker URL")
 	}
 	tf.InfoHash = hash
+	tf.InfoBytes = bto.Info
 	tf.Announce = bto.Announce
-	tf.PieceLength = bto.Info.PieceLength
-	tf.Length = bto.Info.Length
-	tf.Name = bto.Info.Name
-	if piecesHash, err := bto.Info.splitPieceHashes(); err != nil {
+	tf.PieceLength = info.PieceLength
+	tf.Length = info.Length
+	tf.Name = info.Name
+	if !validPathElement(tf.Name) {
+		return tf, fmt.Errorf("Invalid torrent name %q", tf.Name)
+	}
+	if len(info.Files) > 0 {
+		tf.Length = 0
+		for _, f := range info.Files {
+			for _, element := range f.Path {
+				if !validPathElement(element) {
+					return tf, fmt.Errorf("Invalid file path %q", f.Path)
+				}
+			}
+			if len(f.Path) == 0 || f.Length < 0 {
+				return tf, fmt.Errorf("Invalid file entry %q", f.Path)
+			}
+			tf.Files = append(tf.Files, File{Length: f.Length, Path: f.Path, Padding: strings.Contains(f.Attr, "p")})
+			tf.Length += f.Length
+		}
+	}
+	switch urls := bto.URLList.(type) {
+	case string:
+		if urls != "" {
+			tf.WebSeeds = []string{urls}
+		}
+	case []interface{}:
+		for _, u := range urls {
+			if u, ok := u.(string); ok && u != "" {
+				tf.WebSeeds = append(tf.WebSeeds, u)
+			}
+		}
+	}
+	tf.HTTPSeeds = bto.HTTPSeeds
+	for _, tier := range bto.AnnounceList {
+		if len(tier) > 0 {
+			tf.AnnounceList = append(tf.AnnounceList, tier)
+		}
+	}
+	tf.Private = info.Private == 1
+	tf.Source = info.Source
+	tf.Comment = bto.Comment
+	tf.CreatedBy = bto.CreatedBy
+	if bto.CreationDate > 0 {
+		tf.CreationDate = time.Unix(bto.CreationDate, 0).UTC()
+	}
+	if piecesHash, err := info.splitPieceHashes(); err != nil {
 		return tf, err
-	} else {
+	} else if len(piecesHash) > 0 {
 		tf.PieceHashes = piecesHash
 	}
+
+	if info.MetaVersion == 2 {
+		tf.MetaVersion = 2
+		tf.InfoHashV2 = sha256.Sum256(bto.Info)
+		if tf.PieceHashes == nil {
+			tf.InfoHash = truncatedHash(tf.InfoHashV2)
+		}
+		if err := tf.parseV2(info.FileTree, bto.PieceLayers); err != nil {
+			return tf, err
+		}
+	} else if tf.PieceHashes == nil {
+		return tf, fmt.Errorf("Torrent has no pieces")
+	}
 	return tf, nil
 }
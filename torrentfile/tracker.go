@@ -1,22 +1,91 @@
 package torrentfile
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/Harry-kp/nebula/bencode"
 	"github.com/Harry-kp/nebula/peers"
-	"github.com/jackpal/bencode-go"
 )
 
-type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+// Tracker responses are small, these bounds keep a hostile tracker from making us buffer much
+const (
+	maxTrackerResponse = 1 << 20
+	maxTrackerDepth    = 8
+)
+
+// Announce events sent to the tracker, an empty event is a regular announce
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventStopped   = "stopped"
+	eventCompleted = "completed"
+)
+
+// TrackerResponse is the bencoded answer to an HTTP announce
+type TrackerResponse struct {
+	FailureReason  string `bencode:"failure reason,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"`
+	Interval       int    `bencode:"interval,omitempty"`
+	MinInterval    int    `bencode:"min interval,omitempty"`
+	// Complete and Incomplete count the seeders and leechers of the swarm
+	Complete   int `bencode:"complete,omitempty"`
+	Incomplete int `bencode:"incomplete,omitempty"`
+	// Peers is either a compact string of IPv4 peers or a list of TrackerPeer
+	// dictionaries. Peers6 holds compact IPv6 peers (BEP 7).
+	Peers  interface{} `bencode:"peers"`
+	Peers6 string      `bencode:"peers6,omitempty"`
+}
+
+// TrackerPeer is a peer in the dictionary model of a tracker response
+type TrackerPeer struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// PeerList returns the peers of the response, whichever model they are in
+func (r *TrackerResponse) PeerList() ([]peers.Peer, error) {
+	var list []peers.Peer
+	switch p := r.Peers.(type) {
+	case nil:
+	case string:
+		compact, err := peers.Unmarshal([]byte(p))
+		if err != nil {
+			return nil, err
+		}
+		list = compact
+	case []interface{}:
+		for _, entry := range p {
+			dict, ok := entry.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Invalid Peers Response")
+			}
+			host, _ := dict["ip"].(string)
+			port, _ := dict["port"].(int64)
+			ip := net.ParseIP(host)
+			if ip == nil || port <= 0 || port > 65535 {
+				// Trackers may hand out host names, we only dial addresses
+				continue
+			}
+			list = append(list, peers.Peer{IP: ip, Port: uint16(port)})
+		}
+	default:
+		return nil, fmt.Errorf("Invalid Peers Response")
+	}
+	compact6, err := peers.Unmarshal6([]byte(r.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	return append(list, compact6...), nil
 }
 
-func (tf *TorrentFile) createTrackerURL(peer_id [20]byte, port uint16) (string, error) {
+func (tf *TorrentFile) createTrackerURL(peer_id [20]byte, port uint16, event string, left int) (string, error) {
 	baseURL, err := url.Parse(tf.Announce)
 	if err != nil {
 		return "", err
@@ -28,19 +97,25 @@ func (tf *TorrentFile) createTrackerURL(peer_id [20]byte, port uint16) (string,
 	params.Add("info_hash", string(tf.InfoHash[:]))
 	params.Add("port", strconv.Itoa(int(port)))
 	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
+	params.Add("downloaded", strconv.Itoa(tf.Length-left))
 	params.Add("compact", "1")
-	params.Add("left", strconv.Itoa(tf.Length))
+	params.Add("left", strconv.Itoa(left))
+	if event != eventNone {
+		params.Add("event", event)
+	}
 	return fmt.Sprintf("%s?%s", baseURL, params.Encode()), nil
 }
-func (tf *TorrentFile) fetchPeers(peer_id [20]byte, port uint16) ([]peers.Peer, error) {
+
+// fetchPeers announces to the tracker with the given event and number of bytes
+// still left to download, and returns the peers it handed out
+func (tf *TorrentFile) fetchPeers(ctx context.Context, peer_id [20]byte, port uint16, event string, left int) ([]peers.Peer, error) {
 	if len(tf.Announce) < 7 {
 		return nil, fmt.Errorf("Invalid announce URL")
 	}
 
 	switch tf.Announce[:7] {
 	case "http://":
-		return tf.fetchPeersHttp(peer_id, port)
+		return tf.fetchPeersHttp(ctx, peer_id, port, event, left)
 	case "udp://":
 		return nil, fmt.Errorf("UDP tracker not supported yet.We are working on it")
 	default:
@@ -48,24 +123,36 @@ func (tf *TorrentFile) fetchPeers(peer_id [20]byte, port uint16) ([]peers.Peer,
 	}
 }
 
-func (tf *TorrentFile) fetchPeersHttp(peer_id [20]byte, port uint16) ([]peers.Peer, error) {
-	trackerURL, err := tf.createTrackerURL(peer_id, port)
+func (tf *TorrentFile) fetchPeersHttp(ctx context.Context, peer_id [20]byte, port uint16, event string, left int) ([]peers.Peer, error) {
+	trackerURL, err := tf.createTrackerURL(peer_id, port, event, left)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &http.Client{Timeout: 15 * time.Second}
-	response, err := client.Get(trackerURL)
+	response, err := client.Do(request)
 	if err != nil {
 		return nil, err
 	}
 
 	defer response.Body.Close()
 
-	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(response.Body, &trackerResp)
+	trackerResp := TrackerResponse{}
+	decoder := bencode.NewDecoder(response.Body)
+	decoder.MaxSize = maxTrackerResponse
+	decoder.MaxStringLength = maxTrackerResponse
+	decoder.MaxDepth = maxTrackerDepth
+	err = decoder.Decode(&trackerResp)
 	if err != nil {
 		return nil, err
 	}
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	if trackerResp.FailureReason != "" {
+		return nil, fmt.Errorf("Tracker refused the announce: %s", trackerResp.FailureReason)
+	}
+	return trackerResp.PeerList()
 }
@@ -0,0 +1,181 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15). Every request starts with the connection ID,
+// the action and a transaction ID, every response with the action and the
+// transaction ID. A connect request carries UDPProtocolID as its connection ID.
+const (
+	UDPProtocolID = 0x41727101980
+
+	UDPActionConnect  = 0
+	UDPActionAnnounce = 1
+	UDPActionScrape   = 2
+	UDPActionError    = 3
+)
+
+const (
+	// udpTimeout is how long the first attempt waits for an answer, every
+	// retransmission waits twice as long as the one before
+	udpTimeout = 15 * time.Second
+	udpRetries = 3
+	// udpMaxScrape is how many info hashes fit in one scrape packet
+	udpMaxScrape = 74
+	// udpMaxPacket bounds the responses we read
+	udpMaxPacket = 2048
+)
+
+// udpTracker talks to one UDP tracker over a connected socket
+type udpTracker struct {
+	conn         net.Conn
+	connectionID uint64
+}
+
+func dialUDPTracker(ctx context.Context, trackerURL string) (*udpTracker, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	tracker := &udpTracker{conn: conn}
+	if err := tracker.connect(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tracker, nil
+}
+
+func (t *udpTracker) Close() error {
+	return t.conn.Close()
+}
+
+func (t *udpTracker) connect(ctx context.Context) error {
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], UDPProtocolID)
+	response, err := t.roundTrip(ctx, UDPActionConnect, request)
+	if err != nil {
+		return err
+	}
+	if len(response) < 16 {
+		return fmt.Errorf("Short connect response from UDP tracker")
+	}
+	t.connectionID = binary.BigEndian.Uint64(response[8:16])
+	return nil
+}
+
+// scrape asks about up to udpMaxScrape torrents, the results come back in request order
+func (t *udpTracker) scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	request := make([]byte, 16, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint64(request[0:8], t.connectionID)
+	for _, hash := range infoHashes {
+		request = append(request, hash[:]...)
+	}
+	response, err := t.roundTrip(ctx, UDPActionScrape, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("Short scrape response from UDP tracker")
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		entry := response[8+12*i:]
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return results, nil
+}
+
+// roundTrip fills in the action and a fresh transaction ID at bytes 8 to 16 of
+// request, sends it and returns the matching response, retransmitting on timeouts
+func (t *udpTracker) roundTrip(ctx context.Context, action uint32, request []byte) ([]byte, error) {
+	var transactionID [4]byte
+	if _, err := rand.Read(transactionID[:]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(request[8:12], action)
+	copy(request[12:16], transactionID[:])
+
+	// Unblock the read below as soon as the context is done
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buf := make([]byte, udpMaxPacket)
+	for attempt := 0; attempt <= udpRetries; attempt++ {
+		if _, err := t.conn.Write(request); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(udpTimeout << attempt)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		t.conn.SetReadDeadline(deadline)
+		for {
+			n, err := t.conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n < 8 || [4]byte(buf[4:8]) != transactionID {
+				// Late answer to an earlier request or garbage, keep waiting
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[0:4]) {
+			case action:
+				return append([]byte(nil), buf[:n]...), nil
+			case UDPActionError:
+				return nil, fmt.Errorf("UDP tracker error: %s", buf[8:n])
+			default:
+				return nil, fmt.Errorf("Unexpected action in UDP tracker response")
+			}
+		}
+	}
+	return nil, fmt.Errorf("UDP tracker did not answer")
+}
+
+// scrapeUDP connects to the tracker and scrapes the torrents in batches that fit a packet
+func scrapeUDP(ctx context.Context, trackerURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	tracker, err := dialUDPTracker(ctx, trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+
+	results := make(map[[20]byte]ScrapeResult)
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), udpMaxScrape)]
+		infoHashes = infoHashes[len(batch):]
+		batchResults, err := tracker.scrape(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, hash := range batch {
+			results[hash] = batchResults[i]
+		}
+	}
+	return results, nil
+}
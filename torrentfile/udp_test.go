@@ -0,0 +1,102 @@
+package torrentfile
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers connects and scrapes, reporting the number of info
+// hashes of every scrape on batches. A torrent has as many seeders, completed
+// downloads and leechers as the first three bytes of its info hash say.
+func fakeUDPTracker(t *testing.T, batches chan<- int) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	const connectionID = 0x1122334455667788
+	go func() {
+		buf := make([]byte, udpMaxPacket)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := buf[:n]
+			response := make([]byte, 8, udpMaxPacket)
+			copy(response, request[8:16]) // action and transaction ID
+			switch binary.BigEndian.Uint32(request[8:12]) {
+			case UDPActionConnect:
+				if binary.BigEndian.Uint64(request[0:8]) != UDPProtocolID {
+					return
+				}
+				response = binary.BigEndian.AppendUint64(response, connectionID)
+			case UDPActionScrape:
+				if binary.BigEndian.Uint64(request[0:8]) != connectionID || (n-16)%20 != 0 {
+					return
+				}
+				batches <- (n - 16) / 20
+				for hash := request[16:]; len(hash) > 0; hash = hash[20:] {
+					response = binary.BigEndian.AppendUint32(response, uint32(hash[0]))
+					response = binary.BigEndian.AppendUint32(response, uint32(hash[1]))
+					response = binary.BigEndian.AppendUint32(response, uint32(hash[2]))
+				}
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestScrapeUDPBatches(t *testing.T) {
+	tests := []struct {
+		torrents int
+		batches  []int
+	}{
+		{1, []int{1}},
+		{udpMaxScrape, []int{udpMaxScrape}},
+		{udpMaxScrape + 1, []int{udpMaxScrape, 1}},
+		{200, []int{udpMaxScrape, udpMaxScrape, 200 - 2*udpMaxScrape}},
+	}
+	for _, test := range tests {
+		batches := make(chan int, len(test.batches)+1)
+		announce := fakeUDPTracker(t, batches)
+		infoHashes := make([][20]byte, test.torrents)
+		for i := range infoHashes {
+			infoHashes[i] = [20]byte{byte(i), byte(i / 2), byte(i / 3), 0xff, byte(i >> 8)}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		results, err := Scrape(ctx, announce, infoHashes)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every scrape was answered, so its batch is in the channel already
+		var got []int
+		for len(batches) > 0 {
+			got = append(got, <-batches)
+		}
+		if len(got) != len(test.batches) {
+			t.Fatalf("%d torrents: scraped in batches %v, want %v", test.torrents, got, test.batches)
+		}
+		for i := range got {
+			if got[i] != test.batches[i] {
+				t.Fatalf("%d torrents: scraped in batches %v, want %v", test.torrents, got, test.batches)
+			}
+		}
+		if len(results) != test.torrents {
+			t.Fatalf("%d torrents: got %d results", test.torrents, len(results))
+		}
+		for _, hash := range infoHashes {
+			want := ScrapeResult{Seeders: int(hash[0]), Completed: int(hash[1]), Leechers: int(hash[2])}
+			if results[hash] != want {
+				t.Fatalf("Torrent %x: got %+v, want %+v", hash, results[hash], want)
+			}
+		}
+	}
+}
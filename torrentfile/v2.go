@@ -0,0 +1,207 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/Harry-kp/nebula/merkle"
+)
+
+// v2File is a file from the v2 file tree
+type v2File struct {
+	path   []string
+	length int
+	root   merkle.Hash
+}
+
+// IsV2 reports whether the torrent carries BitTorrent v2 metadata, which
+// includes hybrid torrents
+func (t *TorrentFile) IsV2() bool {
+	return t.MetaVersion == 2
+}
+
+// IsHybrid reports whether the torrent can be downloaded from v1 and v2 swarms alike
+func (t *TorrentFile) IsHybrid() bool {
+	return t.IsV2() && t.PieceHashes != nil
+}
+
+// verifyPiece checks a piece against its v1 and v2 hashes, whichever the torrent has
+func (t *TorrentFile) verifyPiece(index int, data []byte) bool {
+	if t.PieceHashes != nil && sha1.Sum(data) != t.PieceHashes[index] {
+		return false
+	}
+	if t.PieceRoots != nil {
+		piece := t.PieceRoots[index]
+		// A hybrid piece whose layer is unknown is still covered by SHA-1
+		if piece.Known() || t.PieceHashes == nil {
+			return piece.Verify(data)
+		}
+	}
+	return true
+}
+
+// numPieces returns the number of pieces of either hash scheme
+func (t *TorrentFile) numPieces() int {
+	return max(len(t.PieceHashes), len(t.PieceRoots))
+}
+
+// parseV2 reads the BEP 52 file tree and piece layers. A pure v2 torrent is laid
+// out like a hybrid one, with virtual padding that aligns every file to a piece.
+func (t *TorrentFile) parseV2(tree map[string]interface{}, layers map[string]string) error {
+	if t.PieceLength < merkle.BlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("Invalid v2 piece length %d", t.PieceLength)
+	}
+	if tree == nil {
+		return fmt.Errorf("v2 torrent without a file tree")
+	}
+	var files []v2File
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Empty file tree")
+	}
+
+	var roots []merkle.Piece
+	for _, f := range files {
+		if f.length == 0 {
+			continue
+		}
+		numPieces := (f.length + t.PieceLength - 1) / t.PieceLength
+		var layer []merkle.Hash
+		if numPieces > 1 {
+			if raw, ok := layers[string(f.root[:])]; ok {
+				if len(raw) != numPieces*merkle.HashSize {
+					return fmt.Errorf("Piece layer of %q has %d bytes, expected %d", f.path, len(raw), numPieces*merkle.HashSize)
+				}
+				layer = make([]merkle.Hash, numPieces)
+				for i := range layer {
+					copy(layer[i][:], raw[i*merkle.HashSize:])
+				}
+				if merkle.FileRoot(layer, t.PieceLength) != f.root {
+					return fmt.Errorf("Piece layer of %q does not match its pieces root", f.path)
+				}
+			}
+		}
+		for i := 0; i < numPieces; i++ {
+			piece := merkle.Piece{
+				Width:      t.PieceLength / merkle.BlockSize,
+				Length:     min(t.PieceLength, f.length-i*t.PieceLength),
+				FileRoot:   f.root,
+				Index:      i,
+				FilePieces: numPieces,
+			}
+			if numPieces == 1 {
+				// A file of a single piece has no layer, its root is the piece's
+				piece.Root = f.root
+				piece.Width = merkle.NextPowerOfTwo((f.length + merkle.BlockSize - 1) / merkle.BlockSize)
+			} else if layer != nil {
+				piece.Root = layer[i]
+			}
+			roots = append(roots, piece)
+		}
+	}
+	t.PieceRoots = roots
+
+	if t.PieceHashes != nil {
+		return t.checkHybrid(files)
+	}
+	t.layoutV2(files)
+	return nil
+}
+
+// walkFileTree collects the files below node in bencode key order, which is the
+// order of the files in the torrent
+func walkFileTree(node map[string]interface{}, path []string, files *[]v2File) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid file tree entry %q", append(path, name))
+		}
+		if name == "" {
+			if len(path) == 0 {
+				return fmt.Errorf("File without a name in the file tree")
+			}
+			length, _ := child["length"].(int64)
+			if length < 0 {
+				return fmt.Errorf("Invalid length of %q", path)
+			}
+			f := v2File{path: append([]string(nil), path...), length: int(length)}
+			if length > 0 {
+				root, _ := child["pieces root"].(string)
+				if len(root) != merkle.HashSize {
+					return fmt.Errorf("Invalid pieces root of %q", path)
+				}
+				copy(f.root[:], root)
+			}
+			*files = append(*files, f)
+			continue
+		}
+		if !validPathElement(name) {
+			return fmt.Errorf("Invalid file path %q", append(path, name))
+		}
+		if err := walkFileTree(child, append(path, name), files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layoutV2 lays out the files of a pure v2 torrent with a padding file after
+// every file that does not end on a piece boundary
+func (t *TorrentFile) layoutV2(files []v2File) {
+	if len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == t.Name {
+		t.Length = files[0].length
+		return
+	}
+	t.Length = 0
+	for i, f := range files {
+		t.Files = append(t.Files, File{Length: f.length, Path: f.path})
+		t.Length += f.length
+		if tail := f.length % t.PieceLength; tail != 0 && i < len(files)-1 {
+			pad := t.PieceLength - tail
+			t.Files = append(t.Files, File{Length: pad, Path: []string{".pad", strconv.Itoa(pad)}, Padding: true})
+			t.Length += pad
+		}
+	}
+}
+
+// checkHybrid makes sure the v1 and v2 views of a hybrid torrent describe the same files
+func (t *TorrentFile) checkHybrid(files []v2File) error {
+	if len(t.PieceHashes) != len(t.PieceRoots) {
+		return fmt.Errorf("Hybrid torrent has %d v1 and %d v2 pieces", len(t.PieceHashes), len(t.PieceRoots))
+	}
+	v1 := t.Files
+	if v1 == nil {
+		v1 = []File{{Length: t.Length, Path: []string{t.Name}}}
+	}
+	i := 0
+	for _, f := range v1 {
+		if f.Padding {
+			continue
+		}
+		if i >= len(files) || files[i].length != f.Length || !slices.Equal(files[i].path, f.Path) {
+			return fmt.Errorf("Hybrid torrent file %q differs between v1 and v2", f.Path)
+		}
+		i++
+	}
+	if i != len(files) {
+		return fmt.Errorf("Hybrid torrent has %d v1 and %d v2 files", i, len(files))
+	}
+	return nil
+}
+
+// truncatedHash returns the v2 info hash cut to the 20 bytes used in handshakes and announces
+func truncatedHash(hash [32]byte) [20]byte {
+	var short [20]byte
+	copy(short[:], hash[:])
+	return short
+}
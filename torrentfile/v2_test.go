@@ -0,0 +1,113 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"github.com/Harry-kp/nebula/merkle"
+)
+
+const v2PieceLength = 2 * merkle.BlockSize
+
+// v2Entry returns the file tree entry of data, its pieces root and its piece layer as it goes in "piece layers"
+func v2Entry(data []byte) (map[string]interface{}, merkle.Hash, string) {
+	var layer []merkle.Hash
+	var raw []byte
+	for begin := 0; begin < len(data); begin += v2PieceLength {
+		root := merkle.DataRoot(data[begin:min(begin+v2PieceLength, len(data))], v2PieceLength/merkle.BlockSize)
+		layer = append(layer, root)
+		raw = append(raw, root[:]...)
+	}
+	root := merkle.FileRoot(layer, v2PieceLength)
+	if len(layer) == 1 {
+		root = merkle.DataRoot(data, merkle.NextPowerOfTwo((len(data)+merkle.BlockSize-1)/merkle.BlockSize))
+	}
+	entry := map[string]interface{}{"": map[string]interface{}{
+		"length":      int64(len(data)),
+		"pieces root": string(root[:]),
+	}}
+	return entry, root, string(raw)
+}
+
+func TestParseV2(t *testing.T) {
+	a, b := content(5*v2PieceLength+100, 11), content(merkle.BlockSize+1, 12)
+	entryA, rootA, layerA := v2Entry(a)
+	entryB, rootB, _ := v2Entry(b)
+	tree := map[string]interface{}{"dir": map[string]interface{}{"a.bin": entryA, "b.bin": entryB}}
+
+	tf := &TorrentFile{Name: "dir", PieceLength: v2PieceLength}
+	if err := tf.parseV2(tree, map[string]string{string(rootA[:]): layerA}); err != nil {
+		t.Fatal(err)
+	}
+	// Six pieces of a.bin, padding up to the next piece, then one of b.bin
+	if len(tf.PieceRoots) != 7 || tf.Length != 6*v2PieceLength+len(b) || len(tf.Files) != 3 || !tf.Files[1].Padding {
+		t.Fatalf("Got %d pieces, length %d and files %v", len(tf.PieceRoots), tf.Length, tf.Files)
+	}
+	for index, piece := range tf.PieceRoots {
+		begin := index * v2PieceLength
+		data := append([]byte(nil), a...)
+		if index == 6 {
+			begin, data = 0, b
+		}
+		buf := make([]byte, v2PieceLength)
+		copy(buf, data[begin:min(begin+v2PieceLength, len(data))])
+		if !piece.Verify(buf) {
+			t.Fatalf("Piece #%d does not verify against its own data", index)
+		}
+	}
+	if tf.PieceRoots[6].Root != rootB || tf.PieceRoots[0].FileRoot != rootA || tf.PieceRoots[5].Index != 5 {
+		t.Fatal("Pieces do not point back at their files")
+	}
+
+	// Without the piece layer the pieces of a.bin wait for their hashes
+	tf = &TorrentFile{Name: "dir", PieceLength: v2PieceLength}
+	if err := tf.parseV2(tree, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tf.PieceRoots[0].Known() || !tf.PieceRoots[6].Known() {
+		t.Fatal("Piece roots known without a piece layer, or unknown for a single piece file")
+	}
+}
+
+func TestParseV2Tampered(t *testing.T) {
+	a := content(3*v2PieceLength, 13)
+	entry, root, layer := v2Entry(a)
+	tree := map[string]interface{}{"a.bin": entry}
+	tampered := []byte(layer)
+	tampered[merkle.HashSize] ^= 1
+	tests := map[string]map[string]string{
+		"tampered layer": {string(root[:]): string(tampered)},
+		"short layer":    {string(root[:]): layer[:2*merkle.HashSize]},
+	}
+	for name, layers := range tests {
+		tf := &TorrentFile{Name: "a.bin", PieceLength: v2PieceLength}
+		if err := tf.parseV2(tree, layers); err == nil {
+			t.Errorf("%s: parseV2 took it", name)
+		}
+	}
+}
+
+func TestCheckHybrid(t *testing.T) {
+	a := content(3*v2PieceLength-5, 14)
+	entry, root, layer := v2Entry(a)
+	var hashes [][20]byte
+	for begin := 0; begin < len(a); begin += v2PieceLength {
+		hashes = append(hashes, sha1.Sum(a[begin:min(begin+v2PieceLength, len(a))]))
+	}
+	tree := map[string]interface{}{"a.bin": entry}
+	layers := map[string]string{string(root[:]): layer}
+
+	tf := &TorrentFile{Name: "a.bin", PieceLength: v2PieceLength, Length: len(a), PieceHashes: hashes}
+	if err := tf.parseV2(tree, layers); err != nil {
+		t.Fatal(err)
+	}
+	// The v1 side must describe the same file
+	tf = &TorrentFile{Name: "a.bin", PieceLength: v2PieceLength, Length: len(a) + 1, PieceHashes: hashes}
+	if err := tf.parseV2(tree, layers); err == nil {
+		t.Fatal("Hybrid torrent with different file lengths accepted")
+	}
+	tf = &TorrentFile{Name: "a.bin", PieceLength: v2PieceLength, Length: len(a), PieceHashes: hashes[:2]}
+	if err := tf.parseV2(tree, layers); err == nil {
+		t.Fatal("Hybrid torrent with different piece counts accepted")
+	}
+}
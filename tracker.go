@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/tracker"
+)
+
+// runTracker implements `nebula tracker`, serving announces and scrapes until interrupted
+func runTracker(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "Address to serve HTTP announces and scrapes on, empty to disable")
+	udpAddr := fs.String("udp", ":6969", "Address to serve UDP announces and scrapes on, empty to disable")
+	interval := fs.Duration("interval", tracker.DefaultInterval, "How often peers are asked to announce")
+	peerTimeout := fs.Duration("peer-timeout", 0, "Forget peers that have not announced for this long (default: three intervals)")
+	allowlist := fs.String("allowlist", "", "File with the hex info hashes to track, one per line (default: track every torrent)")
+	statePath := fs.String("state", "", "File to keep the swarms in across restarts (default: memory only)")
+	logEnabled := fs.Bool("log", false, "Enable logging")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nebula tracker [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || (*httpAddr == "" && *udpAddr == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	logger.Init(logger.Config{LogEnabled: *logEnabled})
+
+	cfg := tracker.Config{Interval: *interval, PeerTimeout: *peerTimeout, StatePath: *statePath}
+	if *allowlist != "" {
+		list, err := readAllowlist(*allowlist)
+		if err != nil {
+			fmt.Println("Error reading allowlist:", err)
+			os.Exit(1)
+		}
+		cfg.Allowlist = list
+	}
+	server, err := tracker.New(cfg)
+	if err != nil {
+		fmt.Println("Error starting tracker:", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *httpAddr != "" {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			fmt.Println("Error listening for HTTP:", err)
+			os.Exit(1)
+		}
+		httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+		go httpServer.Serve(l)
+		defer httpServer.Close()
+		fmt.Printf("Serving HTTP announces on http://%s/announce\n", l.Addr())
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			fmt.Println("Error listening for UDP:", err)
+			os.Exit(1)
+		}
+		go server.ServeUDP(conn)
+		defer conn.Close()
+		fmt.Printf("Serving UDP announces on udp://%s/announce\n", conn.LocalAddr())
+	}
+
+	if err := server.Run(ctx); err != nil {
+		fmt.Println("Error saving tracker state:", err)
+		os.Exit(1)
+	}
+}
+
+// readAllowlist reads hex info hashes, one per line. Blank lines and lines
+// starting with # are skipped.
+func readAllowlist(path string) (map[[20]byte]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := make(map[[20]byte]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(text)
+		if err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("Invalid info hash on line %d: %q", line, text)
+		}
+		list[[20]byte(raw)] = true
+	}
+	return list, scanner.Err()
+}
@@ -0,0 +1,140 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// ServeHTTP answers announces on any path ending in /announce and scrapes on
+// any path ending in /scrape
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "announce":
+		s.serveAnnounce(w, r)
+	case "scrape":
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req, err := parseAnnounce(query, r.RemoteAddr)
+	if err != nil {
+		writeBencode(w, torrentfile.TrackerResponse{FailureReason: err.Error()})
+		return
+	}
+	result, err := s.announce(req)
+	if err != nil {
+		writeBencode(w, torrentfile.TrackerResponse{FailureReason: err.Error()})
+		return
+	}
+
+	resp := torrentfile.TrackerResponse{
+		Interval:   int(s.cfg.Interval.Seconds()),
+		Complete:   result.Seeders,
+		Incomplete: result.Leechers,
+	}
+	if query.Get("compact") == "0" {
+		list := []torrentfile.TrackerPeer{}
+		for i, p := range result.Peers {
+			tp := torrentfile.TrackerPeer{IP: p.IP.String(), Port: int(p.Port)}
+			if query.Get("no_peer_id") != "1" {
+				tp.PeerID = result.PeerIDs[i]
+			}
+			list = append(list, tp)
+		}
+		resp.Peers = list
+	} else {
+		resp.Peers = string(peers.Marshal(result.Peers))
+		resp.Peers6 = string(peers.Marshal6(result.Peers))
+	}
+	writeBencode(w, resp)
+}
+
+// parseAnnounce reads the announce parameters, the peer's address is the one it connects from
+func parseAnnounce(query url.Values, remoteAddr string) (announceRequest, error) {
+	req := announceRequest{Event: query.Get("event"), NumWant: -1}
+	infoHash, peerID := query.Get("info_hash"), query.Get("peer_id")
+	if len(infoHash) != len(req.InfoHash) {
+		return req, fmt.Errorf("Invalid info_hash")
+	}
+	if len(peerID) != len(req.PeerID) {
+		return req, fmt.Errorf("Invalid peer_id")
+	}
+	copy(req.InfoHash[:], infoHash)
+	copy(req.PeerID[:], peerID)
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, fmt.Errorf("Invalid port")
+	}
+	req.Port = uint16(port)
+	if req.Left, err = strconv.ParseInt(query.Get("left"), 10, 64); err != nil || req.Left < 0 {
+		return req, fmt.Errorf("Invalid left")
+	}
+	if numWant := query.Get("numwant"); numWant != "" {
+		if req.NumWant, err = strconv.Atoi(numWant); err != nil {
+			return req, fmt.Errorf("Invalid numwant")
+		}
+	}
+	switch req.Event {
+	case eventNone, eventStarted, eventStopped, eventCompleted:
+	default:
+		return req, fmt.Errorf("Invalid event")
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return req, err
+	}
+	if req.IP = net.ParseIP(host); req.IP == nil {
+		return req, fmt.Errorf("Invalid peer address")
+	}
+	if ip4 := req.IP.To4(); ip4 != nil {
+		req.IP = ip4
+	}
+	return req, nil
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+	resp := torrentfile.ScrapeResponse{Files: make(map[string]torrentfile.ScrapeFile)}
+	if len(infoHashes) == 0 {
+		// A scrape without info hashes asks about every torrent
+		resp.Files = s.scrapeAll()
+	}
+	for _, key := range infoHashes {
+		var infoHash [20]byte
+		if len(key) != len(infoHash) {
+			writeBencode(w, torrentfile.ScrapeResponse{FailureReason: "Invalid info_hash"})
+			return
+		}
+		copy(infoHash[:], key)
+		if s.allowed(infoHash) {
+			resp.Files[key] = s.scrape(infoHash)
+		}
+	}
+	writeBencode(w, resp)
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		logger.Println("Error encoding tracker response:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// get sends a request to the tracker from remoteAddr and decodes the answer into v
+func get(t *testing.T, s *Server, target, remoteAddr string, v interface{}) {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("GET %s: status %d", target, w.Code)
+	}
+	if err := bencode.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %v", target, err)
+	}
+}
+
+// announceQuery is the query of an announce by peer n
+func announceQuery(infoHash [20]byte, n byte, left int64) url.Values {
+	id := peerID(n)
+	return url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {string(id[:])},
+		"port":      {strconv.Itoa(6880 + int(n))},
+		"left":      {strconv.FormatInt(left, 10)},
+	}
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	s := newServer(t, Config{})
+	infoHash := [20]byte{1, '&', '='}
+	var resp torrentfile.TrackerResponse
+	get(t, s, "/announce?"+announceQuery(infoHash, 1, 0).Encode(), "10.0.0.1:50000", &resp)
+	get(t, s, "/announce?"+announceQuery(infoHash, 2, 0).Encode(), "[2001:db8::2]:50000", &resp)
+
+	resp = torrentfile.TrackerResponse{}
+	get(t, s, "/tracker/announce?"+announceQuery(infoHash, 3, 10).Encode(), "10.0.0.3:50000", &resp)
+	if resp.FailureReason != "" {
+		t.Fatal(resp.FailureReason)
+	}
+	if resp.Interval != int(DefaultInterval.Seconds()) || resp.Complete != 2 || resp.Incomplete != 1 {
+		t.Fatalf("Got interval %d, %d seeders and %d leechers", resp.Interval, resp.Complete, resp.Incomplete)
+	}
+	// The address comes from the connection, the port from the query. IPv4
+	// peers go in peers, IPv6 peers in peers6.
+	compact, _ := resp.Peers.(string)
+	list, err := peers.Unmarshal([]byte(compact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].IP.Equal(net.IPv4(10, 0, 0, 1)) || list[0].Port != 6881 {
+		t.Fatalf("Compact peers = %v, want 10.0.0.1:6881", list)
+	}
+	list6, err := peers.Unmarshal6([]byte(resp.Peers6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list6) != 1 || !list6[0].IP.Equal(net.ParseIP("2001:db8::2")) || list6[0].Port != 6882 {
+		t.Fatalf("Compact IPv6 peers = %v, want [2001:db8::2]:6882", list6)
+	}
+}
+
+func TestHTTPAnnounceDict(t *testing.T) {
+	s := newServer(t, Config{})
+	infoHash := [20]byte{1}
+	var resp torrentfile.TrackerResponse
+	get(t, s, "/announce?"+announceQuery(infoHash, 1, 0).Encode(), "10.0.0.1:50000", &resp)
+
+	var dict struct {
+		Peers []torrentfile.TrackerPeer `bencode:"peers"`
+	}
+	query := announceQuery(infoHash, 2, 10)
+	query.Set("compact", "0")
+	get(t, s, "/announce?"+query.Encode(), "10.0.0.2:50000", &dict)
+	id := peerID(1)
+	want := torrentfile.TrackerPeer{PeerID: string(id[:]), IP: "10.0.0.1", Port: 6881}
+	if len(dict.Peers) != 1 || dict.Peers[0] != want {
+		t.Fatalf("Dictionary peers = %+v, want %+v", dict.Peers, want)
+	}
+
+	query.Set("no_peer_id", "1")
+	dict.Peers = nil
+	get(t, s, "/announce?"+query.Encode(), "10.0.0.2:50000", &dict)
+	want.PeerID = ""
+	if len(dict.Peers) != 1 || dict.Peers[0] != want {
+		t.Fatalf("Dictionary peers with no_peer_id = %+v, want %+v", dict.Peers, want)
+	}
+}
+
+func TestHTTPInvalidAnnounce(t *testing.T) {
+	s := newServer(t, Config{})
+	tests := []struct {
+		name, key, value string
+	}{
+		{"short info_hash", "info_hash", "abc"},
+		{"short peer_id", "peer_id", "abc"},
+		{"zero port", "port", "0"},
+		{"negative left", "left", "-1"},
+		{"unknown event", "event", "paused"},
+		{"bad numwant", "numwant", "many"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := announceQuery([20]byte{1}, 1, 0)
+			query.Set(tt.key, tt.value)
+			var resp torrentfile.TrackerResponse
+			get(t, s, "/announce?"+query.Encode(), "10.0.0.1:50000", &resp)
+			if resp.FailureReason == "" {
+				t.Fatal("Tracker took the announce")
+			}
+		})
+	}
+	if files := s.scrapeAll(); len(files) != 0 {
+		t.Fatalf("Invalid announces created %d swarms", len(files))
+	}
+}
+
+func TestHTTPAllowlist(t *testing.T) {
+	allowed, other := [20]byte{1}, [20]byte{2}
+	s := newServer(t, Config{Allowlist: map[[20]byte]bool{allowed: true}})
+	var resp torrentfile.TrackerResponse
+	get(t, s, "/announce?"+announceQuery(other, 1, 0).Encode(), "10.0.0.1:50000", &resp)
+	if resp.FailureReason != errNotAllowed.Error() {
+		t.Fatalf("Failure reason = %q, want %q", resp.FailureReason, errNotAllowed)
+	}
+	get(t, s, "/announce?"+announceQuery(allowed, 1, 0).Encode(), "10.0.0.1:50000", &resp)
+
+	// Scrapes leave out the torrents the tracker does not serve
+	var scrape torrentfile.ScrapeResponse
+	query := url.Values{"info_hash": {string(allowed[:]), string(other[:])}}
+	get(t, s, "/scrape?"+query.Encode(), "10.0.0.1:50000", &scrape)
+	if len(scrape.Files) != 1 || scrape.Files[string(allowed[:])].Complete != 1 {
+		t.Fatalf("Scrape = %+v, want only the allowed torrent with 1 seeder", scrape.Files)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	s := newServer(t, Config{})
+	a, b := [20]byte{1}, [20]byte{2}
+	var resp torrentfile.TrackerResponse
+	get(t, s, "/announce?"+announceQuery(a, 1, 10).Encode(), "10.0.0.1:50000", &resp)
+	get(t, s, "/announce?"+announceQuery(a, 1, 0).Encode(), "10.0.0.1:50000", &resp)
+	get(t, s, "/announce?"+announceQuery(a, 2, 10).Encode(), "10.0.0.2:50000", &resp)
+	get(t, s, "/announce?"+announceQuery(b, 2, 10).Encode(), "10.0.0.2:50000", &resp)
+
+	var scrape torrentfile.ScrapeResponse
+	get(t, s, "/scrape?"+url.Values{"info_hash": {string(a[:])}}.Encode(), "10.0.0.1:50000", &scrape)
+	want := torrentfile.ScrapeFile{Complete: 1, Downloaded: 1, Incomplete: 1}
+	if len(scrape.Files) != 1 || scrape.Files[string(a[:])] != want {
+		t.Fatalf("Scrape = %+v, want %+v", scrape.Files, want)
+	}
+	// Without an info hash the scrape covers every torrent
+	scrape = torrentfile.ScrapeResponse{}
+	get(t, s, "/scrape", "10.0.0.1:50000", &scrape)
+	if len(scrape.Files) != 2 || scrape.Files[string(b[:])].Incomplete != 1 {
+		t.Fatalf("Full scrape = %+v, want both torrents", scrape.Files)
+	}
+}
@@ -0,0 +1,290 @@
+// Package tracker is a small BitTorrent tracker serving announces and scrapes
+// over HTTP (BEP 3, 23, 48 and 7) and UDP (BEP 15)
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Harry-kp/nebula/bencode"
+	"github.com/Harry-kp/nebula/logger"
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+const (
+	// DefaultInterval is how often peers are asked to announce
+	DefaultInterval = 30 * time.Minute
+	// defaultNumWant is how many peers an announce gets when it does not ask for a number
+	defaultNumWant = 50
+	maxNumWant     = 200
+	// maintenanceInterval is how often stale peers are dropped and the state is saved
+	maintenanceInterval = time.Minute
+)
+
+// Announce events, an empty event is a regular announce
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventStopped   = "stopped"
+	eventCompleted = "completed"
+)
+
+var errNotAllowed = errors.New("Torrent not allowed on this tracker")
+
+// Config describes how a Server behaves
+type Config struct {
+	// Interval is how often peers are asked to announce, zero means DefaultInterval
+	Interval time.Duration
+	// PeerTimeout drops peers that have not announced for this long, zero means three intervals
+	PeerTimeout time.Duration
+	// Allowlist limits the tracker to these info hashes, nil allows every torrent
+	Allowlist map[[20]byte]bool
+	// StatePath keeps the swarms in a file across restarts, empty keeps them in memory only
+	StatePath string
+}
+
+// peer is a member of a swarm, bencoded into the state file
+type peer struct {
+	IP       net.IP `bencode:"ip"`
+	Port     uint16 `bencode:"port"`
+	Left     int64  `bencode:"left"`
+	LastSeen int64  `bencode:"last seen"`
+}
+
+// swarm holds the peers of one torrent keyed by their peer ID
+type swarm struct {
+	Peers     map[string]*peer `bencode:"peers"`
+	Completed int              `bencode:"completed"`
+}
+
+// counts returns the number of seeders and leechers
+func (sw *swarm) counts() (seeders, leechers int) {
+	for _, p := range sw.Peers {
+		if p.Left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// Server keeps the swarms of every torrent announced to it. It is an
+// http.Handler and serves UDP with ServeUDP.
+type Server struct {
+	cfg Config
+	// secret makes UDP connection IDs unguessable
+	secret [16]byte
+
+	mu sync.Mutex
+	// swarms are keyed by the raw info hash
+	swarms map[string]*swarm
+}
+
+// announceRequest is an announce in either protocol
+type announceRequest struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	IP       net.IP
+	Port     uint16
+	Left     int64
+	Event    string
+	// NumWant is the number of peers asked for, negative for the default
+	NumWant int
+}
+
+// announceResult is the answer to an announce
+type announceResult struct {
+	Peers    []peers.Peer
+	PeerIDs  []string
+	Seeders  int
+	Leechers int
+}
+
+// New returns a tracker, loading its swarms from cfg.StatePath if that exists
+func New(cfg Config) (*Server, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.PeerTimeout <= 0 {
+		cfg.PeerTimeout = 3 * cfg.Interval
+	}
+	s := &Server{cfg: cfg, swarms: make(map[string]*swarm)}
+	if _, err := rand.Read(s.secret[:]); err != nil {
+		return nil, err
+	}
+	if cfg.StatePath != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) allowed(infoHash [20]byte) bool {
+	return s.cfg.Allowlist == nil || s.cfg.Allowlist[infoHash]
+}
+
+// announce records the peer and picks other peers of the swarm for it. Seeders
+// only get leechers, they have no use for other seeders.
+func (s *Server) announce(req announceRequest) (announceResult, error) {
+	if !s.allowed(req.InfoHash) {
+		return announceResult{}, errNotAllowed
+	}
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(req.InfoHash[:])
+	sw, ok := s.swarms[key]
+	if !ok {
+		sw = &swarm{Peers: make(map[string]*peer)}
+		s.swarms[key] = sw
+	}
+	id := string(req.PeerID[:])
+	switch req.Event {
+	case eventStopped:
+		delete(sw.Peers, id)
+		numWant = 0
+	default:
+		// A download counts once, when a peer we saw leeching has nothing left.
+		// Repeated completed events and peers that show up done do not count.
+		if known, ok := sw.Peers[id]; ok && known.Left > 0 && req.Left == 0 {
+			sw.Completed++
+		}
+		sw.Peers[id] = &peer{IP: req.IP, Port: req.Port, Left: req.Left, LastSeen: time.Now().Unix()}
+	}
+
+	var result announceResult
+	result.Seeders, result.Leechers = sw.counts()
+	// Map iteration order is random, which spreads the peers handed out
+	for otherID, p := range sw.Peers {
+		if len(result.Peers) >= numWant {
+			break
+		}
+		if otherID == id || (req.Left == 0 && p.Left == 0) {
+			continue
+		}
+		result.Peers = append(result.Peers, peers.Peer{IP: p.IP, Port: p.Port})
+		result.PeerIDs = append(result.PeerIDs, otherID)
+	}
+	if len(sw.Peers) == 0 && sw.Completed == 0 {
+		delete(s.swarms, key)
+	}
+	return result, nil
+}
+
+// scrape reports on one torrent, unknown torrents have empty counts
+func (s *Server) scrape(infoHash [20]byte) torrentfile.ScrapeFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[string(infoHash[:])]
+	if !ok {
+		return torrentfile.ScrapeFile{}
+	}
+	seeders, leechers := sw.counts()
+	return torrentfile.ScrapeFile{Complete: seeders, Downloaded: sw.Completed, Incomplete: leechers}
+}
+
+// scrapeAll reports on every torrent the tracker knows
+func (s *Server) scrapeAll() map[string]torrentfile.ScrapeFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]torrentfile.ScrapeFile, len(s.swarms))
+	for key, sw := range s.swarms {
+		seeders, leechers := sw.counts()
+		files[key] = torrentfile.ScrapeFile{Complete: seeders, Downloaded: sw.Completed, Incomplete: leechers}
+	}
+	return files
+}
+
+// Expire drops the peers that stopped announcing. Swarms nobody completed are
+// forgotten once empty, the others keep their download count.
+func (s *Server) Expire() {
+	cutoff := time.Now().Add(-s.cfg.PeerTimeout).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sw := range s.swarms {
+		for id, p := range sw.Peers {
+			if p.LastSeen < cutoff {
+				delete(sw.Peers, id)
+			}
+		}
+		if len(sw.Peers) == 0 && sw.Completed == 0 {
+			delete(s.swarms, key)
+		}
+	}
+}
+
+// Run expires peers and saves the state periodically until ctx is done, then
+// saves the state one last time
+func (s *Server) Run(ctx context.Context) error {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return s.Save()
+		case <-ticker.C:
+			s.Expire()
+			if err := s.Save(); err != nil {
+				logger.Println("Error saving tracker state:", err)
+			}
+		}
+	}
+}
+
+// Save writes the swarms to the state file, if the tracker has one
+func (s *Server) Save() error {
+	if s.cfg.StatePath == "" {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := bencode.Marshal(s.swarms)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write next to the state and rename, so a crash never leaves half a file
+	tmp := s.cfg.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cfg.StatePath)
+}
+
+func (s *Server) load() error {
+	data, err := os.ReadFile(s.cfg.StatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	swarms := make(map[string]*swarm)
+	if err := bencode.Unmarshal(data, &swarms); err != nil {
+		return err
+	}
+	for key, sw := range swarms {
+		if len(key) != 20 || sw == nil {
+			delete(swarms, key)
+			continue
+		}
+		if sw.Peers == nil {
+			sw.Peers = make(map[string]*peer)
+		}
+	}
+	s.swarms = swarms
+	return nil
+}
@@ -0,0 +1,196 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// newServer returns a tracker for tests, failing the test if it cannot start
+func newServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// peerID is the ID of test peer n
+func peerID(n byte) [20]byte {
+	return [20]byte{'-', 'T', 'T', n}
+}
+
+// request builds an announce of peer n, peers listen on 10.0.0.n:6881
+func request(infoHash [20]byte, n byte, left int64, event string) announceRequest {
+	return announceRequest{
+		InfoHash: infoHash,
+		PeerID:   peerID(n),
+		IP:       net.IPv4(10, 0, 0, n).To4(),
+		Port:     6881,
+		Left:     left,
+		Event:    event,
+		NumWant:  -1,
+	}
+}
+
+func mustAnnounce(t *testing.T, s *Server, req announceRequest) announceResult {
+	t.Helper()
+	result, err := s.announce(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestAnnounce(t *testing.T) {
+	s := newServer(t, Config{})
+	infoHash := [20]byte{1}
+	mustAnnounce(t, s, request(infoHash, 1, 0, eventStarted))
+	mustAnnounce(t, s, request(infoHash, 2, 0, eventStarted))
+	mustAnnounce(t, s, request(infoHash, 3, 100, eventStarted))
+
+	// A leecher gets every other peer, a seeder only the leechers
+	result := mustAnnounce(t, s, request(infoHash, 4, 100, eventStarted))
+	if len(result.Peers) != 3 || result.Seeders != 2 || result.Leechers != 2 {
+		t.Fatalf("Leecher got %d peers, %d seeders and %d leechers, want 3, 2 and 2",
+			len(result.Peers), result.Seeders, result.Leechers)
+	}
+	result = mustAnnounce(t, s, request(infoHash, 1, 0, eventNone))
+	if len(result.Peers) != 2 {
+		t.Fatalf("Seeder got %d peers, want the 2 leechers", len(result.Peers))
+	}
+	for _, p := range result.Peers {
+		if p.IP.Equal(net.IPv4(10, 0, 0, 2)) {
+			t.Fatal("Seeder got another seeder")
+		}
+	}
+	req := request(infoHash, 4, 100, eventNone)
+	req.NumWant = 1
+	if result = mustAnnounce(t, s, req); len(result.Peers) != 1 {
+		t.Fatalf("Asked for 1 peer, got %d", len(result.Peers))
+	}
+
+	// A stopped peer leaves the swarm and gets no peers
+	if result = mustAnnounce(t, s, request(infoHash, 3, 100, eventStopped)); len(result.Peers) != 0 {
+		t.Fatalf("Stopped peer got %d peers", len(result.Peers))
+	}
+	if file := s.scrape(infoHash); file.Complete != 2 || file.Incomplete != 1 {
+		t.Fatalf("Scrape = %+v, want 2 seeders and 1 leecher", file)
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	s := newServer(t, Config{})
+	infoHash := [20]byte{1}
+	steps := []struct {
+		req  announceRequest
+		want int
+	}{
+		// A peer that shows up done did not download from the swarm
+		{request(infoHash, 1, 0, eventCompleted), 0},
+		{request(infoHash, 2, 100, eventStarted), 0},
+		{request(infoHash, 2, 40, eventNone), 0},
+		{request(infoHash, 2, 0, eventCompleted), 1},
+		// Repeating the event does not count the download again
+		{request(infoHash, 2, 0, eventCompleted), 1},
+		{request(infoHash, 2, 0, eventNone), 1},
+		// Neither does a completed event while pieces are still missing
+		{request(infoHash, 3, 100, eventStarted), 1},
+		{request(infoHash, 3, 50, eventCompleted), 1},
+		// A regular announce with nothing left finishes the download all the same
+		{request(infoHash, 3, 0, eventNone), 2},
+	}
+	for i, step := range steps {
+		mustAnnounce(t, s, step.req)
+		if got := s.scrape(infoHash).Downloaded; got != step.want {
+			t.Fatalf("Step %d: downloaded = %d, want %d", i, got, step.want)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	allowed, other := [20]byte{1}, [20]byte{2}
+	s := newServer(t, Config{Allowlist: map[[20]byte]bool{allowed: true}})
+	if _, err := s.announce(request(other, 1, 0, eventStarted)); !errors.Is(err, errNotAllowed) {
+		t.Fatalf("Announce of an unlisted torrent = %v, want %v", err, errNotAllowed)
+	}
+	mustAnnounce(t, s, request(allowed, 1, 0, eventStarted))
+	if files := s.scrapeAll(); len(files) != 1 {
+		t.Fatalf("Tracker knows %d torrents, want 1", len(files))
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := newServer(t, Config{PeerTimeout: time.Minute})
+	done, abandoned := [20]byte{1}, [20]byte{2}
+	mustAnnounce(t, s, request(done, 1, 100, eventStarted))
+	mustAnnounce(t, s, request(done, 1, 0, eventCompleted))
+	mustAnnounce(t, s, request(done, 2, 100, eventStarted))
+	mustAnnounce(t, s, request(abandoned, 3, 100, eventStarted))
+
+	// Age every peer but 2 past the timeout
+	s.mu.Lock()
+	for _, sw := range s.swarms {
+		for id, p := range sw.Peers {
+			if id[3] != 2 {
+				p.LastSeen -= int64((2 * time.Minute).Seconds())
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	s.Expire()
+	if file := s.scrape(done); file.Complete != 0 || file.Incomplete != 1 || file.Downloaded != 1 {
+		t.Fatalf("Scrape after expiry = %+v, want 1 leecher and 1 download", file)
+	}
+	// The swarm nobody completed is forgotten once empty
+	if files := s.scrapeAll(); len(files) != 1 {
+		t.Fatalf("Tracker knows %d torrents after expiry, want 1", len(files))
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	cfg := Config{StatePath: filepath.Join(t.TempDir(), "tracker.state")}
+	s := newServer(t, cfg)
+	infoHash := [20]byte{1}
+	mustAnnounce(t, s, request(infoHash, 1, 100, eventStarted))
+	mustAnnounce(t, s, request(infoHash, 1, 0, eventCompleted))
+	mustAnnounce(t, s, request(infoHash, 2, 100, eventStarted))
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newServer(t, cfg)
+	want := torrentfile.ScrapeFile{Complete: 1, Downloaded: 1, Incomplete: 1}
+	if file := loaded.scrape(infoHash); file != want {
+		t.Fatalf("Scrape after reload = %+v, want %+v", file, want)
+	}
+	// Peers survive with their addresses, and known peers keep their progress
+	result := mustAnnounce(t, loaded, request(infoHash, 2, 0, eventCompleted))
+	if len(result.Peers) != 0 {
+		t.Fatalf("Seeder got %d peers from a swarm of seeders", len(result.Peers))
+	}
+	if file := loaded.scrape(infoHash); file.Downloaded != 2 {
+		t.Fatalf("Downloaded = %d after a reloaded leecher completed, want 2", file.Downloaded)
+	}
+	result = mustAnnounce(t, loaded, request(infoHash, 3, 100, eventStarted))
+	if len(result.Peers) != 2 {
+		t.Fatalf("Leecher got %d peers after reload, want 2", len(result.Peers))
+	}
+	for _, p := range result.Peers {
+		if p.Port != 6881 || p.IP.To4() == nil {
+			t.Fatalf("Reloaded peer %v lost its address", p)
+		}
+	}
+
+	// No state file yet is an empty tracker
+	fresh := newServer(t, Config{StatePath: filepath.Join(t.TempDir(), "missing")})
+	if files := fresh.scrapeAll(); len(files) != 0 {
+		t.Fatalf("Fresh tracker knows %d torrents", len(files))
+	}
+}
@@ -0,0 +1,139 @@
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+const (
+	// connectionIDLifetime is how long a UDP connection ID stays valid, clients
+	// use one for a minute and the previous one is still accepted
+	connectionIDLifetime = time.Minute
+	udpAnnounceLength    = 98
+	udpMaxScrape         = 74
+)
+
+// UDP announce events by number
+var udpEvents = []string{eventNone, eventCompleted, eventStarted, eventStopped}
+
+// ServeUDP answers UDP tracker requests on conn until reading from it fails,
+// e.g. because it was closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if response := s.handleUDP(buf[:n], addr); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// connectionID derives the connection ID of addr for a time slot, so the
+// tracker does not have to remember which IDs it handed out
+func (s *Server) connectionID(addr net.Addr, slot int64) uint64 {
+	h := sha256.New()
+	h.Write(s.secret[:])
+	h.Write([]byte(addr.String()))
+	binary.Write(h, binary.BigEndian, slot)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (s *Server) validConnectionID(addr net.Addr, id uint64) bool {
+	slot := time.Now().UnixNano() / int64(connectionIDLifetime)
+	return id == s.connectionID(addr, slot) || id == s.connectionID(addr, slot-1)
+}
+
+// handleUDP returns the response to one request, nil for packets that get none
+func (s *Server) handleUDP(packet []byte, addr net.Addr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, transactionID...)
+
+	if action == torrentfile.UDPActionConnect {
+		if connectionID != torrentfile.UDPProtocolID {
+			return nil
+		}
+		slot := time.Now().UnixNano() / int64(connectionIDLifetime)
+		return binary.BigEndian.AppendUint64(response, s.connectionID(addr, slot))
+	}
+	if !s.validConnectionID(addr, connectionID) {
+		return udpError(transactionID, "Invalid connection ID")
+	}
+
+	switch action {
+	case torrentfile.UDPActionAnnounce:
+		if len(packet) < udpAnnounceLength {
+			return udpError(transactionID, "Short announce")
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return nil
+		}
+		event := binary.BigEndian.Uint32(packet[80:84])
+		if event >= uint32(len(udpEvents)) {
+			return udpError(transactionID, "Invalid event")
+		}
+		req := announceRequest{
+			IP:      udpAddr.IP,
+			Left:    int64(binary.BigEndian.Uint64(packet[64:72])),
+			Event:   udpEvents[event],
+			NumWant: int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+			Port:    binary.BigEndian.Uint16(packet[96:98]),
+		}
+		copy(req.InfoHash[:], packet[16:36])
+		copy(req.PeerID[:], packet[36:56])
+		if ip4 := req.IP.To4(); ip4 != nil {
+			req.IP = ip4
+		}
+		result, err := s.announce(req)
+		if err != nil {
+			return udpError(transactionID, err.Error())
+		}
+		response = binary.BigEndian.AppendUint32(response, uint32(s.cfg.Interval.Seconds()))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Leechers))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Seeders))
+		// Peers come in the address family the request came in
+		if req.IP.To4() != nil {
+			return append(response, peers.Marshal(result.Peers)...)
+		}
+		return append(response, peers.Marshal6(result.Peers)...)
+
+	case torrentfile.UDPActionScrape:
+		hashes := packet[16:]
+		if len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrape {
+			return udpError(transactionID, "Invalid scrape")
+		}
+		for ; len(hashes) > 0; hashes = hashes[20:] {
+			var file torrentfile.ScrapeFile
+			if infoHash := [20]byte(hashes[:20]); s.allowed(infoHash) {
+				file = s.scrape(infoHash)
+			}
+			response = binary.BigEndian.AppendUint32(response, uint32(file.Complete))
+			response = binary.BigEndian.AppendUint32(response, uint32(file.Downloaded))
+			response = binary.BigEndian.AppendUint32(response, uint32(file.Incomplete))
+		}
+		return response
+
+	default:
+		return udpError(transactionID, "Unknown action")
+	}
+}
+
+func udpError(transactionID []byte, message string) []byte {
+	response := binary.BigEndian.AppendUint32(nil, torrentfile.UDPActionError)
+	response = append(response, transactionID...)
+	return append(response, message...)
+}
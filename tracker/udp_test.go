@@ -0,0 +1,164 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Harry-kp/nebula/peers"
+	"github.com/Harry-kp/nebula/torrentfile"
+)
+
+// serveUDP runs the tracker on a local UDP port and returns a client socket
+// talking to it
+func serveUDP(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go s.ServeUDP(server)
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// udpRequest builds a request header followed by body
+func udpRequest(connectionID uint64, action, transactionID uint32, body []byte) []byte {
+	packet := binary.BigEndian.AppendUint64(nil, connectionID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = binary.BigEndian.AppendUint32(packet, transactionID)
+	return append(packet, body...)
+}
+
+// roundTrip sends a request and returns the response after checking its action
+// and transaction ID
+func roundTrip(t *testing.T, conn net.Conn, request []byte, action uint32) []byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := buf[:n]
+	if len(response) < 8 || !bytes.Equal(response[4:8], request[12:16]) {
+		t.Fatalf("Response %x does not answer transaction %x", response, request[12:16])
+	}
+	if got := binary.BigEndian.Uint32(response[0:4]); got != action {
+		t.Fatalf("Response action %d (%q), want %d", got, response[8:], action)
+	}
+	return response[8:]
+}
+
+func udpConnect(t *testing.T, conn net.Conn) uint64 {
+	t.Helper()
+	request := udpRequest(torrentfile.UDPProtocolID, torrentfile.UDPActionConnect, 1, nil)
+	response := roundTrip(t, conn, request, torrentfile.UDPActionConnect)
+	if len(response) != 8 {
+		t.Fatalf("Connect response of %d bytes", len(response))
+	}
+	return binary.BigEndian.Uint64(response)
+}
+
+// udpAnnounce builds the body of an announce by peer n, event is the BEP 15 number
+func udpAnnounce(infoHash [20]byte, n byte, left uint64, event uint32) []byte {
+	id := peerID(n)
+	body := append(infoHash[:], id[:]...)
+	body = binary.BigEndian.AppendUint64(body, 0) // downloaded
+	body = binary.BigEndian.AppendUint64(body, left)
+	body = binary.BigEndian.AppendUint64(body, 0) // uploaded
+	body = binary.BigEndian.AppendUint32(body, event)
+	body = binary.BigEndian.AppendUint32(body, 0)          // IP address
+	body = binary.BigEndian.AppendUint32(body, 0)          // key
+	body = binary.BigEndian.AppendUint32(body, 0xffffffff) // num_want -1
+	return binary.BigEndian.AppendUint16(body, 6880+uint16(n))
+}
+
+func TestUDP(t *testing.T) {
+	s := newServer(t, Config{})
+	conn := serveUDP(t, s)
+	infoHash, unknown := [20]byte{1}, [20]byte{2}
+	// Another peer is already in the swarm
+	mustAnnounce(t, s, request(infoHash, 1, 0, eventStarted))
+
+	id := udpConnect(t, conn)
+	response := roundTrip(t, conn, udpRequest(id, torrentfile.UDPActionAnnounce, 2, udpAnnounce(infoHash, 2, 100, 2)), torrentfile.UDPActionAnnounce)
+	if len(response) < 12 {
+		t.Fatalf("Announce response of %d bytes", len(response))
+	}
+	interval := binary.BigEndian.Uint32(response[0:4])
+	leechers := binary.BigEndian.Uint32(response[4:8])
+	seeders := binary.BigEndian.Uint32(response[8:12])
+	if interval != uint32(DefaultInterval.Seconds()) || leechers != 1 || seeders != 1 {
+		t.Fatalf("Got interval %d, %d leechers and %d seeders", interval, leechers, seeders)
+	}
+	list, err := peers.Unmarshal(response[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].IP.Equal(net.IPv4(10, 0, 0, 1)) || list[0].Port != 6881 {
+		t.Fatalf("Peers = %v, want 10.0.0.1:6881", list)
+	}
+
+	// The peer is recorded with the address it sent from
+	roundTrip(t, conn, udpRequest(id, torrentfile.UDPActionAnnounce, 3, udpAnnounce(infoHash, 2, 0, 1)), torrentfile.UDPActionAnnounce)
+	result := mustAnnounce(t, s, request(infoHash, 3, 100, eventStarted))
+	found := false
+	for _, p := range result.Peers {
+		found = found || (p.IP.Equal(net.IPv4(127, 0, 0, 1)) && p.Port == 6882)
+	}
+	if !found {
+		t.Fatalf("Peers = %v, want 127.0.0.1:6882 among them", result.Peers)
+	}
+
+	body := append(append([]byte(nil), infoHash[:]...), unknown[:]...)
+	response = roundTrip(t, conn, udpRequest(id, torrentfile.UDPActionScrape, 4, body), torrentfile.UDPActionScrape)
+	want := []uint32{2, 1, 1, 0, 0, 0} // seeders, completed, leechers of each torrent
+	if len(response) != 4*len(want) {
+		t.Fatalf("Scrape response of %d bytes, want %d", len(response), 4*len(want))
+	}
+	for i, w := range want {
+		if got := binary.BigEndian.Uint32(response[4*i:]); got != w {
+			t.Fatalf("Scrape field %d = %d, want %d", i, got, w)
+		}
+	}
+}
+
+func TestUDPErrors(t *testing.T) {
+	infoHash := [20]byte{1}
+	s := newServer(t, Config{Allowlist: map[[20]byte]bool{infoHash: true}})
+	conn := serveUDP(t, s)
+	id := udpConnect(t, conn)
+
+	tests := []struct {
+		name    string
+		request []byte
+	}{
+		{"unknown connection ID", udpRequest(id+1, torrentfile.UDPActionAnnounce, 1, udpAnnounce(infoHash, 1, 0, 0))},
+		{"short announce", udpRequest(id, torrentfile.UDPActionAnnounce, 2, udpAnnounce(infoHash, 1, 0, 0)[:60])},
+		{"unknown event", udpRequest(id, torrentfile.UDPActionAnnounce, 3, udpAnnounce(infoHash, 1, 0, 4))},
+		{"unlisted torrent", udpRequest(id, torrentfile.UDPActionAnnounce, 4, udpAnnounce([20]byte{2}, 1, 0, 0))},
+		{"partial info hash", udpRequest(id, torrentfile.UDPActionScrape, 5, infoHash[:10])},
+		{"unknown action", udpRequest(id, 9, 6, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if message := roundTrip(t, conn, tt.request, torrentfile.UDPActionError); len(message) == 0 {
+				t.Fatal("Error without a message")
+			}
+		})
+	}
+	if files := s.scrapeAll(); len(files) != 0 {
+		t.Fatalf("Rejected announces created %d swarms", len(files))
+	}
+}
@@ -0,0 +1,638 @@
+package utp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// PayloadSize keeps packets below common path MTUs
+	payloadSize = 1200
+	// RecvBufferSize is the receive window we advertise
+	recvBufferSize = 1 << 20
+	// SendBufferSize is how much unsent data Write queues before blocking
+	sendBufferSize = 1 << 20
+	// MaxOutOfOrder bounds the packets kept ahead of a hole
+	maxOutOfOrder = 1024
+
+	// Target is the queuing delay LEDBAT aims for
+	target = 100 * time.Millisecond
+	// MaxWindowIncrease is the most the congestion window grows per round trip
+	maxWindowIncrease = 3000
+	minWindow         = 2 * payloadSize
+	initialWindow     = 4 * payloadSize
+
+	minRTO         = 500 * time.Millisecond
+	initialRTO     = time.Second
+	maxRTO         = 30 * time.Second
+	maxRetransmits = 8
+	synRetries     = 3
+	// FinTimeout bounds how long a closed connection waits for its FIN to be acknowledged
+	finTimeout = 10 * time.Second
+	// TickInterval is how often timeouts are checked
+	tickInterval = 50 * time.Millisecond
+	// BaseDelayWindow is how long a minimum delay sample is remembered
+	baseDelayWindow = 2 * time.Minute
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+type outPacket struct {
+	typ           uint8
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool
+	// skipped counts later packets acknowledged while this one was not
+	skipped int
+}
+
+type delaySample struct {
+	at    time.Time
+	delay uint32
+}
+
+// Conn is a uTP connection with net.Conn semantics
+type Conn struct {
+	s      *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu          sync.Mutex
+	state       int
+	err         error
+	established chan struct{}
+	readable    chan struct{}
+	writable    chan struct{}
+	done        chan struct{}
+	// closed is closed by Close, waking every blocked Read and Write
+	closed chan struct{}
+
+	seqNr uint16 // next sequence number to send
+	ackNr uint16 // last sequence number received in order
+
+	readBuf  []byte
+	ooo      map[uint16]*header
+	oooData  map[uint16][]byte
+	gotFin   bool
+	finSeqNr uint16
+	eof      bool
+
+	sendBuf    []byte
+	inflight   []*outPacket
+	flight     int     // bytes in flight
+	window     float64 // congestion window in bytes
+	peerWindow uint32
+	closing    bool
+	finSent    bool
+	finSentAt  time.Time
+
+	rtt, rttVar, rto time.Duration
+	replyMicros      uint32
+	lastAck          uint16
+	dupAcks          int
+	timeouts         int
+	baseDelays       []delaySample
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:           s,
+		remote:      remote,
+		recvID:      recvID,
+		sendID:      sendID,
+		established: make(chan struct{}),
+		readable:    make(chan struct{}, 1),
+		writable:    make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		closed:      make(chan struct{}),
+		ooo:         make(map[uint16]*header),
+		oooData:     make(map[uint16][]byte),
+		window:      initialWindow,
+		peerWindow:  recvBufferSize,
+		rto:         initialRTO,
+	}
+	go c.tick()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// header builds the header of an outgoing packet, the caller holds mu
+func (c *Conn) header(typ uint8, seqNr uint16) *header {
+	buffered := len(c.readBuf)
+	for _, data := range c.oooData {
+		buffered += len(data)
+	}
+	return &header{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: nowMicros(),
+		tsDiff:    c.replyMicros,
+		wndSize:   uint32(max(recvBufferSize-buffered, 0)),
+		seqNr:     seqNr,
+		ackNr:     c.ackNr,
+	}
+}
+
+func (c *Conn) sendSyn() {
+	h := c.header(stSyn, c.seqNr)
+	h.connID = c.recvID
+	c.inflight = append(c.inflight, &outPacket{typ: stSyn, seqNr: c.seqNr, sentAt: time.Now(), transmissions: 1})
+	c.seqNr++
+	c.s.send(h, nil, c.remote)
+}
+
+// sendAck acknowledges what we received, with a selective ack for packets past a hole
+func (c *Conn) sendAck() {
+	h := c.header(stState, c.seqNr)
+	if len(c.ooo) > 0 {
+		mask := make([]byte, minSackLength)
+		for seq := range c.ooo {
+			bit := int(seq - c.ackNr - 2)
+			if bit < 0 || bit >= maxOutOfOrder {
+				continue
+			}
+			for bit/8 >= len(mask) {
+				mask = append(mask, make([]byte, 4)...)
+			}
+			mask[bit/8] |= 1 << (bit % 8)
+		}
+		if len(mask) > 255-3 {
+			mask = mask[:252]
+		}
+		h.sack = mask
+	}
+	c.s.send(h, nil, c.remote)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.s.send(c.header(p.typ, p.seqNr), p.payload, c.remote)
+}
+
+// flush packetizes queued data as far as the congestion and receive windows allow
+func (c *Conn) flush() {
+	if c.state != stateConnected {
+		return
+	}
+	limit := min(int(c.window), int(c.peerWindow))
+	for len(c.sendBuf) > 0 {
+		size := min(len(c.sendBuf), payloadSize)
+		// Always allow one packet in flight so a tiny window cannot stall us
+		if c.flight > 0 && c.flight+size > limit {
+			break
+		}
+		p := &outPacket{typ: stData, seqNr: c.seqNr, payload: c.sendBuf[:size:size]}
+		c.sendBuf = c.sendBuf[size:]
+		c.seqNr++
+		c.inflight = append(c.inflight, p)
+		c.flight += size
+		c.transmit(p)
+	}
+	if len(c.sendBuf) == 0 {
+		c.sendBuf = nil
+		if c.closing && !c.finSent {
+			c.finSent = true
+			c.finSentAt = time.Now()
+			p := &outPacket{typ: stFin, seqNr: c.seqNr}
+			c.seqNr++
+			c.inflight = append(c.inflight, p)
+			c.transmit(p)
+		}
+	}
+	if len(c.sendBuf) < sendBufferSize {
+		notify(c.writable)
+	}
+}
+
+// handle processes a packet addressed to this connection
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if h.typ == stReset {
+		c.failLocked(syscall.ECONNRESET)
+		return
+	}
+	c.replyMicros = nowMicros() - h.timestamp
+	c.peerWindow = h.wndSize
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+		c.inflight = nil
+		close(c.established)
+	} else if h.typ == stSyn {
+		// Our reply to the SYN got lost
+		c.sendAck()
+		return
+	}
+
+	c.processAck(h)
+
+	switch h.typ {
+	case stData, stFin:
+		c.receive(h, payload)
+		c.sendAck()
+	}
+	c.flush()
+}
+
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin {
+		c.gotFin = true
+		c.finSeqNr = h.seqNr
+	}
+	switch {
+	case h.seqNr == c.ackNr+1:
+		c.readBuf = append(c.readBuf, payload...)
+		c.ackNr++
+		for {
+			next, ok := c.ooo[c.ackNr+1]
+			if !ok {
+				break
+			}
+			c.readBuf = append(c.readBuf, c.oooData[next.seqNr]...)
+			delete(c.ooo, next.seqNr)
+			delete(c.oooData, next.seqNr)
+			c.ackNr++
+		}
+	case seqLess(c.ackNr, h.seqNr) && int(h.seqNr-c.ackNr) < maxOutOfOrder:
+		c.ooo[h.seqNr] = h
+		c.oooData[h.seqNr] = payload
+	}
+	if c.gotFin && c.ackNr == c.finSeqNr {
+		c.eof = true
+	}
+	notify(c.readable)
+}
+
+// processAck drops acknowledged packets, samples the round trip time, feeds
+// LEDBAT and resends packets that are reported lost
+func (c *Conn) processAck(h *header) {
+	now := time.Now()
+	ackedBytes := 0
+	ack := func(p *outPacket) {
+		if p.acked {
+			return
+		}
+		p.acked = true
+		ackedBytes += len(p.payload)
+		c.flight -= len(p.payload)
+		if p.transmissions == 1 {
+			c.sampleRTT(now.Sub(p.sentAt))
+		}
+	}
+
+	for _, p := range c.inflight {
+		if !seqLess(h.ackNr, p.seqNr) {
+			ack(p)
+		}
+	}
+	for i, b := range h.sack {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) == 0 {
+				continue
+			}
+			seq := h.ackNr + 2 + uint16(i*8+bit)
+			for _, p := range c.inflight {
+				if p.seqNr == seq {
+					ack(p)
+				}
+			}
+		}
+	}
+
+	// A packet that three later packets overtook is lost. Acknowledged packets
+	// leave inflight below, so every acked one here was acked by this packet
+	// and skipped adds up over several acks.
+	lost := false
+	overtaken := 0
+	for i := len(c.inflight) - 1; i >= 0; i-- {
+		p := c.inflight[i]
+		if p.acked {
+			overtaken++
+			continue
+		}
+		p.skipped += overtaken
+		if p.skipped >= 3 && p.transmissions == 1 {
+			c.transmit(p)
+			lost = true
+		}
+	}
+	if h.typ == stState && h.ackNr == c.lastAck && ackedBytes == 0 && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.inflight[0].acked {
+			c.transmit(c.inflight[0])
+			lost = true
+		}
+	} else {
+		c.dupAcks = 0
+	}
+	c.lastAck = h.ackNr
+
+	remaining := c.inflight[:0]
+	for _, p := range c.inflight {
+		if !p.acked {
+			remaining = append(remaining, p)
+		}
+	}
+	c.inflight = remaining
+
+	if ackedBytes > 0 {
+		// Progress undoes the backoff of earlier timeouts
+		c.timeouts = 0
+		if c.rtt > 0 {
+			c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+		}
+		if h.tsDiff != 0 {
+			c.ledbat(ackedBytes, h.tsDiff, now)
+		}
+	}
+	if lost {
+		c.window = max(c.window/2, minWindow)
+	}
+	if c.finSent && len(c.inflight) == 0 && c.closing {
+		c.shutdownLocked()
+	}
+}
+
+func (c *Conn) sampleRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+// ledbat grows the window while the queuing delay is below target and shrinks it above
+func (c *Conn) ledbat(ackedBytes int, delay uint32, now time.Time) {
+	// The base delay is the lowest delay seen lately, anything above it is queuing
+	kept := c.baseDelays[:0]
+	for _, d := range c.baseDelays {
+		if now.Sub(d.at) < baseDelayWindow && d.delay <= delay {
+			kept = append(kept, d)
+		}
+	}
+	c.baseDelays = append(kept, delaySample{at: now, delay: delay})
+	base := c.baseDelays[0].delay
+	queuing := time.Duration(delay-base) * time.Microsecond
+
+	offTarget := float64(target-queuing) / float64(target)
+	windowFactor := float64(ackedBytes) / max(c.window, float64(ackedBytes))
+	c.window += maxWindowIncrease * offTarget * windowFactor
+	c.window = min(max(c.window, minWindow), float64(sendBufferSize))
+}
+
+// tick resends timed out packets and tears the connection down when it is done
+func (c *Conn) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		c.checkTimeouts(time.Now())
+		c.mu.Unlock()
+	}
+}
+
+func (c *Conn) checkTimeouts(now time.Time) {
+	if c.finSent && now.Sub(c.finSentAt) > finTimeout {
+		c.failLocked(os.ErrDeadlineExceeded)
+		return
+	}
+	if len(c.inflight) == 0 {
+		return
+	}
+	oldest := c.inflight[0]
+	if now.Sub(oldest.sentAt) < c.rto {
+		return
+	}
+	c.timeouts++
+	limit := maxRetransmits
+	if c.state == stateSynSent {
+		limit = synRetries
+	}
+	if c.timeouts > limit {
+		c.failLocked(os.ErrDeadlineExceeded)
+		return
+	}
+	rto := c.rto
+	c.rto = min(c.rto*2, maxRTO)
+	c.window = minWindow
+	if oldest.typ == stSyn {
+		h := c.header(stSyn, oldest.seqNr)
+		h.connID = c.recvID
+		oldest.sentAt = now
+		oldest.transmissions++
+		c.s.send(h, nil, c.remote)
+		return
+	}
+	for _, p := range c.inflight {
+		if now.Sub(p.sentAt) >= rto {
+			c.transmit(p)
+		}
+	}
+}
+
+// fail tears the connection down with an error
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	if c.state == stateSynSent {
+		close(c.established)
+	} else if err != syscall.ECONNRESET {
+		// Let the remote know instead of leaving it waiting
+		c.s.send(c.header(stReset, c.seqNr), nil, c.remote)
+	}
+	c.shutdownLocked()
+}
+
+func (c *Conn) shutdownLocked() {
+	if c.state == stateClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.state = stateClosed
+	close(c.done)
+	notify(c.readable)
+	notify(c.writable)
+	go c.s.remove(c)
+}
+
+// wait blocks until ch is signalled, the deadline passes or the connection ends.
+// The caller holds mu, which is released while waiting.
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-c.done:
+		return nil
+	case <-c.closed:
+		return nil
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		// A closed connection is closed for reading at once, even while its FIN is still going out
+		if c.closing {
+			return 0, net.ErrClosed
+		}
+		if len(c.readBuf) > 0 {
+			break
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			return 0, c.err
+		}
+		if err := c.wait(c.readable, c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.state == stateClosed {
+			return written, c.err
+		}
+		if c.closing {
+			return written, net.ErrClosed
+		}
+		room := sendBufferSize - len(c.sendBuf)
+		if room <= 0 {
+			if err := c.wait(c.writable, c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(room, len(b)-written)
+		c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+		written += n
+		c.flush()
+	}
+	return written, nil
+}
+
+// Close makes blocked and later reads and writes fail with net.ErrClosed. The
+// queued data and a FIN are sent in the background, the connection goes away
+// once the FIN is acknowledged or finTimeout passes.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed || c.closing {
+		return nil
+	}
+	c.closing = true
+	close(c.closed)
+	if c.state == stateSynSent {
+		c.shutdownLocked()
+		return nil
+	}
+	c.flush()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
@@ -0,0 +1,289 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipe is one end of an in-memory packet link. Drop decides which outgoing
+// packets are lost and delay how late the others arrive, so packets can
+// overtake each other.
+type pipe struct {
+	addr   pipeAddr
+	remote *pipe
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	drop  func(h *header) bool
+	delay func() time.Duration
+}
+
+func newPipes() (*pipe, *pipe) {
+	a := &pipe{addr: "a", in: make(chan []byte, 4096), closed: make(chan struct{})}
+	b := &pipe{addr: "b", in: make(chan []byte, 4096), closed: make(chan struct{})}
+	a.remote, b.remote = b, a
+	return a, b
+}
+
+// impair makes the link lossy and reordering in both directions
+func impair(a, b *pipe, lossRate float64, maxDelay time.Duration, seed int64) {
+	var mu sync.Mutex
+	r := mathrand.New(mathrand.NewSource(seed))
+	for _, p := range []*pipe{a, b} {
+		p.mu.Lock()
+		p.drop = func(*header) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return r.Float64() < lossRate
+		}
+		p.delay = func() time.Duration {
+			mu.Lock()
+			defer mu.Unlock()
+			return time.Duration(r.Int63n(int64(maxDelay)))
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *pipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-p.in:
+		return copy(b, packet), p.remote.addr, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *pipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	packet := append([]byte(nil), b...)
+	p.mu.Lock()
+	drop, delay := p.drop, p.delay
+	p.mu.Unlock()
+	if drop != nil {
+		if h, _, err := unmarshal(packet); err == nil && drop(h) {
+			return len(b), nil
+		}
+	}
+	deliver := func() {
+		select {
+		case p.remote.in <- packet:
+		default: // a full queue loses the packet, as a real one would
+		}
+	}
+	if delay != nil {
+		time.AfterFunc(delay(), deliver)
+	} else {
+		deliver()
+	}
+	return len(b), nil
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pipe) LocalAddr() net.Addr                { return p.addr }
+func (p *pipe) SetDeadline(t time.Time) error      { return nil }
+func (p *pipe) SetReadDeadline(t time.Time) error  { return nil }
+func (p *pipe) SetWriteDeadline(t time.Time) error { return nil }
+
+// connect runs uTP over the pipes and returns the dialing and the accepting end
+func connect(t *testing.T, a, b *pipe) (*Conn, *Conn) {
+	t.Helper()
+	client, server := NewSocket(a), NewSocket(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := server.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.DialAddr(ctx, b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-accepted:
+		return c.(*Conn), s.(*Conn)
+	case <-ctx.Done():
+		t.Fatal("Accept timed out")
+		return nil, nil
+	}
+}
+
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	mathrand.New(mathrand.NewSource(seed)).Read(data)
+	return data
+}
+
+// transfer writes data on one end, closes it and checks that the other end
+// reads exactly data followed by EOF
+func transfer(t *testing.T, from, to *Conn, data []byte) {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		if err == nil {
+			err = from.Close()
+		}
+		errs <- err
+	}()
+	to.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(to)
+	if err != nil {
+		t.Fatalf("Read after %d bytes: %v", len(got), err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	a, b := newPipes()
+	client, server := connect(t, a, b)
+	transfer(t, client, server, randomData(1<<20, 1))
+}
+
+func TestTransferLossyReordering(t *testing.T) {
+	a, b := newPipes()
+	client, server := connect(t, a, b)
+	impair(a, b, 0.05, 20*time.Millisecond, 2)
+	// The acks cross the same bad link as the data
+	transfer(t, client, server, randomData(512<<10, 3))
+}
+
+func TestSelectiveAckRecovery(t *testing.T) {
+	a, b := newPipes()
+	client, server := connect(t, a, b)
+	// Lose the first transmission of one data packet in the middle
+	var mu sync.Mutex
+	var lost uint16
+	dropped := false
+	a.mu.Lock()
+	a.drop = func(h *header) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if h.typ != stData {
+			return false
+		}
+		if !dropped {
+			if lost == 0 {
+				lost = h.seqNr + 2
+			}
+			if h.seqNr == lost {
+				dropped = true
+				return true
+			}
+		}
+		return false
+	}
+	a.mu.Unlock()
+
+	start := time.Now()
+	transfer(t, client, server, randomData(64*payloadSize, 4))
+	mu.Lock()
+	defer mu.Unlock()
+	if !dropped {
+		t.Fatal("No packet was dropped")
+	}
+	// Waiting for the retransmission timeout would take at least minRTO
+	if elapsed := time.Since(start); elapsed >= minRTO {
+		t.Fatalf("Recovery took %s, the selective acks were not used", elapsed)
+	}
+}
+
+func TestCloseWakesReader(t *testing.T) {
+	a, b := newPipes()
+	client, _ := connect(t, a, b)
+	// The peer never acknowledges the FIN, Close must not wait for it
+	a.mu.Lock()
+	a.drop = func(*header) bool { return true }
+	a.mu.Unlock()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-read:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Read = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wake the blocked Read")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Close took %s", elapsed)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after Close = %v, want net.ErrClosed", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestCloseFlushesQueuedData(t *testing.T) {
+	a, b := newPipes()
+	client, server := connect(t, a, b)
+	impair(a, b, 0.05, 10*time.Millisecond, 5)
+	// Close right after a write that is still queued, the data and the FIN
+	// go out in the background
+	data := randomData(256<<10, 6)
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+	// The acknowledged FIN tears the closed connection down
+	select {
+	case <-client.done:
+	case <-time.After(finTimeout):
+		t.Fatal("Closed connection not torn down after its FIN was acknowledged")
+	}
+}
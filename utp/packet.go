@@ -0,0 +1,105 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version       = 1
+	headerSize    = 20
+	extNone       = 0
+	extSelectAck  = 1
+	minSackLength = 4
+)
+
+var errInvalidPacket = errors.New("utp: invalid packet")
+
+type header struct {
+	typ       uint8
+	connID    uint16
+	timestamp uint32 // microseconds
+	tsDiff    uint32 // microseconds
+	wndSize   uint32
+	seqNr     uint16
+	ackNr     uint16
+	// sack is the selective ack bitmask, bit i acknowledges ackNr+2+i
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if len(h.sack) > 0 {
+		size += 2 + len(h.sack)
+	}
+	buf := make([]byte, size)
+	buf[0] = h.typ<<4 | version
+	if len(h.sack) > 0 {
+		buf[1] = extSelectAck
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:], h.ackNr)
+	offset := headerSize
+	if len(h.sack) > 0 {
+		buf[offset] = extNone
+		buf[offset+1] = byte(len(h.sack))
+		offset += 2 + copy(buf[offset+2:], h.sack)
+	}
+	copy(buf[offset:], payload)
+	return buf
+}
+
+// unmarshal parses a packet and returns its header and payload
+func unmarshal(buf []byte) (*header, []byte, error) {
+	if len(buf) < headerSize || buf[0]&0x0f != version || buf[0]>>4 > stSyn {
+		return nil, nil, errInvalidPacket
+	}
+	h := &header{
+		typ:       buf[0] >> 4,
+		connID:    binary.BigEndian.Uint16(buf[2:]),
+		timestamp: binary.BigEndian.Uint32(buf[4:]),
+		tsDiff:    binary.BigEndian.Uint32(buf[8:]),
+		wndSize:   binary.BigEndian.Uint32(buf[12:]),
+		seqNr:     binary.BigEndian.Uint16(buf[16:]),
+		ackNr:     binary.BigEndian.Uint16(buf[18:]),
+	}
+	ext := buf[1]
+	offset := headerSize
+	for ext != extNone {
+		if len(buf) < offset+2 {
+			return nil, nil, errInvalidPacket
+		}
+		next, length := buf[offset], int(buf[offset+1])
+		offset += 2
+		if len(buf) < offset+length {
+			return nil, nil, errInvalidPacket
+		}
+		if ext == extSelectAck {
+			if length < minSackLength || length%4 != 0 {
+				return nil, nil, errInvalidPacket
+			}
+			h.sack = buf[offset : offset+length]
+		}
+		offset += length
+		ext = next
+	}
+	return h, buf[offset:], nil
+}
+
+// seqLess compares sequence numbers, taking wrap-around into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
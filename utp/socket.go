@@ -0,0 +1,214 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// stream over UDP whose LEDBAT congestion control yields to other traffic.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptBacklog is the number of incoming connections waiting for Accept
+const acceptBacklog = 32
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It both dials and
+// accepts, so outgoing connections share the listen port. It implements net.Listener.
+type Socket struct {
+	pc        net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP socket on addr, e.g. ":6881"
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over an existing packet connection
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Addr returns the local address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close stops the socket and resets every connection on it
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+		err = s.pc.Close()
+	})
+	return err
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial connects to addr, e.g. "192.0.2.1:6881"
+func (s *Socket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.DialAddr(ctx, remote)
+}
+
+// DialAddr connects to a remote address of the underlying packet connection
+func (s *Socket) DialAddr(ctx context.Context, remote net.Addr) (net.Conn, error) {
+	s.mu.Lock()
+	var id uint16
+	for {
+		id = randomUint16()
+		if _, taken := s.conns[connKey{remote.String(), id}]; !taken {
+			break
+		}
+	}
+	// The dialing side receives on id and sends on id+1, the accepting side the other way round
+	c := newConn(s, remote, id, id+1)
+	s.conns[connKey{remote.String(), c.recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.sendSyn()
+	c.mu.Unlock()
+
+	select {
+	case <-c.established:
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			continue
+		}
+		h, payload, err := unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte(nil), payload...), addr)
+	}
+}
+
+func (s *Socket) dispatch(h *header, payload []byte, addr net.Addr) {
+	key := connKey{addr.String(), h.connID}
+	if h.typ == stSyn {
+		key.id = h.connID + 1
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	if !ok && h.typ == stSyn {
+		select {
+		case <-s.closed:
+		default:
+			if len(s.accept) < cap(s.accept) {
+				c = newConn(s, addr, h.connID+1, h.connID)
+				s.conns[key] = c
+				c.mu.Lock()
+				c.state = stateConnected
+				c.seqNr = randomUint16()
+				c.ackNr = h.seqNr
+				c.mu.Unlock()
+				close(c.established)
+				s.accept <- c
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		if h.typ != stReset {
+			s.send(&header{typ: stReset, connID: h.connID, ackNr: h.seqNr, timestamp: nowMicros()}, nil, addr)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+func (s *Socket) send(h *header, payload []byte, addr net.Addr) {
+	s.pc.WriteTo(h.marshal(payload), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+var epoch = time.Now()
+
+func nowMicros() uint32 {
+	return uint32(time.Since(epoch).Microseconds())
+}
@@ -0,0 +1,214 @@
+// Package webseed downloads pieces from HTTP servers that mirror a torrent,
+// either as plain files (BEP 19 url-list) or through a seeding script (BEP 17 httpseeds).
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestTimeout bounds a single HTTP request
+const requestTimeout = 60 * time.Second
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// BusyError is returned when a BEP 17 seed answers 503, asking to come back later
+type BusyError struct {
+	URL string
+	// RetryAfter is how long the seed asked us to wait, zero if it did not say
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("Web seed %s is busy, retry in %s", e.URL, e.RetryAfter)
+}
+
+// File is a file of the torrent as laid out on the mirror
+type File struct {
+	Path   []string
+	Length int64
+	// Padding files are zeros that the mirror does not host
+	Padding bool
+}
+
+// URLSeed is a BEP 19 web seed, a server hosting the files of the torrent
+type URLSeed struct {
+	URL string
+	// Name is the name of the torrent, the file name of a single file
+	// torrent or the directory of a multi-file one
+	Name string
+	// Files is the layout of a multi-file torrent, nil for a single file
+	Files  []File
+	Length int64
+}
+
+func (s *URLSeed) String() string {
+	return s.URL
+}
+
+// fileURL returns the URL of the file with the given path below the torrent name
+func (s *URLSeed) fileURL(path []string) string {
+	if !strings.HasSuffix(s.URL, "/") {
+		// A URL not ending in a slash points right at a single file
+		if s.Files == nil {
+			return s.URL
+		}
+		return s.URL + "/" + escape(append([]string{s.Name}, path...))
+	}
+	return s.URL + escape(append([]string{s.Name}, path...))
+}
+
+func escape(parts []string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	return strings.Join(escaped, "/")
+}
+
+// FetchPiece downloads the length bytes at offset begin of the torrent,
+// with one range request per file the piece overlaps
+func (s *URLSeed) FetchPiece(ctx context.Context, index int, begin int64, length int) ([]byte, error) {
+	files := s.Files
+	if files == nil {
+		files = []File{{Length: s.Length}}
+	}
+	buf := make([]byte, 0, length)
+	end := begin + int64(length)
+	var offset int64
+	for _, file := range files {
+		start := max(begin, offset)
+		stop := min(end, offset+file.Length)
+		if start < stop && file.Padding {
+			buf = append(buf, make([]byte, stop-start)...)
+		} else if start < stop {
+			data, err := fetchRange(ctx, s.fileURL(file.Path), start-offset, stop-offset)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, data...)
+		}
+		offset += file.Length
+	}
+	if len(buf) != length {
+		return nil, fmt.Errorf("Web seed %s served %d bytes for piece #%d, expected %d", s.URL, len(buf), index, length)
+	}
+	return buf, nil
+}
+
+// fetchRange downloads bytes [start, stop) of the file at rawURL
+func fetchRange(ctx context.Context, rawURL string, start, stop int64) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, stop-1))
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body := io.LimitReader(response.Body, stop+1)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		// A server may answer with another range than we asked for
+		first, err := rangeStart(response.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, fmt.Errorf("Web seed %s: %w", rawURL, err)
+		}
+		if first != start {
+			return nil, fmt.Errorf("Web seed %s returned a range starting at %d, expected %d", rawURL, first, start)
+		}
+		data, err := io.ReadAll(io.LimitReader(body, stop-start+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != stop-start {
+			return nil, fmt.Errorf("Web seed %s returned %d bytes for a range of %d", rawURL, len(data), stop-start)
+		}
+		return data, nil
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file
+		if _, err := io.CopyN(io.Discard, body, start); err != nil {
+			return nil, err
+		}
+		data := make([]byte, stop-start)
+		if _, err := io.ReadFull(body, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("Web seed %s returned %s", rawURL, response.Status)
+	}
+}
+
+// rangeStart parses the first byte position of a Content-Range header such as "bytes 0-99/1234"
+func rangeStart(header string) (int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	first, _, found := strings.Cut(spec, "-")
+	if !ok || !found {
+		return 0, fmt.Errorf("Invalid Content-Range %q", header)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("Invalid Content-Range %q", header)
+	}
+	return start, nil
+}
+
+// HTTPSeed is a BEP 17 web seed, a script serving pieces by info hash and index
+type HTTPSeed struct {
+	URL      string
+	InfoHash [20]byte
+}
+
+func (s *HTTPSeed) String() string {
+	return s.URL
+}
+
+// FetchPiece downloads a whole piece
+func (s *HTTPSeed) FetchPiece(ctx context.Context, index int, begin int64, length int) ([]byte, error) {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	params.Set("info_hash", string(s.InfoHash[:]))
+	params.Set("piece", strconv.Itoa(index))
+	base.RawQuery = params.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusServiceUnavailable {
+		// The body holds the number of seconds to wait before retrying
+		retry, _ := io.ReadAll(io.LimitReader(response.Body, 16))
+		seconds, _ := strconv.Atoi(strings.TrimSpace(string(retry)))
+		return nil, &BusyError{URL: s.URL, RetryAfter: time.Duration(max(seconds, 0)) * time.Second}
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Web seed %s returned %s", s.URL, response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, int64(length)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf("Web seed %s returned %d bytes for piece #%d, expected %d", s.URL, len(data), index, length)
+	}
+	return data, nil
+}
@@ -0,0 +1,195 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func content(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// mirror serves files by URL path. Unless ignoreRange is set, range requests
+// get 206 answers through http.ServeContent.
+func mirror(t *testing.T, files map[string][]byte, ignoreRange bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if ignoreRange {
+			w.Write(data)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fetchAll fetches the torrent piece by piece and checks it against want
+func fetchAll(t *testing.T, seed *URLSeed, want []byte, pieceLength int) {
+	t.Helper()
+	for index := 0; index*pieceLength < len(want); index++ {
+		begin := index * pieceLength
+		end := min(begin+pieceLength, len(want))
+		got, err := seed.FetchPiece(context.Background(), index, int64(begin), end-begin)
+		if err != nil {
+			t.Fatalf("Piece #%d: %v", index, err)
+		}
+		if !bytes.Equal(got, want[begin:end]) {
+			t.Fatalf("Piece #%d differs from the content", index)
+		}
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	data := content(1000, 1)
+	for _, ignoreRange := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignoreRange=%t", ignoreRange), func(t *testing.T) {
+			srv := mirror(t, map[string][]byte{"/data/movie file.mkv": data}, ignoreRange)
+			// A URL ending in a slash gets the name appended, any other points at the file
+			fetchAll(t, &URLSeed{URL: srv.URL + "/data/", Name: "movie file.mkv", Length: int64(len(data))}, data, 128)
+			fetchAll(t, &URLSeed{URL: srv.URL + "/data/movie%20file.mkv", Name: "other", Length: int64(len(data))}, data, 300)
+		})
+	}
+}
+
+func TestMultiFile(t *testing.T) {
+	a, b, c := content(100, 2), content(300, 3), content(50, 4)
+	files := []File{
+		{Path: []string{"a.bin"}, Length: 100},
+		{Path: []string{".pad", "28"}, Length: 28, Padding: true},
+		{Path: []string{"sub dir", "b.bin"}, Length: 300},
+		{Path: []string{"c.bin"}, Length: 50},
+	}
+	var want []byte
+	want = append(want, a...)
+	want = append(want, make([]byte, 28)...)
+	want = append(want, b...)
+	want = append(want, c...)
+
+	for _, ignoreRange := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignoreRange=%t", ignoreRange), func(t *testing.T) {
+			// The padding file is not on the mirror, fetching it fails the test
+			srv := mirror(t, map[string][]byte{
+				"/torrent/a.bin":         a,
+				"/torrent/sub dir/b.bin": b,
+				"/torrent/c.bin":         c,
+			}, ignoreRange)
+			for _, url := range []string{srv.URL + "/", srv.URL} {
+				seed := &URLSeed{URL: url, Name: "torrent", Files: files, Length: int64(len(want))}
+				// Pieces of 64 bytes cross every boundary, pieces of 256 span several files
+				fetchAll(t, seed, want, 64)
+				fetchAll(t, seed, want, 256)
+			}
+		})
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	srv := mirror(t, map[string][]byte{}, false)
+	seed := &URLSeed{URL: srv.URL + "/", Name: "gone.bin", Length: 100}
+	if _, err := seed.FetchPiece(context.Background(), 0, 0, 100); err == nil {
+		t.Fatal("Fetched a piece of a file the mirror does not have")
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	data := content(1000, 5)
+	tests := []struct {
+		name   string
+		header func(start, stop int) string
+		ok     bool
+	}{
+		{"matching", func(start, stop int) string { return fmt.Sprintf("bytes %d-%d/1000", start, stop-1) }, true},
+		{"other start", func(start, stop int) string { return fmt.Sprintf("bytes %d-%d/1000", start+1, stop) }, false},
+		{"missing", func(int, int) string { return "" }, false},
+		{"malformed", func(int, int) string { return "bytes */1000" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var start, stop int
+				fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &stop)
+				stop++
+				// Always send the bytes that were asked for, only the header varies
+				if h := tt.header(start, stop); h != "" {
+					w.Header().Set("Content-Range", h)
+				}
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data[start:stop])
+			}))
+			defer srv.Close()
+			seed := &URLSeed{URL: srv.URL + "/f", Name: "f", Length: int64(len(data))}
+			got, err := seed.FetchPiece(context.Background(), 1, 200, 200)
+			if tt.ok && (err != nil || !bytes.Equal(got, data[200:400])) {
+				t.Fatalf("FetchPiece = %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("FetchPiece took a range with a bad Content-Range")
+			}
+		})
+	}
+}
+
+func TestHTTPSeed(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, '&', '=', ' '}
+	data := content(1000, 6)
+	const pieceLength = 256
+	busy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != string(infoHash[:]) || r.URL.Query().Get("key") != "v" {
+			http.Error(w, "unknown torrent", http.StatusNotFound)
+			return
+		}
+		if busy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("42\n"))
+			return
+		}
+		index, err := strconv.Atoi(r.URL.Query().Get("piece"))
+		if err != nil || index*pieceLength >= len(data) {
+			http.Error(w, "bad piece", http.StatusBadRequest)
+			return
+		}
+		w.Write(data[index*pieceLength : min((index+1)*pieceLength, len(data))])
+	}))
+	defer srv.Close()
+	seed := &HTTPSeed{URL: srv.URL + "/seed?key=v", InfoHash: infoHash}
+
+	_, err := seed.FetchPiece(context.Background(), 0, 0, pieceLength)
+	var busyErr *BusyError
+	if !errors.As(err, &busyErr) || busyErr.RetryAfter != 42*time.Second {
+		t.Fatalf("FetchPiece from a busy seed = %v, want a BusyError asking for 42s", err)
+	}
+
+	busy = false
+	for index := 0; index*pieceLength < len(data); index++ {
+		begin := index * pieceLength
+		end := min(begin+pieceLength, len(data))
+		got, err := seed.FetchPiece(context.Background(), index, int64(begin), end-begin)
+		if err != nil {
+			t.Fatalf("Piece #%d: %v", index, err)
+		}
+		if !bytes.Equal(got, data[begin:end]) {
+			t.Fatalf("Piece #%d differs from the content", index)
+		}
+	}
+	// A piece of the wrong size is an error
+	if _, err := seed.FetchPiece(context.Background(), 0, 0, pieceLength+1); err == nil {
+		t.Fatal("FetchPiece took a short piece")
+	}
+}